@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"data_ram/ramcore"
+	"data_ram/ramformats"
+	"data_ram/ramio"
+	"data_ram/ramstream"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// baseConfig loads the file given by -config, if any, and applies environment
+// overrides. Command line flags are bound on top of the result so they win.
+func baseConfig(args []string) (ramcore.Config, error) {
+	cfg := ramcore.Config{}
+	if path := findConfigFlag(args); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("Error reading config file: %v", err)
+		}
+		cfg, err = ramcore.ParseConfig(data, filepath.Ext(path))
+		if err != nil {
+			return cfg, fmt.Errorf("Error parsing config file %s: %v", path, err)
+		}
+	}
+	if err := ramcore.ApplyEnvOverrides(&cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// findConfigFlag pulls the -config value out of args before the flag set is built.
+func findConfigFlag(args []string) string {
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+func addSenderFlags(fs *flag.FlagSet, cfg *ramcore.Config) {
+	if cfg.SenderType == "" {
+		cfg.SenderType = ramcore.StreamTypeTCP
+	}
+	fs.StringVar(&cfg.SenderType, "transport", cfg.SenderType, "Sender transport: tcp, tls, quic, udp, unix, fifo, stdio, http, https, ws or wss")
+	fs.StringVar(&cfg.SenderAddress, "to", cfg.SenderAddress, "Receiver address host:port, or a path for unix and fifo")
+	fs.StringVar(&cfg.PickupPath, "pickup", cfg.PickupPath, "Directory to pick files up from")
+	fs.StringVar(&cfg.PickupRegex, "regex", cfg.PickupRegex, "Only pick up file names matching this regex")
+	fs.BoolVar(&cfg.IgnoreDotFiles, "ignore-dot-files", cfg.IgnoreDotFiles, "Skip files starting with a dot")
+	fs.Int64Var(&cfg.ChunkSize, "chunk-size", cfg.ChunkSize, "Bytes of file data per export bundle")
+	fs.IntVar(&cfg.MaxBundleCount, "max-bundle-count", cfg.MaxBundleCount, "Maximum files per export bundle")
+	fs.IntVar(&cfg.MaxQueueSize, "max-queue-size", cfg.MaxQueueSize, "Maximum files waiting to be bundled")
+	fs.IntVar(&cfg.MaxOpenFiles, "max-open-files", cfg.MaxOpenFiles, "Maximum files kept open at once while sending")
+	fs.IntVar(&cfg.Connections, "connections", cfg.Connections, "Bundles sent at once, each on its own tcp connection or quic stream")
+	fs.BoolVar(&cfg.QUICDatagrams, "quic-datagrams", cfg.QUICDatagrams, "Send data records as unreliable quic datagrams, resending what the receiver reports missing")
+	fs.IntVar(&cfg.UDPPacketLen, "udp-packet-len", cfg.UDPPacketLen, "Largest datagram a udp sender sends")
+	fs.IntVar(&cfg.UDPRedundancy, "udp-redundancy", cfg.UDPRedundancy, "Times a udp sender sends every packet")
+	fs.IntVar(&cfg.UDPFECGroup, "udp-fec-group", cfg.UDPFECGroup, "Packets a udp sender covers with each parity packet, 0 for none")
+	fs.Int64Var(&cfg.UDPSendRate, "udp-send-rate", cfg.UDPSendRate, "Bytes per second a udp sender sends, 0 for no limit")
+	fs.IntVar(&cfg.FECData, "fec-data", cfg.FECData, "Data records covered by each group of parity records, 0 for none")
+	fs.IntVar(&cfg.FECParity, "fec-parity", cfg.FECParity, "Parity records sent after each group, that many lost records can be rebuilt")
+	fs.IntVar(&cfg.PollIntervalMs, "poll-ms", cfg.PollIntervalMs, "Pickup directory scan interval in milliseconds")
+	fs.StringVar(&cfg.HashAlgorithm, "hash", cfg.HashAlgorithm, "Whole file hash for verification: sha256, sha512 or none")
+	fs.IntVar(&cfg.FormatVersion, "format", cfg.FormatVersion, "Export bundle wire format version, 1 for older receivers (default 2)")
+	fs.StringVar(&cfg.StateDirectory, "state-dir", cfg.StateDirectory, "Directory for the export journal so sends resume after a restart")
+}
+
+func addListenerFlags(fs *flag.FlagSet, cfg *ramcore.Config) {
+	if cfg.ListenerType == "" {
+		cfg.ListenerType = ramcore.StreamTypeTCP
+	}
+	fs.StringVar(&cfg.ListenerType, "listen-transport", cfg.ListenerType, "Listener transport: tcp, tls, quic, udp, unix, fifo, stdio, http, https, ws or wss")
+	fs.StringVar(&cfg.ListenerAddress, "listen", cfg.ListenerAddress, "Address to listen on host:port, or a path for unix and fifo")
+	fs.StringVar(&cfg.ProcessingDirectory, "processing-dir", cfg.ProcessingDirectory, "Directory files are reassembled in")
+	fs.IntVar(&cfg.BufferSize, "buffer-size", cfg.BufferSize, "Receive buffer size in bytes")
+	fs.BoolVar(&cfg.Preallocate, "preallocate", cfg.Preallocate, "Reserve disk space for each incoming file up front")
+}
+
+func addTLSFlags(fs *flag.FlagSet, cfg *ramcore.Config) {
+	fs.StringVar(&cfg.CertFile, "cert", cfg.CertFile, "TLS certificate PEM file")
+	fs.StringVar(&cfg.KeyFile, "key", cfg.KeyFile, "TLS key PEM file")
+	fs.StringVar(&cfg.CAFile, "ca", cfg.CAFile, "CA bundle a sender verifies the listener against")
+	fs.StringVar(&cfg.ClientCAFile, "client-ca", cfg.ClientCAFile, "CA bundle a listener requires client certificates from")
+	fs.StringVar(&cfg.ServerName, "server-name", cfg.ServerName, "Name expected on the listener's certificate, defaults to the host sent to")
+	fs.StringVar(&cfg.SPKIPins, "spki-pins", cfg.SPKIPins, "Comma separated base64 SHA-256 hashes of listener keys to accept")
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.String("config", "", "YAML, JSON or TOML config file, flags override its values")
+	return fs
+}
+
+func runSend(args []string) int {
+	cfg, err := baseConfig(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	fs := newFlagSet("send")
+	addSenderFlags(fs, &cfg)
+	addTLSFlags(fs, &cfg)
+	once := fs.Bool("once", false, "Exit once everything in the pickup directory has been sent")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	cfg.ListenerType = ""
+	redirectLogs(cfg)
+	core := ramcore.NewCore(cfg)
+	if *once {
+		return runCore(core, core.SenderIdle)
+	}
+	return runCore(core, nil)
+}
+
+func runReceive(args []string) int {
+	cfg, err := baseConfig(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	fs := newFlagSet("receive")
+	addListenerFlags(fs, &cfg)
+	addTLSFlags(fs, &cfg)
+	fs.StringVar(&cfg.OutputDirectory, "output-dir", cfg.OutputDirectory, "Directory completed files are moved to")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	cfg.SenderType = ""
+	core := ramcore.NewCore(cfg)
+	if cfg.ListenerType == ramcore.StreamTypeStdio {
+		// Nothing more can arrive once stdin ends
+		return runCore(core, core.ListenerIdle)
+	}
+	return runCore(core, nil)
+}
+
+func runRelay(args []string) int {
+	cfg, err := baseConfig(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	fs := newFlagSet("relay")
+	addListenerFlags(fs, &cfg)
+	addSenderFlags(fs, &cfg)
+	addTLSFlags(fs, &cfg)
+	relayDir := fs.String("relay-dir", cfg.PickupPath, "Directory received files are staged in before being forwarded")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	// Received files land in the relay directory where the sender picks them up
+	cfg.PickupPath = *relayDir
+	cfg.OutputDirectory = *relayDir
+	redirectLogs(cfg)
+	return runCore(ramcore.NewCore(cfg), nil)
+}
+
+// redirectLogs sends the log to stderr when stdout carries the records.
+func redirectLogs(cfg ramcore.Config) {
+	if cfg.SenderType == ramcore.StreamTypeStdio {
+		ramstream.SetLogOutput(os.Stderr)
+	}
+}
+
+// runCore starts the core and runs until interrupted, or until done reports
+// true if it is set.
+func runCore(core *ramcore.Core, done func() bool) int {
+	if err := core.Config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+		return exitUsage
+	}
+	// Anything else is a runtime failure, such as an address that cannot be bound
+	if err := core.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Runs until done, interrupted, or the sender stops on an error it cannot retry
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for (done == nil || !done()) && core.SenderErr() == nil && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	if err := core.Stop(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := core.SenderErr(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if done != nil && !done() {
+		// Interrupted before everything was sent or delivered
+		return exitError
+	}
+	return exitOK
+}
+
+func runInspect(args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: dataram inspect <bundle file>...")
+		return exitUsage
+	}
+	code := exitOK
+	for _, path := range fs.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = exitError
+			continue
+		}
+		info, err := ramformats.InspectExportBundle(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			code = exitError
+			continue
+		}
+		printBundleInfo(path, info)
+	}
+	return code
+}
+
+func printBundleInfo(path string, info *ramformats.BundleInfo) {
+	fmt.Printf("%s: export bundle v%d\n", path, info.Version)
+	if info.Version >= ramformats.FORMAT_VERSION_2 {
+		final := ""
+		if info.Flags&ramformats.RECORD_FLAG_FINAL != 0 {
+			final = " (final)"
+		}
+		fmt.Printf("  bundle %s record %d%s\n", info.BundleID, info.Sequence, final)
+	}
+	switch info.RecordType {
+	case ramformats.METADATA_HEADER:
+		fmt.Printf("  metadata for %d file(s)\n", len(info.Meta))
+		for uuid, meta := range info.Meta {
+			fmt.Printf("  %s\n", uuid)
+			for k, v := range meta {
+				fmt.Printf("    %s: %s\n", k, v)
+			}
+		}
+	case ramformats.DATA_HEADER:
+		fmt.Printf("  data with %d segment(s)\n", len(info.Segments))
+		for _, segment := range info.Segments {
+			checksum := ""
+			if info.SegmentChecksums() {
+				checksum = fmt.Sprintf(" crc32c %08x", segment.Checksum)
+				if !segment.Valid {
+					checksum += " MISMATCH"
+				}
+			}
+			fmt.Printf("  %s bytes %d-%d of %d%s\n", segment.UUID, segment.Start,
+				segment.Start+int64(segment.Length), segment.FileSize, checksum)
+		}
+	case ramformats.PARITY_HEADER:
+		p := info.Parity
+		fmt.Printf("  parity %d of %d for records %d-%d, %d byte shard\n", p.Index+1, p.ParityShards,
+			info.Sequence, info.Sequence+p.DataShards-1, p.ShardLen)
+	}
+}
+
+func runKeygen(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	certOut := fs.String("cert-out", "cert.pem", "Certificate output file")
+	keyOut := fs.String("key-out", "key.pem", "Key output file")
+	hosts := fs.String("hosts", "localhost,127.0.0.1", "Comma separated DNS names and IP addresses")
+	days := fs.Int("days", 365, "Days the certificate is valid for")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *days <= 0 {
+		fmt.Fprintln(os.Stderr, "days must be positive")
+		return exitUsage
+	}
+	certPEM, keyPEM, err := ramio.GenerateSelfSignedCert(strings.Split(*hosts, ","), time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := os.WriteFile(*certOut, certPEM, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := os.WriteFile(*keyOut, keyPEM, 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	fmt.Printf("Wrote %s and %s\n", *certOut, *keyOut)
+	if pin, err := ramio.SPKIHashPEM(certPEM); err == nil {
+		fmt.Printf("SPKI pin: %s\n", pin)
+	}
+	return exitOK
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRun_ExitCodes(t *testing.T) {
+	if code := run(nil); code != exitUsage {
+		t.Errorf("No command: got exit code %d, want %d", code, exitUsage)
+	}
+	if code := run([]string{"teleport"}); code != exitUsage {
+		t.Errorf("Unknown command: got exit code %d, want %d", code, exitUsage)
+	}
+	if code := run([]string{"send", "-no-such-flag"}); code != exitUsage {
+		t.Errorf("Bad flag: got exit code %d, want %d", code, exitUsage)
+	}
+	// Missing pickup directory fails validation before anything starts
+	if code := run([]string{"send", "-to", "localhost:9000"}); code != exitUsage {
+		t.Errorf("Invalid config: got exit code %d, want %d", code, exitUsage)
+	}
+	// A valid config that fails at start up is a runtime failure
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := run([]string{"receive", "-listen-transport", "tls", "-listen", "127.0.0.1:9130", "-processing-dir", dir,
+		"-cert", garbage, "-key", garbage}); code != exitError {
+		t.Errorf("Start failure: got exit code %d, want %d", code, exitError)
+	}
+	if code := run([]string{"inspect"}); code != exitUsage {
+		t.Errorf("Inspect without files: got exit code %d, want %d", code, exitUsage)
+	}
+	if code := run([]string{"inspect", filepath.Join(t.TempDir(), "missing.bundle")}); code != exitError {
+		t.Errorf("Inspect missing file: got exit code %d, want %d", code, exitError)
+	}
+}
+
+func TestFindConfigFlag(t *testing.T) {
+	cases := map[string][]string{
+		"a.yaml": {"-to", "x", "-config", "a.yaml"},
+		"b.json": {"--config=b.json"},
+		"c.toml": {"--config", "c.toml", "-once"},
+		"":       {"-to", "config"},
+	}
+	for want, args := range cases {
+		if got := findConfigFlag(args); got != want {
+			t.Errorf("findConfigFlag(%v) = %q, want %q", args, got, want)
+		}
+	}
+}
+
+func TestRunKeygen(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	if code := run([]string{"keygen", "-cert-out", certPath, "-key-out", keyPath}); code != exitOK {
+		t.Fatalf("keygen failed with exit code %d", code)
+	}
+	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		t.Fatalf("Generated files do not load: %v", err)
+	}
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		t.Fatalf("Failed to stat key: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Key file permissions are %v, want 0600", info.Mode().Perm())
+	}
+}
@@ -1,12 +1,55 @@
 package main
 
 import (
-	"data_ram/ramcore"
+	"fmt"
+	"os"
 )
 
+// Exit codes for scripting
+const (
+	exitOK    = 0
+	exitError = 1 // Runtime failure
+	exitUsage = 2 // Bad arguments or config
+)
+
+const usage = `Usage: dataram <command> [flags]
+
+Commands:
+  send     Pick files up from a directory and send them to a receiver
+  receive  Listen for files and write them to an output directory
+  relay    Receive files and forward them on to another receiver
+  inspect  Decode and print export bundle files
+  keygen   Generate a self-signed TLS certificate and key
+
+Run 'dataram <command> -h' for the flags of each command.
+`
+
 func main() {
 	// Entry point for the data transport application
-	// Example: Load config, create core, start listener/sender
-	_ = ramcore.NewCore(ramcore.Config{})
+	os.Exit(run(os.Args[1:]))
+}
 
+func run(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
+	switch args[0] {
+	case "send":
+		return runSend(args[1:])
+	case "receive":
+		return runReceive(args[1:])
+	case "relay":
+		return runRelay(args[1:])
+	case "inspect":
+		return runInspect(args[1:])
+	case "keygen":
+		return runKeygen(args[1:])
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return exitOK
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", args[0], usage)
+		return exitUsage
+	}
 }
@@ -1,12 +1,296 @@
 package ramcore
 
+import (
+	"data_ram/ramformats"
+	"data_ram/ramio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Stream types that can be used for listeners and senders.
+const (
+	StreamTypeTCP   = "tcp"
+	StreamTypeQUIC  = "quic"
+	StreamTypeTLS   = "tls"   // TCP wrapped in TLS, mutual if the listener sets clientCAFile
+	StreamTypeUDP   = "udp"   // One way, for links with no return path
+	StreamTypeUnix  = "unix"  // Unix domain socket, the address is the socket path
+	StreamTypeFIFO  = "fifo"  // Named pipe, the address is the pipe path. One way and a single sender
+	StreamTypeStdio = "stdio" // Senders write to stdout and listeners read stdin, for shell pipelines. One way
+	StreamTypeHTTP  = "http"  // Records POSTed over HTTP
+	StreamTypeHTTPS = "https" // Records POSTed over HTTPS, HTTP/2 when the listener offers it
+	StreamTypeWS    = "ws"    // Records in WebSocket messages, for HTTP proxies and load balancers
+	StreamTypeWSS   = "wss"   // WebSocket over TLS
+	StreamTypeLocal = "local" // In-process hand-off from the sender straight into the local listener
+)
+
+// Defaults applied to any zero valued config fields.
+const (
+	DefaultChunkSize      = 1024 * 1024
+	DefaultMaxBundleCount = 64
+	DefaultMaxQueueSize   = 1024
+	DefaultBufferSize     = 2 * DefaultChunkSize
+	DefaultPollIntervalMs = 500
+	DefaultMaxOpenFiles   = ramformats.DEFAULT_MAX_OPEN_FILES
+	DefaultConnections    = 1
+)
+
+// Limits used when validating a config.
+const (
+	MaxChunkSize    = 1024 * 1024 * 1024
+	MaxConnections  = 64
+	MaxUDPPacketLen = 65507 // Largest UDP payload over IPv4
+	MaxUDPFECGroup  = 255
+)
+
 // Config holds configuration for listeners and senders.
+// The env tag names the environment variable that overrides each field.
 type Config struct {
-	ListenerType    string
-	ListenerAddress string
-	SenderType      string
-	SenderAddress   string
-	// Add more config fields as needed
+	ListenerType    string `json:"listenerType" yaml:"listenerType" toml:"listenerType" env:"DATARAM_LISTENER_TYPE"`
+	ListenerAddress string `json:"listenerAddress" yaml:"listenerAddress" toml:"listenerAddress" env:"DATARAM_LISTENER_ADDRESS"`
+	SenderType      string `json:"senderType" yaml:"senderType" toml:"senderType" env:"DATARAM_SENDER_TYPE"`
+	SenderAddress   string `json:"senderAddress" yaml:"senderAddress" toml:"senderAddress" env:"DATARAM_SENDER_ADDRESS"`
+
+	// Sender side
+	PickupPath     string `json:"pickupPath" yaml:"pickupPath" toml:"pickupPath" env:"DATARAM_PICKUP_PATH"`     // Directory to pick files up from
+	PickupRegex    string `json:"pickupRegex" yaml:"pickupRegex" toml:"pickupRegex" env:"DATARAM_PICKUP_REGEX"` // Only files matching this regex are picked up, empty matches all
+	IgnoreDotFiles bool   `json:"ignoreDotFiles" yaml:"ignoreDotFiles" toml:"ignoreDotFiles" env:"DATARAM_IGNORE_DOT_FILES"`
+	ChunkSize      int64  `json:"chunkSize" yaml:"chunkSize" toml:"chunkSize" env:"DATARAM_CHUNK_SIZE"`                      // Bytes of file data in each export bundle
+	MaxBundleCount int    `json:"maxBundleCount" yaml:"maxBundleCount" toml:"maxBundleCount" env:"DATARAM_MAX_BUNDLE_COUNT"` // Maximum number of files in a single export bundle
+	MaxQueueSize   int    `json:"maxQueueSize" yaml:"maxQueueSize" toml:"maxQueueSize" env:"DATARAM_MAX_QUEUE_SIZE"`         // Maximum number of files waiting to be bundled
+	PollIntervalMs int    `json:"pollIntervalMs" yaml:"pollIntervalMs" toml:"pollIntervalMs" env:"DATARAM_POLL_INTERVAL_MS"` // How often the pickup directory is scanned
+	HashAlgorithm  string `json:"hashAlgorithm" yaml:"hashAlgorithm" toml:"hashAlgorithm" env:"DATARAM_HASH_ALGORITHM"`      // Whole file hash sent for verification: sha256 (default), sha512 or none
+	MaxOpenFiles   int    `json:"maxOpenFiles" yaml:"maxOpenFiles" toml:"maxOpenFiles" env:"DATARAM_MAX_OPEN_FILES"`         // Files kept open at once while exporting
+	FormatVersion  int    `json:"formatVersion" yaml:"formatVersion" toml:"formatVersion" env:"DATARAM_FORMAT_VERSION"`      // Export bundle wire format, 1 for receivers that predate v2, 0 uses the default
+	StateDirectory string `json:"stateDirectory" yaml:"stateDirectory" toml:"stateDirectory" env:"DATARAM_STATE_DIRECTORY"`  // Export and sent file journals are kept here so sends resume after a restart and sent files are not sent again, empty disables them
+	Connections    int    `json:"connections" yaml:"connections" toml:"connections" env:"DATARAM_CONNECTIONS"`               // Bundles sent at once, each on its own TCP connection or QUIC stream
+	QUICDatagrams  bool   `json:"quicDatagrams" yaml:"quicDatagrams" toml:"quicDatagrams" env:"DATARAM_QUIC_DATAGRAMS"`      // Send data records as unreliable QUIC datagrams, lost ones are resent from the receiver's missing-range report
+	UDPPacketLen   int    `json:"udpPacketLen" yaml:"udpPacketLen" toml:"udpPacketLen" env:"DATARAM_UDP_PACKET_LEN"`         // Largest datagram a udp sender sends, 0 uses the default
+	UDPRedundancy  int    `json:"udpRedundancy" yaml:"udpRedundancy" toml:"udpRedundancy" env:"DATARAM_UDP_REDUNDANCY"`      // Times a udp sender sends every packet, 0 sends each once
+	UDPFECGroup    int    `json:"udpFecGroup" yaml:"udpFecGroup" toml:"udpFecGroup" env:"DATARAM_UDP_FEC_GROUP"`             // Packets a udp sender covers with each parity packet, 0 sends no parity
+	UDPSendRate    int64  `json:"udpSendRate" yaml:"udpSendRate" toml:"udpSendRate" env:"DATARAM_UDP_SEND_RATE"`             // Bytes per second a udp sender sends across all its connections, repeats and parity included, 0 is unlimited
+	FECData        int    `json:"fecData" yaml:"fecData" toml:"fecData" env:"DATARAM_FEC_DATA"`                              // Data records of a bundle covered by each group of parity records, 0 sends no parity records
+	FECParity      int    `json:"fecParity" yaml:"fecParity" toml:"fecParity" env:"DATARAM_FEC_PARITY"`                      // Reed-Solomon parity records sent after each fecData data records, any that many lost can be rebuilt
+
+	// Listener side
+	ProcessingDirectory string `json:"processingDirectory" yaml:"processingDirectory" toml:"processingDirectory" env:"DATARAM_PROCESSING_DIRECTORY"` // Where files are reassembled
+	OutputDirectory     string `json:"outputDirectory" yaml:"outputDirectory" toml:"outputDirectory" env:"DATARAM_OUTPUT_DIRECTORY"`                 // Completed files are moved here, if empty they stay in the processing directory
+	BufferSize          int    `json:"bufferSize" yaml:"bufferSize" toml:"bufferSize" env:"DATARAM_BUFFER_SIZE"`                                     // Receive buffer size for network listeners, also the largest bundle a tcp listener accepts
+	Preallocate         bool   `json:"preallocate" yaml:"preallocate" toml:"preallocate" env:"DATARAM_PREALLOCATE"`                                  // Reserve disk space for each incoming file up front (fallocate on linux)
+
+	// TLS, the certificate is required for quic and tls listeners.
+	// quic and tls senders present CertFile and KeyFile as their client certificate if they are set.
+	CertFile     string `json:"certFile" yaml:"certFile" toml:"certFile" env:"DATARAM_CERT_FILE"`
+	KeyFile      string `json:"keyFile" yaml:"keyFile" toml:"keyFile" env:"DATARAM_KEY_FILE"`
+	CAFile       string `json:"caFile" yaml:"caFile" toml:"caFile" env:"DATARAM_CA_FILE"`                          // CAs a quic or tls sender verifies the listener against, empty uses the system roots
+	ClientCAFile string `json:"clientCAFile" yaml:"clientCAFile" toml:"clientCAFile" env:"DATARAM_CLIENT_CA_FILE"` // CAs a quic or tls listener requires client certificates to be signed by, empty accepts any client
+	ServerName   string `json:"serverName" yaml:"serverName" toml:"serverName" env:"DATARAM_SERVER_NAME"`          // Name a sender expects on the listener's certificate, empty uses the host of senderAddress
+	SPKIPins     string `json:"spkiPins" yaml:"spkiPins" toml:"spkiPins" env:"DATARAM_SPKI_PINS"`                  // Comma separated base64 SHA-256 hashes of listener keys a sender accepts, without caFile a pin alone is trusted
+}
+
+// spkiPins splits the SPKIPins field.
+func (c Config) spkiPins() []string {
+	var pins []string
+	for _, pin := range strings.Split(c.SPKIPins, ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+	return pins
 }
 
-// ...existing code...
+// withDefaults returns a copy of the config with zero values replaced by defaults.
+func (c Config) withDefaults() Config {
+	if c.ChunkSize == 0 {
+		c.ChunkSize = DefaultChunkSize
+		if c.QUICDatagrams {
+			c.ChunkSize = ramio.QUIC_DATAGRAM_CHUNK_SIZE
+		}
+	}
+	if c.MaxBundleCount == 0 {
+		c.MaxBundleCount = DefaultMaxBundleCount
+	}
+	if c.MaxQueueSize == 0 {
+		c.MaxQueueSize = DefaultMaxQueueSize
+	}
+	if c.MaxOpenFiles == 0 {
+		c.MaxOpenFiles = DefaultMaxOpenFiles
+	}
+	if c.BufferSize == 0 {
+		c.BufferSize = DefaultBufferSize
+	}
+	if c.PollIntervalMs == 0 {
+		c.PollIntervalMs = DefaultPollIntervalMs
+	}
+	if c.Connections == 0 {
+		c.Connections = DefaultConnections
+	}
+	return c
+}
+
+// Validate checks the config, with defaults applied, and returns every problem found.
+func (c Config) Validate() error {
+	c = c.withDefaults()
+	var errs []error
+
+	if c.ListenerType == "" && c.SenderType == "" {
+		errs = append(errs, fmt.Errorf("Neither a listener nor a sender is configured"))
+	}
+	if c.ListenerType != "" {
+		errs = append(errs, validateStream("listener", c.ListenerType, c.ListenerAddress, true)...)
+		if c.ProcessingDirectory == "" {
+			errs = append(errs, fmt.Errorf("processingDirectory must be set for a listener"))
+		}
+		if c.BufferSize < 0 {
+			errs = append(errs, fmt.Errorf("bufferSize must be positive, got %d", c.BufferSize))
+		}
+	}
+	if c.SenderType != "" {
+		errs = append(errs, validateStream("sender", c.SenderType, c.SenderAddress, false)...)
+		if c.SenderType == StreamTypeLocal && c.ListenerType != StreamTypeLocal {
+			errs = append(errs, fmt.Errorf("A local sender requires a local listener"))
+		}
+		if c.PickupPath == "" {
+			errs = append(errs, fmt.Errorf("pickupPath must be set for a sender"))
+		}
+		if c.PickupRegex != "" {
+			if _, err := regexp.Compile(c.PickupRegex); err != nil {
+				errs = append(errs, fmt.Errorf("pickupRegex is not valid: %v", err))
+			}
+		}
+		if c.ChunkSize <= 0 || c.ChunkSize > MaxChunkSize {
+			errs = append(errs, fmt.Errorf("chunkSize must be between 1 and %d, got %d", MaxChunkSize, c.ChunkSize))
+		}
+		switch c.HashAlgorithm {
+		case "", ramformats.HashAlgSHA256, ramformats.HashAlgSHA512, ramformats.HashAlgNone:
+		default:
+			errs = append(errs, fmt.Errorf("hashAlgorithm must be %s, %s or %s, got %s",
+				ramformats.HashAlgSHA256, ramformats.HashAlgSHA512, ramformats.HashAlgNone, c.HashAlgorithm))
+		}
+		switch c.FormatVersion {
+		case 0, ramformats.FORMAT_VERSION_1, ramformats.FORMAT_VERSION_2:
+		default:
+			errs = append(errs, fmt.Errorf("formatVersion must be %d or %d, got %d",
+				ramformats.FORMAT_VERSION_1, ramformats.FORMAT_VERSION_2, c.FormatVersion))
+		}
+		if c.MaxOpenFiles < 0 {
+			errs = append(errs, fmt.Errorf("maxOpenFiles must be positive, got %d", c.MaxOpenFiles))
+		}
+		if c.Connections < 1 || c.Connections > MaxConnections {
+			errs = append(errs, fmt.Errorf("connections must be between 1 and %d, got %d", MaxConnections, c.Connections))
+		} else if c.Connections > 1 && c.SenderType == StreamTypeLocal {
+			errs = append(errs, fmt.Errorf("connections can only be set for network senders"))
+		} else if c.Connections > 1 && (c.SenderType == StreamTypeFIFO || c.SenderType == StreamTypeStdio) {
+			errs = append(errs, fmt.Errorf("connections cannot be set for %s senders, they have a single writer", c.SenderType))
+		}
+		if c.QUICDatagrams && c.SenderType != StreamTypeQUIC {
+			errs = append(errs, fmt.Errorf("quicDatagrams can only be set for quic senders"))
+		} else if c.QUICDatagrams && c.ChunkSize > ramio.QUIC_DATAGRAM_CHUNK_SIZE {
+			errs = append(errs, fmt.Errorf("chunkSize must be at most %d with quicDatagrams for data records to fit in a datagram, got %d", ramio.QUIC_DATAGRAM_CHUNK_SIZE, c.ChunkSize))
+		}
+		if c.SenderType == StreamTypeUDP {
+			if c.UDPPacketLen != 0 && (c.UDPPacketLen <= ramio.UDP_HEADER_LEN || c.UDPPacketLen > MaxUDPPacketLen) {
+				errs = append(errs, fmt.Errorf("udpPacketLen must be between %d and %d, got %d", ramio.UDP_HEADER_LEN+1, MaxUDPPacketLen, c.UDPPacketLen))
+			}
+			if c.UDPRedundancy < 0 {
+				errs = append(errs, fmt.Errorf("udpRedundancy must be positive, got %d", c.UDPRedundancy))
+			}
+			if c.UDPFECGroup < 0 || c.UDPFECGroup > MaxUDPFECGroup {
+				errs = append(errs, fmt.Errorf("udpFecGroup must be between 0 and %d, got %d", MaxUDPFECGroup, c.UDPFECGroup))
+			}
+			if c.UDPSendRate < 0 {
+				errs = append(errs, fmt.Errorf("udpSendRate must be positive, got %d", c.UDPSendRate))
+			}
+		}
+		if err := ramformats.ValidateFEC(c.FECData, c.FECParity); err != nil {
+			errs = append(errs, fmt.Errorf("fecData and fecParity: %v", err))
+		} else if c.FECData > 0 && c.FormatVersion == ramformats.FORMAT_VERSION_1 {
+			errs = append(errs, fmt.Errorf("fecData and fecParity need formatVersion %d", ramformats.FORMAT_VERSION_2))
+		}
+		if c.MaxBundleCount <= 0 {
+			errs = append(errs, fmt.Errorf("maxBundleCount must be positive, got %d", c.MaxBundleCount))
+		}
+	}
+	if c.BufferSize > 0 && c.ChunkSize > 0 && c.ChunkSize <= MaxChunkSize && c.MaxBundleCount > 0 {
+		// Listeners refuse records longer than bufferSize, one that can never
+		// fit would be resent forever
+		if recordLen := ramformats.MaxRecordLen(c.ChunkSize, c.MaxBundleCount, c.FECData); recordLen > int64(c.BufferSize) {
+			errs = append(errs, fmt.Errorf("bufferSize must be at least %d for records of chunkSize %d, got %d", recordLen, c.ChunkSize, c.BufferSize))
+		}
+	}
+	if c.MaxQueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("maxQueueSize must be positive, got %d", c.MaxQueueSize))
+	}
+	if c.PollIntervalMs <= 0 {
+		errs = append(errs, fmt.Errorf("pollIntervalMs must be positive, got %d", c.PollIntervalMs))
+	}
+	secureSender := c.SenderType == StreamTypeQUIC || c.SenderType == StreamTypeTLS || c.SenderType == StreamTypeHTTPS || c.SenderType == StreamTypeWSS
+	switch c.ListenerType {
+	case StreamTypeQUIC, StreamTypeTLS, StreamTypeHTTPS, StreamTypeWSS:
+		errs = append(errs, validateFile("certFile", c.CertFile)...)
+		errs = append(errs, validateFile("keyFile", c.KeyFile)...)
+	default:
+		if secureSender && (c.CertFile != "" || c.KeyFile != "") {
+			// Client certificate for mTLS
+			errs = append(errs, validateFile("certFile", c.CertFile)...)
+			errs = append(errs, validateFile("keyFile", c.KeyFile)...)
+		}
+	}
+	for _, pin := range c.spkiPins() {
+		if err := ramio.ValidateSPKIPin(pin); err != nil {
+			errs = append(errs, fmt.Errorf("spkiPins is not valid: %v", err))
+		}
+	}
+	if c.CAFile != "" {
+		errs = append(errs, validateFile("caFile", c.CAFile)...)
+	}
+	if c.ClientCAFile != "" {
+		errs = append(errs, validateFile("clientCAFile", c.ClientCAFile)...)
+	}
+	return errors.Join(errs...)
+}
+
+// validateStream checks a stream type is known and that network streams have a usable address.
+func validateStream(side string, streamType string, address string, allowEmptyHost bool) []error {
+	switch streamType {
+	case StreamTypeLocal, StreamTypeStdio:
+		return nil
+	case StreamTypeUnix, StreamTypeFIFO:
+		if address == "" {
+			return []error{fmt.Errorf("%s address must be set to a path for %s", side, streamType)}
+		}
+		return nil
+	case StreamTypeTCP, StreamTypeQUIC, StreamTypeTLS, StreamTypeUDP, StreamTypeHTTP, StreamTypeHTTPS, StreamTypeWS, StreamTypeWSS:
+	default:
+		return []error{fmt.Errorf("Unknown %s type: %s", side, streamType)}
+	}
+	if address == "" {
+		return []error{fmt.Errorf("%s address must be set for %s", side, streamType)}
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return []error{fmt.Errorf("%s address %s is not valid: %v", side, address, err)}
+	}
+	if host == "" && !allowEmptyHost {
+		return []error{fmt.Errorf("%s address %s has no host", side, address)}
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum < 1 || portNum > 65535 {
+		return []error{fmt.Errorf("%s address %s has an invalid port", side, address)}
+	}
+	return nil
+}
+
+func validateFile(name string, path string) []error {
+	if path == "" {
+		return []error{fmt.Errorf("%s must be set", name)}
+	}
+	if _, err := os.Stat(path); err != nil {
+		return []error{fmt.Errorf("%s is not readable: %v", name, err)}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package ramcore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig_Formats(t *testing.T) {
+	inputs := map[string]string{
+		".yaml": "listenerType: tcp\nlistenerAddress: \":9000\"\nprocessingDirectory: /tmp/proc\nchunkSize: 4096\nignoreDotFiles: true\n",
+		".json": `{"listenerType": "tcp", "listenerAddress": ":9000", "processingDirectory": "/tmp/proc", "chunkSize": 4096, "ignoreDotFiles": true}`,
+		".toml": "listenerType = \"tcp\"\nlistenerAddress = \":9000\"\nprocessingDirectory = \"/tmp/proc\"\nchunkSize = 4096\nignoreDotFiles = true\n",
+	}
+	for ext, input := range inputs {
+		cfg, err := ParseConfig([]byte(input), ext)
+		if err != nil {
+			t.Fatalf("ParseConfig(%s) failed: %v", ext, err)
+		}
+		if cfg.ListenerType != StreamTypeTCP || cfg.ListenerAddress != ":9000" || cfg.ProcessingDirectory != "/tmp/proc" {
+			t.Errorf("ParseConfig(%s) string fields mismatch: %+v", ext, cfg)
+		}
+		if cfg.ChunkSize != 4096 || !cfg.IgnoreDotFiles {
+			t.Errorf("ParseConfig(%s) numeric/bool fields mismatch: %+v", ext, cfg)
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Validate(%s) failed: %v", ext, err)
+		}
+	}
+}
+
+func TestParseConfig_UnknownKeys(t *testing.T) {
+	inputs := map[string]string{
+		".yml":  "listenerTyp: tcp\n",
+		".json": `{"listenerTyp": "tcp"}`,
+		".toml": "listenerTyp = \"tcp\"\n",
+	}
+	for ext, input := range inputs {
+		if _, err := ParseConfig([]byte(input), ext); err == nil {
+			t.Errorf("Expected error for unknown key in %s", ext)
+		}
+	}
+	if _, err := ParseConfig([]byte("{}"), ".ini"); err == nil {
+		t.Error("Expected error for unsupported format")
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	env := map[string]string{
+		"DATARAM_SENDER_ADDRESS":   "10.0.0.1:9000",
+		"DATARAM_CHUNK_SIZE":       "8192",
+		"DATARAM_MAX_BUNDLE_COUNT": "7",
+		"DATARAM_IGNORE_DOT_FILES": "true",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	cfg := Config{SenderAddress: "127.0.0.1:1", ChunkSize: 1}
+	if err := applyEnvOverrides(&cfg, lookup); err != nil {
+		t.Fatalf("applyEnvOverrides failed: %v", err)
+	}
+	if cfg.SenderAddress != "10.0.0.1:9000" || cfg.ChunkSize != 8192 || cfg.MaxBundleCount != 7 || !cfg.IgnoreDotFiles {
+		t.Errorf("Overrides not applied: %+v", cfg)
+	}
+
+	env = map[string]string{"DATARAM_CHUNK_SIZE": "big"}
+	if err := applyEnvOverrides(&cfg, lookup); err == nil {
+		t.Error("Expected error for non-integer override")
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cases := map[string]struct {
+		cfg  Config
+		want string
+	}{
+		"nothing":       {Config{}, "Neither a listener nor a sender"},
+		"listener type": {Config{ListenerType: "ftp", ProcessingDirectory: "/tmp"}, "Unknown listener type"},
+		"sender type":   {Config{SenderType: "ftp", PickupPath: "/tmp"}, "Unknown sender type"},
+		"bad address":   {Config{ListenerType: StreamTypeTCP, ListenerAddress: "localhost", ProcessingDirectory: "/tmp"}, "listener address localhost is not valid"},
+		"bad port":      {Config{SenderType: StreamTypeTCP, SenderAddress: "localhost:99999", PickupPath: "/tmp"}, "invalid port"},
+		"no host":       {Config{SenderType: StreamTypeTCP, SenderAddress: ":9000", PickupPath: "/tmp"}, "has no host"},
+		"no processing": {Config{ListenerType: StreamTypeLocal}, "processingDirectory must be set"},
+		"no pickup":     {Config{SenderType: StreamTypeTCP, SenderAddress: "localhost:9000"}, "pickupPath must be set"},
+		"chunk size":    {Config{SenderType: StreamTypeTCP, SenderAddress: "localhost:9000", PickupPath: "/tmp", ChunkSize: -1}, "chunkSize must be between"},
+		"bundle count":  {Config{SenderType: StreamTypeTCP, SenderAddress: "localhost:9000", PickupPath: "/tmp", MaxBundleCount: -1}, "maxBundleCount must be positive"},
+		"open files":    {Config{SenderType: StreamTypeTCP, SenderAddress: "localhost:9000", PickupPath: "/tmp", MaxOpenFiles: -1}, "maxOpenFiles must be positive"},
+		"connections":   {Config{SenderType: StreamTypeTCP, SenderAddress: "localhost:9000", PickupPath: "/tmp", Connections: -2}, "connections must be between"},
+		"local striped": {Config{SenderType: StreamTypeLocal, ListenerType: StreamTypeLocal, ProcessingDirectory: "/tmp", PickupPath: "/tmp", Connections: 4}, "connections can only be set"},
+		"queue size":    {Config{ListenerType: StreamTypeLocal, ProcessingDirectory: "/tmp", MaxQueueSize: -5}, "maxQueueSize must be positive"},
+		"hash":          {Config{SenderType: StreamTypeTCP, SenderAddress: "localhost:9000", PickupPath: "/tmp", HashAlgorithm: "md5"}, "hashAlgorithm must be"},
+		"format":        {Config{SenderType: StreamTypeTCP, SenderAddress: "localhost:9000", PickupPath: "/tmp", FormatVersion: 3}, "formatVersion must be"},
+		"regex":         {Config{SenderType: StreamTypeTCP, SenderAddress: "localhost:9000", PickupPath: "/tmp", PickupRegex: "(["}, "pickupRegex is not valid"},
+		"quic certs":    {Config{ListenerType: StreamTypeQUIC, ListenerAddress: ":9000", ProcessingDirectory: "/tmp"}, "certFile must be set"},
+		"tls certs":     {Config{ListenerType: StreamTypeTLS, ListenerAddress: ":9000", ProcessingDirectory: "/tmp"}, "certFile must be set"},
+		"client ca":     {Config{ListenerType: StreamTypeTLS, ListenerAddress: ":9000", ProcessingDirectory: "/tmp", CertFile: "/tmp", KeyFile: "/tmp", ClientCAFile: "/nonexistent.pem"}, "clientCAFile is not readable"},
+		"spki pin":      {Config{SenderType: StreamTypeQUIC, SenderAddress: "localhost:9000", PickupPath: "/tmp", SPKIPins: "abc"}, "spkiPins is not valid"},
+		"datagrams":     {Config{SenderType: StreamTypeTCP, SenderAddress: "localhost:9000", PickupPath: "/tmp", QUICDatagrams: true}, "quicDatagrams can only be set"},
+		"datagram size": {Config{SenderType: StreamTypeQUIC, SenderAddress: "localhost:9000", PickupPath: "/tmp", QUICDatagrams: true, ChunkSize: 4096}, "chunkSize must be at most"},
+		"udp packet":    {Config{SenderType: StreamTypeUDP, SenderAddress: "localhost:9000", PickupPath: "/tmp", UDPPacketLen: 10}, "udpPacketLen must be between"},
+		"udp fec":       {Config{SenderType: StreamTypeUDP, SenderAddress: "localhost:9000", PickupPath: "/tmp", UDPFECGroup: 300}, "udpFecGroup must be between"},
+		"udp rate":      {Config{SenderType: StreamTypeUDP, SenderAddress: "localhost:9000", PickupPath: "/tmp", UDPSendRate: -1}, "udpSendRate must be positive"},
+		"fec shards":    {Config{SenderType: StreamTypeUDP, SenderAddress: "localhost:9000", PickupPath: "/tmp", FECData: 4}, "fecData and fecParity"},
+		"fec format":    {Config{SenderType: StreamTypeUDP, SenderAddress: "localhost:9000", PickupPath: "/tmp", FECData: 4, FECParity: 2, FormatVersion: 1}, "need formatVersion 2"},
+		"unix path":     {Config{SenderType: StreamTypeUnix, PickupPath: "/tmp"}, "sender address must be set to a path"},
+		"fifo striped":  {Config{SenderType: StreamTypeFIFO, SenderAddress: "/tmp/dataram.fifo", PickupPath: "/tmp", Connections: 2}, "connections cannot be set for fifo"},
+		"stdio striped": {Config{SenderType: StreamTypeStdio, PickupPath: "/tmp", Connections: 2}, "connections cannot be set for stdio"},
+		"https certs":   {Config{ListenerType: StreamTypeHTTPS, ListenerAddress: ":9000", ProcessingDirectory: "/tmp"}, "certFile must be set"},
+		"wss certs":     {Config{ListenerType: StreamTypeWSS, ListenerAddress: ":9000", ProcessingDirectory: "/tmp"}, "certFile must be set"},
+		"missing cert":  {Config{ListenerType: StreamTypeQUIC, ListenerAddress: ":9000", ProcessingDirectory: "/tmp", CertFile: "/nonexistent.pem", KeyFile: "/nonexistent.pem"}, "certFile is not readable"},
+		"buffer size":   {Config{ListenerType: StreamTypeTCP, ListenerAddress: ":9000", ProcessingDirectory: "/tmp", BufferSize: 4096}, "bufferSize must be at least"},
+		"fec buffer":    {Config{SenderType: StreamTypeTCP, SenderAddress: "localhost:9000", PickupPath: "/tmp", ChunkSize: 4096, MaxBundleCount: 1, BufferSize: 4300, FECData: 4, FECParity: 2}, "bufferSize must be at least"},
+		"local sender":  {Config{SenderType: StreamTypeLocal, PickupPath: "/tmp"}, "local sender requires a local listener"},
+	}
+	for name, tc := range cases {
+		err := tc.cfg.Validate()
+		if err == nil {
+			t.Errorf("%s: expected error containing %q", name, tc.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected error containing %q, got %v", name, tc.want, err)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dataram.yaml")
+	content := "senderType: tcp\nsenderAddress: localhost:9000\npickupPath: " + dir + "\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	t.Setenv("DATARAM_SENDER_ADDRESS", "localhost:9100")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.SenderAddress != "localhost:9100" {
+		t.Errorf("Env override not applied, got %s", cfg.SenderAddress)
+	}
+
+	t.Setenv("DATARAM_SENDER_TYPE", "smoke-signal")
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("Expected validation error after bad env override")
+	}
+	if _, err := LoadConfig(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("Expected error for missing config file")
+	}
+}
@@ -0,0 +1,108 @@
+package ramcore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfig reads a YAML, JSON or TOML config file, chosen by file extension,
+// applies environment variable overrides and validates the result.
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("Error reading config file: %v", err)
+	}
+	cfg, err := ParseConfig(data, filepath.Ext(path))
+	if err != nil {
+		return Config{}, fmt.Errorf("Error parsing config file %s: %v", path, err)
+	}
+	if err := ApplyEnvOverrides(&cfg); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("Invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig decodes config data in the format given by ext (".yaml", ".yml", ".json" or ".toml").
+// Unknown keys are rejected so typos do not silently fall back to defaults.
+func ParseConfig(data []byte, ext string) (Config, error) {
+	var cfg Config
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, err
+		}
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			return Config{}, err
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), &cfg)
+		if err != nil {
+			return Config{}, err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return Config{}, fmt.Errorf("unknown config keys: %v", undecoded)
+		}
+	default:
+		return Config{}, fmt.Errorf("unsupported config format %q", ext)
+	}
+	return cfg, nil
+}
+
+// ApplyEnvOverrides sets any config field whose env tag names a set environment variable.
+func ApplyEnvOverrides(cfg *Config) error {
+	return applyEnvOverrides(cfg, os.LookupEnv)
+}
+
+func applyEnvOverrides(cfg *Config, lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		envName := t.Field(i).Tag.Get("env")
+		if envName == "" {
+			continue
+		}
+		value, ok := lookup(envName)
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Error parsing %s=%q as an integer: %v", envName, value, err)
+			}
+			field.SetInt(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("Error parsing %s=%q as a bool: %v", envName, value, err)
+			}
+			field.SetBool(b)
+		default:
+			return fmt.Errorf("Unsupported type for %s", envName)
+		}
+	}
+	return nil
+}
@@ -1,13 +1,620 @@
 package ramcore
 
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"data_ram/ramformats"
+	"data_ram/raminputs"
+	"data_ram/ramio"
+	"data_ram/ramstream"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// File names used inside Config.StateDirectory
+const (
+	exportStateFile = "export.json"
+	sentStateFile   = "sent.json"
+)
+
+// How many times missing ranges are resent before giving up until the next pulse
+const maxResendRounds = 3
+
 // Core coordinates listeners and senders using the config.
+//
+// The sender side picks files up from a local directory, bundles them with a
+// RamExportBundle and writes the bundles to the configured stream. The listener
+// side feeds received bundles into a RamImportBundle and delivers the completed
+// files to the output directory and FileHandler.
 type Core struct {
 	Config Config
+	// FileHandler is called for each file the listener side completes. Optional.
+	FileHandler func(rf *ramformats.RamFile)
+
+	config         Config // Config with defaults applied, set by Start
+	pickup         *raminputs.LocalPickup
+	exporter       *ramformats.RamExportBundle
+	importer       *ramformats.RamImportBundle
+	sender         ramstream.RamStream
+	listener       ramstream.RamListener
+	pendingBundles [][]byte              // Bundles sent together, retried as a whole until all are acknowledged
+	bundleBuffers  []bytes.Buffer        // Reused to hold each bundle while it is sent, one per connection
+	pendingFiles   []ramformats.RamFile  // Files pushed to the exporter that are not fully sent yet
+	senderIdle     atomic.Bool           // Set when the last sender pulse found nothing left to send
+	senderErr      atomic.Pointer[error] // Set when the sender stopped on an error retrying cannot fix
+	listenerDone   atomic.Bool           // Set when the listener's input has ended
+	listenerIdle   atomic.Bool           // Set once every file completed before the listener's input ended is delivered
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
+	running        bool
+	mu             sync.Mutex
 }
 
 func NewCore(cfg Config) *Core {
-	// TODO: Instantiate Listener and Sender based on config
 	return &Core{Config: cfg}
 }
 
-// ...existing code...
+// Start builds the pipeline described by the config and starts it running in
+// the background. Nothing is left running if an error is returned.
+func (c *Core) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running {
+		return fmt.Errorf("Core is already running")
+	}
+	if err := c.Config.Validate(); err != nil {
+		return fmt.Errorf("Invalid config: %w", err)
+	}
+	cfg := c.Config.withDefaults()
+	c.config = cfg
+	c.senderErr.Store(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+
+	var localSink ramstream.RamStream
+	if cfg.ListenerType != "" {
+		sink, err := c.startListener(ctx)
+		if err != nil {
+			c.shutdown()
+			return err
+		}
+		localSink = sink
+	}
+	if cfg.SenderType != "" {
+		if err := c.startSender(ctx, localSink); err != nil {
+			c.shutdown()
+			return err
+		}
+	}
+	c.running = true
+	return nil
+}
+
+// Stop shuts down the sender and listener and waits for background work to finish.
+func (c *Core) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running {
+		return fmt.Errorf("Core is not running")
+	}
+	c.running = false
+	return c.shutdown()
+}
+
+func (c *Core) shutdown() error {
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+	var err error
+	if c.listener != nil {
+		err = c.listener.Flush()
+		c.listener = nil
+	}
+	c.wg.Wait()
+	if c.sender != nil {
+		c.sender.Flush()
+		c.sender = nil
+	}
+	if c.exporter != nil {
+		c.exporter.Close()
+	}
+	if c.importer != nil {
+		c.importer.Close()
+	}
+	return err
+}
+
+func (c *Core) startListener(ctx context.Context) (ramstream.RamStream, error) {
+	cfg := c.config
+	if cfg.ProcessingDirectory == "" {
+		return nil, fmt.Errorf("Processing directory must be set for a listener")
+	}
+	if err := os.MkdirAll(cfg.ProcessingDirectory, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating processing directory: %v", err)
+	}
+	if cfg.OutputDirectory != "" {
+		if err := os.MkdirAll(cfg.OutputDirectory, 0755); err != nil {
+			return nil, fmt.Errorf("Error creating output directory: %v", err)
+		}
+	}
+
+	c.importer = ramformats.NewRamImportBundle(cfg.MaxQueueSize, cfg.ProcessingDirectory)
+	c.importer.SetPreallocate(cfg.Preallocate)
+	sink := newImportSink(c.importer)
+
+	switch cfg.ListenerType {
+	case StreamTypeTCP:
+		c.listener = ramio.NewTCPStream(cfg.ListenerAddress, ramstream.DROutputStream, sink)
+	case StreamTypeQUIC:
+		tlsConfig, err := ramio.LoadServerTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.listener = ramio.NewQUICStream(cfg.ListenerAddress, ramstream.DROutputStream, sink, tlsConfig)
+	case StreamTypeTLS:
+		tlsConfig, err := ramio.LoadServerTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.listener = ramio.NewTLSStream(cfg.ListenerAddress, ramstream.DROutputStream, sink, tlsConfig)
+	case StreamTypeUDP:
+		c.listener = ramio.NewUDPStream(cfg.ListenerAddress, ramstream.DROutputStream, sink)
+	case StreamTypeUnix:
+		c.listener = ramio.NewUnixStream(cfg.ListenerAddress, ramstream.DROutputStream, sink)
+	case StreamTypeFIFO:
+		c.listener = ramio.NewFIFOStream(cfg.ListenerAddress, ramstream.DROutputStream, sink)
+	case StreamTypeStdio:
+		c.listener = ramio.NewStdioStream(nil, ramstream.DROutputStream, sink)
+	case StreamTypeHTTP:
+		c.listener = ramio.NewHTTPStream(cfg.ListenerAddress, ramstream.DROutputStream, sink, nil)
+	case StreamTypeHTTPS:
+		tlsConfig, err := ramio.LoadServerTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.listener = ramio.NewHTTPStream(cfg.ListenerAddress, ramstream.DROutputStream, sink, tlsConfig)
+	case StreamTypeWS:
+		c.listener = ramio.NewWebSocketStream(cfg.ListenerAddress, ramstream.DROutputStream, sink, nil)
+	case StreamTypeWSS:
+		tlsConfig, err := ramio.LoadServerTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.listener = ramio.NewWebSocketStream(cfg.ListenerAddress, ramstream.DROutputStream, sink, tlsConfig)
+	case StreamTypeLocal:
+		// Nothing to listen on, the local sender writes straight into the sink
+	default:
+		return nil, fmt.Errorf("Unknown listener type: %s", cfg.ListenerType)
+	}
+
+	if c.listener != nil {
+		listener := c.listener
+		go func() {
+			if err := listener.Listen(cfg.BufferSize); err != nil && ctx.Err() == nil {
+				ramstream.Logf("Listener on %s stopped: %v\n", cfg.ListenerAddress, err)
+			}
+			c.listenerDone.Store(true)
+		}()
+	}
+
+	c.wg.Add(1)
+	go c.deliverLoop(ctx)
+	return sink, nil
+}
+
+func (c *Core) startSender(ctx context.Context, localSink ramstream.RamStream) error {
+	cfg := c.config
+	if cfg.StateDirectory != "" {
+		if err := os.MkdirAll(cfg.StateDirectory, 0755); err != nil {
+			return fmt.Errorf("Error creating state directory: %v", err)
+		}
+		// Files already sent are skipped after a restart
+		sentPath := filepath.Join(cfg.StateDirectory, sentStateFile)
+		c.pickup = raminputs.NewLocalPickupWithState(cfg.PickupPath, cfg.PickupRegex, cfg.IgnoreDotFiles, sentPath)
+	} else {
+		c.pickup = raminputs.NewLocalPickup(cfg.PickupPath, cfg.PickupRegex, cfg.IgnoreDotFiles)
+	}
+	if err := c.pickup.Init(); err != nil {
+		return err
+	}
+	if cfg.StateDirectory != "" {
+		statePath := filepath.Join(cfg.StateDirectory, exportStateFile)
+		exporter, err := ramformats.NewRamExportBundleWithState(cfg.ChunkSize, cfg.MaxBundleCount, cfg.MaxQueueSize, statePath)
+		if err != nil {
+			return err
+		}
+		c.exporter = exporter
+		// Files restored from the journal are already in flight
+		for _, rf := range c.exporter.PendingFiles() {
+			c.pickup.MarkInProgress(rf)
+			c.pendingFiles = append(c.pendingFiles, rf)
+		}
+	} else {
+		c.exporter = ramformats.NewRamExportBundle(cfg.ChunkSize, cfg.MaxBundleCount, cfg.MaxQueueSize)
+	}
+	if cfg.HashAlgorithm != "" {
+		if err := c.exporter.SetHashAlgorithm(cfg.HashAlgorithm); err != nil {
+			return err
+		}
+	}
+	if err := c.exporter.SetMaxOpenFiles(cfg.MaxOpenFiles); err != nil {
+		return err
+	}
+	if cfg.FormatVersion != 0 {
+		if err := c.exporter.SetFormatVersion(cfg.FormatVersion); err != nil {
+			return err
+		}
+	}
+	if err := c.exporter.SetFEC(cfg.FECData, cfg.FECParity); err != nil {
+		return err
+	}
+
+	switch cfg.SenderType {
+	case StreamTypeTCP:
+		streams := make([]ramstream.RamStream, cfg.Connections)
+		for i := range streams {
+			streams[i] = ramio.NewTCPStream(cfg.SenderAddress, ramstream.DROutputStream, nil)
+		}
+		c.sender = senderStream(streams)
+	case StreamTypeQUIC:
+		tlsConfig, err := clientTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+		// One connection carries a stream per bundle in flight
+		var quicStream *ramio.QUICStream
+		if cfg.QUICDatagrams {
+			quicStream = ramio.NewQUICDatagramStream(cfg.SenderAddress, ramstream.DROutputStream, nil, tlsConfig)
+		} else {
+			quicStream = ramio.NewQUICStream(cfg.SenderAddress, ramstream.DROutputStream, nil, tlsConfig)
+		}
+		streams := make([]ramstream.RamStream, cfg.Connections)
+		for i := range streams {
+			streams[i] = quicStream
+		}
+		c.sender = senderStream(streams)
+	case StreamTypeTLS:
+		tlsConfig, err := clientTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+		streams := make([]ramstream.RamStream, cfg.Connections)
+		for i := range streams {
+			streams[i] = ramio.NewTLSStream(cfg.SenderAddress, ramstream.DROutputStream, nil, tlsConfig)
+		}
+		c.sender = senderStream(streams)
+	case StreamTypeUDP:
+		streams := make([]ramstream.RamStream, cfg.Connections)
+		for i := range streams {
+			udpStream := ramio.NewUDPStream(cfg.SenderAddress, ramstream.DROutputStream, nil)
+			if cfg.UDPPacketLen != 0 {
+				udpStream.PacketLen = cfg.UDPPacketLen
+			}
+			udpStream.Redundancy = max(1, cfg.UDPRedundancy)
+			udpStream.FECGroupSize = cfg.UDPFECGroup
+			if cfg.UDPSendRate > 0 {
+				// Each connection paces itself, so they share the rate
+				udpStream.SendRate = max(1, cfg.UDPSendRate/int64(len(streams)))
+			}
+			streams[i] = udpStream
+		}
+		c.sender = senderStream(streams)
+	case StreamTypeUnix:
+		streams := make([]ramstream.RamStream, cfg.Connections)
+		for i := range streams {
+			streams[i] = ramio.NewUnixStream(cfg.SenderAddress, ramstream.DROutputStream, nil)
+		}
+		c.sender = senderStream(streams)
+	case StreamTypeFIFO:
+		c.sender = ramio.NewFIFOStream(cfg.SenderAddress, ramstream.DROutputStream, nil)
+	case StreamTypeStdio:
+		c.sender = ramio.NewStdioStream(os.Stdout, ramstream.DROutputStream, nil)
+	case StreamTypeHTTP, StreamTypeHTTPS:
+		var tlsConfig *tls.Config
+		if cfg.SenderType == StreamTypeHTTPS {
+			var err error
+			if tlsConfig, err = clientTLSConfig(cfg); err != nil {
+				return err
+			}
+		}
+		// Requests in flight share one client's connections
+		httpStream := ramio.NewHTTPStream(cfg.SenderAddress, ramstream.DROutputStream, nil, tlsConfig)
+		streams := make([]ramstream.RamStream, cfg.Connections)
+		for i := range streams {
+			streams[i] = httpStream
+		}
+		c.sender = senderStream(streams)
+	case StreamTypeWS, StreamTypeWSS:
+		var tlsConfig *tls.Config
+		if cfg.SenderType == StreamTypeWSS {
+			var err error
+			if tlsConfig, err = clientTLSConfig(cfg); err != nil {
+				return err
+			}
+		}
+		// One connection per record in flight
+		streams := make([]ramstream.RamStream, cfg.Connections)
+		for i := range streams {
+			streams[i] = ramio.NewWebSocketStream(cfg.SenderAddress, ramstream.DROutputStream, nil, tlsConfig)
+		}
+		c.sender = senderStream(streams)
+	case StreamTypeLocal:
+		if localSink == nil || cfg.ListenerType != StreamTypeLocal {
+			return fmt.Errorf("Local sender requires a local listener")
+		}
+		c.sender = localSink
+	default:
+		return fmt.Errorf("Unknown sender type: %s", cfg.SenderType)
+	}
+
+	c.bundleBuffers = make([]bytes.Buffer, cfg.Connections)
+
+	c.wg.Add(1)
+	go c.sendLoop(ctx)
+	return nil
+}
+
+// clientTLSConfig builds the TLS config quic and tls senders verify the listener with.
+func clientTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig, err := ramio.LoadClientTLSConfig(cfg.CAFile, cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = cfg.ServerName
+	if err := ramio.PinSPKI(tlsConfig, cfg.spkiPins()); err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+// senderStream stripes across the streams when there is more than one.
+func senderStream(streams []ramstream.RamStream) ramstream.RamStream {
+	if len(streams) == 1 {
+		return streams[0]
+	}
+	return ramio.NewParallelStream(ramstream.DROutputStream, streams...)
+}
+
+// SenderIdle reports whether the sender has sent everything in the pickup
+// directory as of its last pulse.
+func (c *Core) SenderIdle() bool {
+	return c.senderIdle.Load()
+}
+
+// SenderErr returns the error the sender stopped on, such as bundles larger than
+// the listener accepts, or nil while it is still running.
+func (c *Core) SenderErr() error {
+	if err := c.senderErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// ListenerIdle reports whether the listener's input has ended, as a stdio listener's
+// does at the end of stdin, and every file completed from it has been delivered.
+// Files still missing data when the input ended are never delivered.
+func (c *Core) ListenerIdle() bool {
+	return c.listenerIdle.Load()
+}
+
+func (c *Core) sendLoop(ctx context.Context) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(time.Duration(c.config.PollIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		idle, err := c.pulseSender(ctx)
+		if errors.Is(err, ramio.ErrFrameTooLarge) {
+			// Every resend would be refused the same way
+			ramstream.Logf("Sender stopped: %v\n", err)
+			c.senderErr.Store(&err)
+			return
+		}
+		if err != nil {
+			ramstream.Logf("Sender error: %v\n", err)
+		}
+		c.senderIdle.Store(idle)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pulseSender picks up new files and sends bundles until the exporter is drained.
+// It returns true if everything picked up so far has been sent.
+func (c *Core) pulseSender(ctx context.Context) (bool, error) {
+	if err := c.pickup.Pulse(); err != nil {
+		return false, err
+	}
+	for {
+		rf, err := c.pickup.GetFile()
+		if err != nil {
+			break // Nothing left to pick up
+		}
+		if err := c.exporter.PushFile(*rf); err != nil {
+			// Exporter queue is full, try again next pulse
+			c.pickup.ReturnFile(rf)
+			break
+		}
+		c.pendingFiles = append(c.pendingFiles, *rf)
+	}
+
+	for ctx.Err() == nil {
+		if len(c.pendingBundles) == 0 {
+			// Take a bundle for each connection so they are all sent at once
+			for i := range c.bundleBuffers {
+				c.bundleBuffers[i].Reset()
+				n, err := c.exporter.WriteNextExportBundle(&c.bundleBuffers[i])
+				if err != nil {
+					return false, err
+				}
+				if n == 0 {
+					break
+				}
+				c.pendingBundles = append(c.pendingBundles, c.bundleBuffers[i].Bytes())
+			}
+			if len(c.pendingBundles) == 0 {
+				// Everything pushed to the exporter has been sent
+				if err := c.resendMissing(); err != nil {
+					return false, err
+				}
+				for i := range c.pendingFiles {
+					c.exporter.ReleaseFile(c.pendingFiles[i].UUID)
+					if err := c.pickup.CompleteFile(&c.pendingFiles[i]); err != nil {
+						ramstream.Logf("Error completing file %s: %v\n", c.pendingFiles[i].LocalPath, err)
+					}
+				}
+				c.pendingFiles = c.pendingFiles[:0]
+				return len(c.pickup.FilesInQueue) == 0 && c.pickup.Settling() == 0, nil
+			}
+		}
+		if err := c.sendBundles(c.pendingBundles); errors.Is(err, ramio.ErrFrameTooLarge) {
+			return false, fmt.Errorf("Failed to send bundle: %w", err)
+		} else if err != nil {
+			return false, fmt.Errorf("Failed to send bundle, will retry: %v", err)
+		}
+		c.pendingBundles = c.pendingBundles[:0]
+		if err := c.exporter.AcknowledgeBundle(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// sendBundles writes the bundles concurrently and waits for every write.
+// The receiver ignores chunks it already has, so a failed batch is resent whole.
+func (c *Core) sendBundles(bundles [][]byte) error {
+	if len(bundles) == 1 {
+		_, err := c.sender.Write(bundles[0])
+		return err
+	}
+	errs := make([]error, len(bundles))
+	var wg sync.WaitGroup
+	for i, bundle := range bundles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = c.sender.Write(bundle)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// resendMissing asks the receiver what it is still missing of the pending files
+// and resends just those ranges, until it has everything or maxResendRounds is reached.
+// Senders without a control channel are trusted to have delivered everything.
+func (c *Core) resendMissing() error {
+	nacker, ok := c.sender.(ramstream.RamNackSender)
+	if !ok || len(c.pendingFiles) == 0 {
+		return nil
+	}
+	uuids := make([]string, len(c.pendingFiles))
+	for i, rf := range c.pendingFiles {
+		uuids[i] = rf.UUID
+	}
+	request, err := ramformats.EncodeUUIDList(uuids)
+	if err != nil {
+		return err
+	}
+	for round := 0; round < maxResendRounds; round++ {
+		reply, err := nacker.Nack(request)
+		if err != nil {
+			return fmt.Errorf("Failed to ask receiver for missing ranges, will retry: %v", err)
+		}
+		if len(reply) == 0 {
+			return nil // Receiver cannot report what it is missing
+		}
+		missing, err := ramformats.DecodeResendRequests(reply)
+		if err != nil {
+			return err
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		ramstream.Logf("Receiver is missing %d range(s), resending\n", len(missing))
+		records, err := c.exporter.ResendRecords(missing)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if _, err := c.sender.Write(record); err != nil {
+				return fmt.Errorf("Failed to resend ranges, will retry: %v", err)
+			}
+		}
+	}
+	return fmt.Errorf("Receiver still missing ranges after %d resend rounds, will retry", maxResendRounds)
+}
+
+func (c *Core) deliverLoop(ctx context.Context) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(time.Duration(c.config.PollIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		// Checked before draining so files completed by the last records are delivered first
+		done := c.listenerDone.Load()
+		for {
+			rf := c.importer.PopFile()
+			if rf == nil {
+				break
+			}
+			if err := c.deliverFile(rf); err != nil {
+				ramstream.Logf("Error delivering file %s: %v\n", rf.UUID, err)
+			}
+		}
+		c.listenerIdle.Store(done)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverFile moves a completed file to the output directory and hands it to the FileHandler.
+// A file already in the output directory is never replaced, the new one is delivered
+// under its name with the UUID added instead.
+func (c *Core) deliverFile(rf *ramformats.RamFile) error {
+	if c.config.OutputDirectory != "" {
+		name := filepath.Base(rf.MetaData[ramformats.DRFileNameKey])
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			name = rf.UUID
+		}
+		outPath := filepath.Join(c.config.OutputDirectory, name)
+		// Linking fails rather than replace an existing file, as a rename would
+		err := os.Link(rf.LocalPath, outPath)
+		if errors.Is(err, fs.ErrExist) {
+			ext := filepath.Ext(name)
+			unique := strings.TrimSuffix(name, ext) + "." + rf.UUID + ext
+			ramstream.Logf("Error delivering file %s: %s already exists in the output directory, delivering it as %s\n", rf.UUID, name, unique)
+			outPath = filepath.Join(c.config.OutputDirectory, unique)
+			err = os.Link(rf.LocalPath, outPath)
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(rf.LocalPath); err != nil {
+			ramstream.Logf("Error removing delivered file %s from the processing directory: %v\n", rf.LocalPath, err)
+		}
+		rf.LocalPath = outPath
+	}
+	if c.FileHandler != nil {
+		c.FileHandler(rf)
+	}
+	return nil
+}
@@ -0,0 +1,726 @@
+package ramcore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"data_ram/ramformats"
+	"data_ram/ramio"
+	"data_ram/ramstream"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestFiles creates count files of random data in dir and returns their contents by name.
+func writeTestFiles(t *testing.T, dir string, count int, size int) map[string][]byte {
+	files := make(map[string][]byte)
+	for i := 0; i < count; i++ {
+		data := make([]byte, size+i)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatalf("Failed to generate data: %v", err)
+		}
+		name := fmt.Sprintf("core_file_%d.bin", i)
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+		files[name] = data
+	}
+	return files
+}
+
+// waitForFiles polls the output directory until every expected file has arrived intact.
+func waitForFiles(t *testing.T, dir string, files map[string][]byte) {
+	deadline := time.Now().Add(10 * time.Second)
+	for name, want := range files {
+		for {
+			got, err := os.ReadFile(filepath.Join(dir, name))
+			if err == nil && bytes.Equal(got, want) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("File %s did not arrive intact (err: %v)", name, err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestCore_LocalTransfer(t *testing.T) {
+	pickupDir := t.TempDir()
+	outputDir := t.TempDir()
+	files := writeTestFiles(t, pickupDir, 4, 3000)
+
+	delivered := make(chan string, len(files))
+	core := NewCore(Config{
+		ListenerType:        StreamTypeLocal,
+		SenderType:          StreamTypeLocal,
+		PickupPath:          pickupDir,
+		ProcessingDirectory: t.TempDir(),
+		OutputDirectory:     outputDir,
+		ChunkSize:           1024,
+		MaxBundleCount:      2,
+		PollIntervalMs:      10,
+	})
+	core.FileHandler = func(rf *ramformats.RamFile) {
+		delivered <- filepath.Base(rf.LocalPath)
+	}
+	if err := core.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer core.Stop()
+
+	waitForFiles(t, outputDir, files)
+	for i := 0; i < len(files); i++ {
+		select {
+		case name := <-delivered:
+			if _, ok := files[name]; !ok {
+				t.Errorf("Unexpected file delivered: %s", name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("FileHandler was not called for every file")
+		}
+	}
+}
+
+func TestCore_TCPTransfer(t *testing.T) {
+	pickupDir := t.TempDir()
+	outputDir := t.TempDir()
+	files := writeTestFiles(t, pickupDir, 3, 2500)
+	address := "127.0.0.1:9110"
+
+	receiver := NewCore(Config{
+		ListenerType:        StreamTypeTCP,
+		ListenerAddress:     address,
+		ProcessingDirectory: t.TempDir(),
+		OutputDirectory:     outputDir,
+		PollIntervalMs:      10,
+	})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Receiver start failed: %v", err)
+	}
+	defer receiver.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	sender := NewCore(Config{
+		SenderType:     StreamTypeTCP,
+		SenderAddress:  address,
+		PickupPath:     pickupDir,
+		ChunkSize:      1024,
+		MaxBundleCount: 2,
+		PollIntervalMs: 10,
+	})
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Sender start failed: %v", err)
+	}
+	defer sender.Stop()
+
+	waitForFiles(t, outputDir, files)
+}
+
+func TestCore_ParallelTCPTransfer(t *testing.T) {
+	pickupDir := t.TempDir()
+	outputDir := t.TempDir()
+	files := writeTestFiles(t, pickupDir, 4, 5000)
+	address := "127.0.0.1:9111"
+
+	receiver := NewCore(Config{
+		ListenerType:        StreamTypeTCP,
+		ListenerAddress:     address,
+		ProcessingDirectory: t.TempDir(),
+		OutputDirectory:     outputDir,
+		PollIntervalMs:      10,
+	})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Receiver start failed: %v", err)
+	}
+	defer receiver.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	sender := NewCore(Config{
+		SenderType:     StreamTypeTCP,
+		SenderAddress:  address,
+		PickupPath:     pickupDir,
+		ChunkSize:      1024,
+		MaxBundleCount: 4,
+		PollIntervalMs: 10,
+		Connections:    3,
+	})
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Sender start failed: %v", err)
+	}
+	defer sender.Stop()
+
+	waitForFiles(t, outputDir, files)
+}
+
+// writeTestCert writes a self-signed certificate and key for 127.0.0.1 and returns their paths
+func writeTestCert(t *testing.T) (string, string) {
+	t.Helper()
+	certPEM, keyPEM, err := ramio.GenerateSelfSignedCert([]string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateSelfSignedCert failed: %v", err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestCore_MutualTLSTransfer(t *testing.T) {
+	pickupDir := t.TempDir()
+	outputDir := t.TempDir()
+	files := writeTestFiles(t, pickupDir, 2, 2500)
+	address := "127.0.0.1:9112"
+	serverCert, serverKey := writeTestCert(t)
+	clientCert, clientKey := writeTestCert(t)
+
+	receiver := NewCore(Config{
+		ListenerType:        StreamTypeTLS,
+		ListenerAddress:     address,
+		ProcessingDirectory: t.TempDir(),
+		OutputDirectory:     outputDir,
+		PollIntervalMs:      10,
+		CertFile:            serverCert,
+		KeyFile:             serverKey,
+		ClientCAFile:        clientCert,
+	})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Receiver start failed: %v", err)
+	}
+	defer receiver.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	sender := NewCore(Config{
+		SenderType:     StreamTypeTLS,
+		SenderAddress:  address,
+		PickupPath:     pickupDir,
+		ChunkSize:      1024,
+		PollIntervalMs: 10,
+		CAFile:         serverCert,
+		CertFile:       clientCert,
+		KeyFile:        clientKey,
+	})
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Sender start failed: %v", err)
+	}
+	defer sender.Stop()
+
+	waitForFiles(t, outputDir, files)
+}
+
+func TestCore_PinnedQUICTransfer(t *testing.T) {
+	pickupDir := t.TempDir()
+	outputDir := t.TempDir()
+	files := writeTestFiles(t, pickupDir, 2, 2500)
+	address := "127.0.0.1:9113"
+	serverCert, serverKey := writeTestCert(t)
+	certPEM, err := os.ReadFile(serverCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin, err := ramio.SPKIHashPEM(certPEM)
+	if err != nil {
+		t.Fatalf("SPKIHashPEM failed: %v", err)
+	}
+
+	receiver := NewCore(Config{
+		ListenerType:        StreamTypeQUIC,
+		ListenerAddress:     address,
+		ProcessingDirectory: t.TempDir(),
+		OutputDirectory:     outputDir,
+		PollIntervalMs:      10,
+		CertFile:            serverCert,
+		KeyFile:             serverKey,
+	})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Receiver start failed: %v", err)
+	}
+	defer receiver.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	// No CA, the listener is trusted by its pinned key alone
+	sender := NewCore(Config{
+		SenderType:     StreamTypeQUIC,
+		SenderAddress:  address,
+		PickupPath:     pickupDir,
+		ChunkSize:      1024,
+		PollIntervalMs: 10,
+		SPKIPins:       pin,
+		Connections:    3,
+	})
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Sender start failed: %v", err)
+	}
+	defer sender.Stop()
+
+	waitForFiles(t, outputDir, files)
+}
+
+func TestCore_QUICDatagramTransfer(t *testing.T) {
+	pickupDir := t.TempDir()
+	outputDir := t.TempDir()
+	files := writeTestFiles(t, pickupDir, 3, 5000)
+	address := "127.0.0.1:9114"
+	serverCert, serverKey := writeTestCert(t)
+
+	receiver := NewCore(Config{
+		ListenerType:        StreamTypeQUIC,
+		ListenerAddress:     address,
+		ProcessingDirectory: t.TempDir(),
+		OutputDirectory:     outputDir,
+		PollIntervalMs:      10,
+		CertFile:            serverCert,
+		KeyFile:             serverKey,
+	})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Receiver start failed: %v", err)
+	}
+	defer receiver.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	// Chunks small enough for data records to fit in a datagram
+	sender := NewCore(Config{
+		SenderType:     StreamTypeQUIC,
+		SenderAddress:  address,
+		PickupPath:     pickupDir,
+		ChunkSize:      512,
+		PollIntervalMs: 10,
+		CAFile:         serverCert,
+		QUICDatagrams:  true,
+	})
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Sender start failed: %v", err)
+	}
+	defer sender.Stop()
+
+	waitForFiles(t, outputDir, files)
+}
+
+func TestCore_UDPTransfer(t *testing.T) {
+	pickupDir := t.TempDir()
+	outputDir := t.TempDir()
+	files := writeTestFiles(t, pickupDir, 3, 5000)
+	address := "127.0.0.1:9115"
+
+	receiver := NewCore(Config{
+		ListenerType:        StreamTypeUDP,
+		ListenerAddress:     address,
+		ProcessingDirectory: t.TempDir(),
+		OutputDirectory:     outputDir,
+		PollIntervalMs:      10,
+	})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Receiver start failed: %v", err)
+	}
+	defer receiver.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	sender := NewCore(Config{
+		SenderType:     StreamTypeUDP,
+		SenderAddress:  address,
+		PickupPath:     pickupDir,
+		ChunkSize:      1024,
+		PollIntervalMs: 10,
+		UDPPacketLen:   512,
+		UDPRedundancy:  2,
+		UDPFECGroup:    4,
+		FECData:        4,
+		FECParity:      2,
+	})
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Sender start failed: %v", err)
+	}
+	defer sender.Stop()
+
+	waitForFiles(t, outputDir, files)
+}
+
+func TestCore_UnixAndFIFOTransfer(t *testing.T) {
+	for _, streamType := range []string{StreamTypeUnix, StreamTypeFIFO} {
+		t.Run(streamType, func(t *testing.T) {
+			pickupDir := t.TempDir()
+			outputDir := t.TempDir()
+			files := writeTestFiles(t, pickupDir, 3, 5000)
+			address := filepath.Join(t.TempDir(), "dataram."+streamType)
+
+			receiver := NewCore(Config{
+				ListenerType:        streamType,
+				ListenerAddress:     address,
+				ProcessingDirectory: t.TempDir(),
+				OutputDirectory:     outputDir,
+				PollIntervalMs:      10,
+			})
+			if err := receiver.Start(); err != nil {
+				t.Fatalf("Receiver start failed: %v", err)
+			}
+			defer receiver.Stop()
+			time.Sleep(100 * time.Millisecond)
+
+			sender := NewCore(Config{
+				SenderType:     streamType,
+				SenderAddress:  address,
+				PickupPath:     pickupDir,
+				ChunkSize:      1024,
+				PollIntervalMs: 10,
+			})
+			if err := sender.Start(); err != nil {
+				t.Fatalf("Sender start failed: %v", err)
+			}
+			defer sender.Stop()
+
+			waitForFiles(t, outputDir, files)
+		})
+	}
+}
+
+func TestCore_StdioListener(t *testing.T) {
+	pickupDir := t.TempDir()
+	outputDir := t.TempDir()
+	files := writeTestFiles(t, pickupDir, 3, 5000)
+
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	defer stdinReader.Close()
+	stdin := os.Stdin
+	os.Stdin = stdinReader
+	defer func() { os.Stdin = stdin }()
+
+	receiver := NewCore(Config{
+		ListenerType:        StreamTypeStdio,
+		ProcessingDirectory: t.TempDir(),
+		OutputDirectory:     outputDir,
+		PollIntervalMs:      10,
+	})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Receiver start failed: %v", err)
+	}
+	defer receiver.Stop()
+
+	// Stand in for a sender on the other end of a shell pipeline
+	exporter := ramformats.NewRamExportBundle(1024, 10, 10)
+	for name := range files {
+		exporter.PushFile(*ramformats.NewRamFileFromLocal(filepath.Join(pickupDir, name), name))
+	}
+	pipe := ramio.NewPipeStream(nil, stdinWriter, ramstream.DROutputStream, nil)
+	for {
+		record, err := exporter.GetNextExportBundle()
+		if err != nil {
+			t.Fatalf("GetNextExportBundle failed: %v", err)
+		}
+		if record == nil {
+			break
+		}
+		if _, err := pipe.Write(record); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if receiver.ListenerIdle() {
+		t.Fatal("Listener reported idle before stdin ended")
+	}
+	stdinWriter.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !receiver.ListenerIdle() {
+		if time.Now().After(deadline) {
+			t.Fatal("Listener did not become idle after stdin ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Idle means everything has already been delivered
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(outputDir, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("File %s was not delivered intact (err: %v)", name, err)
+		}
+	}
+}
+
+func TestCore_HTTPSTransfer(t *testing.T) {
+	pickupDir := t.TempDir()
+	outputDir := t.TempDir()
+	files := writeTestFiles(t, pickupDir, 3, 2500)
+	address := "127.0.0.1:9116"
+	serverCert, serverKey := writeTestCert(t)
+	clientCert, clientKey := writeTestCert(t)
+
+	receiver := NewCore(Config{
+		ListenerType:        StreamTypeHTTPS,
+		ListenerAddress:     address,
+		ProcessingDirectory: t.TempDir(),
+		OutputDirectory:     outputDir,
+		PollIntervalMs:      10,
+		CertFile:            serverCert,
+		KeyFile:             serverKey,
+		ClientCAFile:        clientCert,
+	})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Receiver start failed: %v", err)
+	}
+	defer receiver.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	sender := NewCore(Config{
+		SenderType:     StreamTypeHTTPS,
+		SenderAddress:  address,
+		PickupPath:     pickupDir,
+		ChunkSize:      1024,
+		PollIntervalMs: 10,
+		Connections:    3,
+		CAFile:         serverCert,
+		CertFile:       clientCert,
+		KeyFile:        clientKey,
+	})
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Sender start failed: %v", err)
+	}
+	defer sender.Stop()
+
+	waitForFiles(t, outputDir, files)
+}
+
+func TestCore_WebSocketTransfer(t *testing.T) {
+	pickupDir := t.TempDir()
+	outputDir := t.TempDir()
+	files := writeTestFiles(t, pickupDir, 3, 2500)
+	address := "127.0.0.1:9117"
+	certFile, keyFile := writeTestCert(t)
+
+	receiver := NewCore(Config{
+		ListenerType:        StreamTypeWSS,
+		ListenerAddress:     address,
+		ProcessingDirectory: t.TempDir(),
+		OutputDirectory:     outputDir,
+		PollIntervalMs:      10,
+		CertFile:            certFile,
+		KeyFile:             keyFile,
+	})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Receiver start failed: %v", err)
+	}
+	defer receiver.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	sender := NewCore(Config{
+		SenderType:     StreamTypeWSS,
+		SenderAddress:  address,
+		PickupPath:     pickupDir,
+		ChunkSize:      1024,
+		PollIntervalMs: 10,
+		Connections:    2,
+		CAFile:         certFile,
+	})
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Sender start failed: %v", err)
+	}
+	defer sender.Stop()
+
+	waitForFiles(t, outputDir, files)
+}
+
+func TestCore_ImportHandler(t *testing.T) {
+	pickupDir := t.TempDir()
+	files := writeTestFiles(t, pickupDir, 2, 2500)
+
+	// An existing server with the import handler mounted alongside its own routes
+	importer := ramformats.NewRamImportBundle(10, t.TempDir())
+	mux := http.NewServeMux()
+	mux.Handle("/dataram/", NewImportHandler(importer, DefaultBufferSize))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sender := NewCore(Config{
+		SenderType:     StreamTypeHTTP,
+		SenderAddress:  server.Listener.Addr().String(),
+		PickupPath:     pickupDir,
+		ChunkSize:      1024,
+		PollIntervalMs: 10,
+	})
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Sender start failed: %v", err)
+	}
+	defer sender.Stop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	received := 0
+	for received < len(files) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d of %d files arrived", received, len(files))
+		}
+		rf := importer.PopFile()
+		if rf == nil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		got, err := os.ReadFile(rf.LocalPath)
+		if err != nil || !bytes.Equal(got, files[rf.MetaData[ramformats.DRFileNameKey]]) {
+			t.Errorf("File %s was not received intact (err: %v)", rf.MetaData[ramformats.DRFileNameKey], err)
+		}
+		received++
+	}
+}
+
+func TestCore_StartErrors(t *testing.T) {
+	if err := NewCore(Config{}).Start(); err == nil {
+		t.Error("Expected error starting core with nothing configured")
+	}
+	if err := NewCore(Config{ListenerType: "carrier-pigeon", ProcessingDirectory: t.TempDir()}).Start(); err == nil {
+		t.Error("Expected error for unknown listener type")
+	}
+	if err := NewCore(Config{SenderType: StreamTypeLocal, PickupPath: t.TempDir()}).Start(); err == nil {
+		t.Error("Expected error for local sender without local listener")
+	}
+	core := NewCore(Config{ListenerType: StreamTypeLocal, ProcessingDirectory: t.TempDir()})
+	if err := core.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := core.Start(); err == nil {
+		t.Error("Expected error starting a running core")
+	}
+	if err := core.Stop(); err != nil {
+		t.Errorf("Stop failed: %v", err)
+	}
+	if err := core.Stop(); err == nil {
+		t.Error("Expected error stopping a stopped core")
+	}
+}
+
+func TestCore_FrameTooLargeStopsSender(t *testing.T) {
+	pickupDir := t.TempDir()
+	writeTestFiles(t, pickupDir, 1, 10000)
+	address := "127.0.0.1:9118"
+
+	// The receiver only accepts records of its own smaller chunk size
+	receiver := NewCore(Config{
+		ListenerType:        StreamTypeTCP,
+		ListenerAddress:     address,
+		ProcessingDirectory: t.TempDir(),
+		ChunkSize:           1024,
+		MaxBundleCount:      1,
+		BufferSize:          2048,
+		PollIntervalMs:      10,
+	})
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Receiver start failed: %v", err)
+	}
+	defer receiver.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	sender := NewCore(Config{
+		SenderType:     StreamTypeTCP,
+		SenderAddress:  address,
+		PickupPath:     pickupDir,
+		ChunkSize:      8192,
+		PollIntervalMs: 10,
+	})
+	if err := sender.Start(); err != nil {
+		t.Fatalf("Sender start failed: %v", err)
+	}
+	defer sender.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sender.SenderErr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Sender kept retrying bundles the listener refuses")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := sender.SenderErr(); !errors.Is(err, ramio.ErrFrameTooLarge) {
+		t.Errorf("Expected ErrFrameTooLarge, got %v", err)
+	}
+	if sender.SenderIdle() {
+		t.Error("Sender reported idle without sending the file")
+	}
+}
+
+func TestCore_DeliverSameName(t *testing.T) {
+	processingDir := t.TempDir()
+	outputDir := t.TempDir()
+	core := &Core{config: Config{OutputDirectory: outputDir}}
+
+	uuids := []string{"0b5e1c1e-0000-4000-8000-000000000001", "0b5e1c1e-0000-4000-8000-000000000002"}
+	for i, uuid := range uuids {
+		localPath := filepath.Join(processingDir, uuid)
+		if err := os.WriteFile(localPath, []byte(fmt.Sprintf("contents %d", i)), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+		rf := &ramformats.RamFile{
+			LocalPath: localPath,
+			UUID:      uuid,
+			MetaData:  map[string]string{ramformats.DRFileNameKey: "report.csv"},
+		}
+		if err := core.deliverFile(rf); err != nil {
+			t.Fatalf("deliverFile %d failed: %v", i, err)
+		}
+		if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+			t.Errorf("File %d was left in the processing directory", i)
+		}
+	}
+
+	// The second file is delivered alongside the first rather than replacing it
+	want := map[string]string{
+		"report.csv":                  "contents 0",
+		"report." + uuids[1] + ".csv": "contents 1",
+	}
+	for name, contents := range want {
+		got, err := os.ReadFile(filepath.Join(outputDir, name))
+		if err != nil || string(got) != contents {
+			t.Errorf("%s: got %q (err: %v), want %q", name, got, err, contents)
+		}
+	}
+}
+
+func TestCore_ResendMissing(t *testing.T) {
+	pickupDir := t.TempDir()
+	files := writeTestFiles(t, pickupDir, 1, 3000)
+
+	importer := ramformats.NewRamImportBundle(10, t.TempDir())
+	core := &Core{
+		exporter: ramformats.NewRamExportBundle(1024, 10, 10),
+		sender:   newImportSink(importer),
+	}
+	rf := ramformats.NewRamFileFromLocal(filepath.Join(pickupDir, "core_file_0.bin"), "core_file_0.bin")
+	core.exporter.PushFile(*rf)
+	core.pendingFiles = append(core.pendingFiles, *rf)
+
+	// The second data record is lost on the way
+	for i := 0; ; i++ {
+		bundle, err := core.exporter.GetNextExportBundle()
+		if err != nil {
+			t.Fatalf("GetNextExportBundle failed: %v", err)
+		}
+		if bundle == nil {
+			break
+		}
+		if i != 2 {
+			core.sender.Write(bundle)
+		}
+	}
+	if importer.PopFile() != nil {
+		t.Fatal("File should not be complete before the resend")
+	}
+
+	if err := core.resendMissing(); err != nil {
+		t.Fatalf("resendMissing failed: %v", err)
+	}
+	delivered := importer.PopFile()
+	if delivered == nil {
+		t.Fatal("File did not complete after the resend")
+	}
+	got, _ := os.ReadFile(delivered.LocalPath)
+	if !bytes.Equal(got, files["core_file_0.bin"]) {
+		t.Error("Resent file does not match original")
+	}
+}
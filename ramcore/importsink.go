@@ -0,0 +1,77 @@
+package ramcore
+
+import (
+	"data_ram/ramformats"
+	"data_ram/ramio"
+	"data_ram/ramstream"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// importSink adapts a RamImportBundle to a RamStream so listeners can write
+// received export bundles straight into it. Every Write must be a whole bundle.
+// Writes may come from several connections at once.
+type importSink struct {
+	importer     *ramformats.RamImportBundle
+	bytesWritten atomic.Int64
+}
+
+func newImportSink(importer *ramformats.RamImportBundle) *importSink {
+	return &importSink{importer: importer}
+}
+
+// NewImportHandler returns an http.Handler that feeds records POSTed by an https or
+// http sender into importer, for mounting on an existing server with
+// mux.Handle("/dataram/", handler). maxBundleLen caps the size of a request.
+func NewImportHandler(importer *ramformats.RamImportBundle, maxBundleLen int) http.Handler {
+	return ramio.NewHTTPHandler(newImportSink(importer), maxBundleLen)
+}
+
+// NewWebSocketImportHandler is NewImportHandler for ws and wss senders.
+func NewWebSocketImportHandler(importer *ramformats.RamImportBundle, maxBundleLen int) http.Handler {
+	return ramio.NewWebSocketHandler(newImportSink(importer), maxBundleLen)
+}
+
+func (s *importSink) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("Read should not be called on import sink")
+}
+
+func (s *importSink) Write(p []byte) (int, error) {
+	if err := s.importer.ProcessNextExportBundle(p); err != nil {
+		return 0, err
+	}
+	s.bytesWritten.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// HandleNack answers a list of file UUIDs with the ranges of them still missing.
+func (s *importSink) HandleNack(request []byte) ([]byte, error) {
+	uuids, err := ramformats.DecodeUUIDList(request)
+	if err != nil {
+		return nil, err
+	}
+	return ramformats.EncodeResendRequests(s.importer.ResendRequests(uuids))
+}
+
+// Nack lets a local sender ask the sink directly.
+func (s *importSink) Nack(request []byte) ([]byte, error) {
+	return s.HandleNack(request)
+}
+
+func (s *importSink) Reset() error {
+	s.bytesWritten.Store(0)
+	return nil
+}
+
+func (s *importSink) Len() int {
+	return int(s.bytesWritten.Load())
+}
+
+func (s *importSink) Flush() error {
+	return nil
+}
+
+var _ ramstream.RamStream = (*importSink)(nil)
+var _ ramstream.RamNackHandler = (*importSink)(nil)
+var _ ramstream.RamNackSender = (*importSink)(nil)
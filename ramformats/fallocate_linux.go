@@ -0,0 +1,14 @@
+//go:build linux
+
+package ramformats
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocateFile reserves size bytes of disk for file so writes arriving out
+// of order do not fragment it or fail part way for lack of space.
+func preallocateFile(file *os.File, size int64) error {
+	return syscall.Fallocate(int(file.Fd()), 0, 0, size)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ramformats
+
+import (
+	"errors"
+	"os"
+)
+
+// preallocateFile is only supported on linux, elsewhere files are extended with Truncate.
+func preallocateFile(file *os.File, size int64) error {
+	return errors.ErrUnsupported
+}
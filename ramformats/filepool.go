@@ -0,0 +1,99 @@
+package ramformats
+
+import (
+	"fmt"
+	"os"
+)
+
+// openForRead opens a file to export from.
+func openForRead(path string) (*os.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return file, nil
+}
+
+// DEFAULT_MAX_OPEN_FILES bounds the files an exporter or importer keeps open at once
+const DEFAULT_MAX_OPEN_FILES = 16
+
+// filePool keeps a bounded number of files open so an export or import does
+// not reopen a file for every chunk. When full the least recently used file is
+// closed. It is not safe for concurrent use.
+type filePool struct {
+	maxOpen int
+	open    map[string]*os.File
+	order   []string // Least recently used first
+}
+
+func newFilePool(maxOpen int) *filePool {
+	return &filePool{
+		maxOpen: maxOpen,
+		open:    make(map[string]*os.File),
+		order:   make([]string, 0, maxOpen),
+	}
+}
+
+// get returns an open handle for path, opening it with open if needed.
+func (p *filePool) get(path string, open func(string) (*os.File, error)) (*os.File, error) {
+	if file, exists := p.open[path]; exists {
+		p.touch(path)
+		return file, nil
+	}
+	for len(p.order) >= p.maxOpen && len(p.order) > 0 {
+		p.close(p.order[0])
+	}
+	file, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	p.open[path] = file
+	p.order = append(p.order, path)
+	return file, nil
+}
+
+// touch moves path to the most recently used end of the order.
+func (p *filePool) touch(path string) {
+	for i, open := range p.order {
+		if open == path {
+			p.order = append(append(p.order[:i], p.order[i+1:]...), path)
+			return
+		}
+	}
+}
+
+// close closes path if it is open.
+func (p *filePool) close(path string) {
+	file, exists := p.open[path]
+	if !exists {
+		return
+	}
+	file.Close()
+	delete(p.open, path)
+	for i, open := range p.order {
+		if open == path {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// closeAll closes every open file.
+func (p *filePool) closeAll() {
+	for path := range p.open {
+		p.close(path)
+	}
+}
+
+// setMaxOpen changes the bound, closing files if there are now too many open.
+func (p *filePool) setMaxOpen(maxOpen int) {
+	p.maxOpen = maxOpen
+	for len(p.order) > maxOpen {
+		p.close(p.order[0])
+	}
+}
+
+// len returns the number of open files.
+func (p *filePool) len() int {
+	return len(p.open)
+}
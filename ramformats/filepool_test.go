@@ -0,0 +1,51 @@
+package ramformats
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestFilePool_Bounded(t *testing.T) {
+	files := make([]string, 4)
+	for i := range files {
+		files[i] = fmt.Sprintf("test_data/file_pool_file_%d.bin", i)
+		if _, err := createTestFile(files[i], 10); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		defer os.Remove(files[i])
+	}
+
+	pool := newFilePool(2)
+	first, err := pool.get(files[0], openForRead)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if again, _ := pool.get(files[0], openForRead); again != first {
+		t.Error("Expected the open handle to be reused")
+	}
+	pool.get(files[1], openForRead)
+	pool.get(files[0], openForRead) // files[1] is now least recently used
+	pool.get(files[2], openForRead)
+	if pool.len() != 2 {
+		t.Fatalf("Expected 2 open files, got %d", pool.len())
+	}
+	if _, open := pool.open[files[1]]; open {
+		t.Error("Least recently used file should have been closed")
+	}
+	if _, open := pool.open[files[0]]; !open {
+		t.Error("Recently used file should still be open")
+	}
+
+	pool.setMaxOpen(1)
+	if pool.len() != 1 {
+		t.Errorf("Expected 1 open file after shrinking, got %d", pool.len())
+	}
+	pool.closeAll()
+	if pool.len() != 0 {
+		t.Errorf("Expected no open files, got %d", pool.len())
+	}
+	if _, err := pool.get("test_data/missing.bin", openForRead); err == nil {
+		t.Error("Expected error opening a missing file")
+	}
+}
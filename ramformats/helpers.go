@@ -2,20 +2,92 @@ package ramformats
 
 // Function to generate UUID
 import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"data_ram/ramstream"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
 	"os"
 	"strconv"
 
 	"github.com/google/uuid"
 )
 
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SegmentChecksum returns the CRC32C of data.
+func SegmentChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32cTable)
+}
+
+// segmentChecksum returns the CRC32C of a data segment, covering its header
+// (UUID, file size, start and length) as well as its data so a corrupted
+// offset is caught along with corrupted data.
+func segmentChecksum(header []byte, data []byte) uint32 {
+	return crc32.Update(SegmentChecksum(header), crc32cTable, data)
+}
+
+// NewFileHasher returns a hash for one of the supported whole file hash algorithms.
+func NewFileHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case HashAlgSHA256:
+		return sha256.New(), nil
+	case HashAlgSHA512:
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("Unsupported hash algorithm: %s", algorithm)
+	}
+}
+
+// HashFile returns the hex encoded hash of the file at path.
+func HashFile(path string, algorithm string) (string, error) {
+	hasher, err := NewFileHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 func GenerateUUID() string {
 	// Generate a new UUID
 	return uuid.New().String()
 }
 
+// ValidateUUID checks s is a UUID in its canonical 36 character form. UUIDs
+// received from a peer name files and state files, so anything else, such as
+// a path, is refused.
+func ValidateUUID(s string) error {
+	if len(s) != UUID_LEN {
+		return fmt.Errorf("Invalid UUID %q: length %d", s, len(s))
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return fmt.Errorf("Invalid UUID %q", s)
+			}
+		case ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F'):
+		default:
+			return fmt.Errorf("Invalid UUID %q", s)
+		}
+	}
+	return nil
+}
+
 func GetIntFromString(value string) (int64, error) {
 	i64, err := strconv.ParseInt(value, 10, 64)
 	if err != nil {
@@ -30,10 +102,19 @@ func ExportMetaToBytes(meta map[string]map[string]string) ([]byte, error) {
 	return json.Marshal(meta)
 }
 
+// BytesToExportMeta decodes a metadata record body, a map of file UUID to the
+// file's metadata. Every key must be a valid UUID.
 func BytesToExportMeta(data []byte) (map[string]map[string]string, error) {
 	var meta map[string]map[string]string
-	err := json.Unmarshal(data, &meta)
-	return meta, err
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	for uuid := range meta {
+		if err := ValidateUUID(uuid); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
 }
 
 func IntToBytes(intToConvert int) []byte {
@@ -66,6 +147,12 @@ func PopFront(files *[]RamFile) (RamFile, bool) {
 }
 
 func PrepareFile(path string, size int64) (*os.File, error) {
+	return prepareFile(path, size, false)
+}
+
+// prepareFile opens a file for writing and grows it to size, reserving the
+// disk space up front when preallocate is set and the platform supports it.
+func prepareFile(path string, size int64, preallocate bool) (*os.File, error) {
 	// Open the file with read-write, create if not exists
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
@@ -81,6 +168,12 @@ func PrepareFile(path string, size int64) (*os.File, error) {
 
 	// Resize the file if it's smaller than desired
 	if info.Size() < size {
+		if preallocate {
+			if err := preallocateFile(file, size); err != nil {
+				// Fall back to a sparse file
+				ramstream.Logf("Preallocating %s failed, extending it instead: %v\n", path, err)
+			}
+		}
 		err = file.Truncate(size)
 		if err != nil {
 			file.Close()
@@ -88,6 +181,31 @@ func PrepareFile(path string, size int64) (*os.File, error) {
 		}
 	}
 
-	// Now file is ready for seeking and writing
+	// Now file is ready for writing with WriteAt
 	return file, nil
 }
+
+// WriteFileAtomic writes data to a temporary file, syncs it and renames it over path
+// so a crash never leaves a half written file behind.
+func WriteFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package ramformats
+
+import (
+	"fmt"
+)
+
+// BundleInfo is a decoded view of a single export bundle, used for inspection and debugging.
+type BundleInfo struct {
+	RecordHeader
+	Meta     map[string]map[string]string // Set for METADATA_HEADER bundles
+	Segments []SegmentInfo                // Set for DATA_HEADER bundles
+	Parity   *ParityInfo                  // Set for PARITY_HEADER bundles
+}
+
+// ParityInfo describes the group a parity record covers.
+type ParityInfo struct {
+	DataShards   int // Data records in the group, starting at the record's sequence
+	ParityShards int
+	Index        int // Which of the group's parity records this is
+	ShardLen     int
+}
+
+// SegmentInfo describes one file segment within a data bundle.
+type SegmentInfo struct {
+	UUID     string
+	FileSize int64
+	Start    int64
+	Length   int
+	Checksum uint32 // CRC32C of the data, zero if the record has no segment checksums
+	Valid    bool   // False if the data does not match the checksum
+}
+
+// InspectExportBundle decodes the headers of an export bundle without writing any file data.
+func InspectExportBundle(data []byte) (*BundleInfo, error) {
+	header, body, err := DecodeRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	info := &BundleInfo{RecordHeader: header}
+
+	switch info.RecordType {
+	case METADATA_HEADER:
+		meta, err := BytesToExportMeta(body)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing ram export meta map, %s", err)
+		}
+		info.Meta = meta
+	case DATA_HEADER:
+		segments, err := decodeSegments(body, header.SegmentChecksums())
+		if err != nil {
+			return nil, err
+		}
+		for _, segment := range segments {
+			info.Segments = append(info.Segments, segment.SegmentInfo)
+		}
+	case PARITY_HEADER:
+		g, index, _, err := decodeParityBody(body)
+		if err != nil {
+			return nil, err
+		}
+		info.Parity = &ParityInfo{DataShards: g.dataShards, ParityShards: g.parityShards, Index: index, ShardLen: g.shardLen}
+	default:
+		return nil, fmt.Errorf("Unrecognised type header: %d", info.RecordType)
+	}
+	return info, nil
+}
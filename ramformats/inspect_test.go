@@ -0,0 +1,82 @@
+package ramformats
+
+import (
+	"os"
+	"testing"
+)
+
+func TestInspectExportBundle(t *testing.T) {
+	os.MkdirAll("test_data", 0755)
+	filename := "test_data/inspect_file.bin"
+	if _, err := createTestFile(filename, 700); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+
+	exp := NewRamExportBundle(512, 4, 4)
+	rf := NewRamFileFromLocal(filename, "inspect_file.bin")
+	if err := exp.PushFile(*rf); err != nil {
+		t.Fatalf("PushFile failed: %v", err)
+	}
+
+	metaBundle, err := exp.GetNextExportBundle()
+	if err != nil {
+		t.Fatalf("GetNextExportBundle failed: %v", err)
+	}
+	info, err := InspectExportBundle(metaBundle)
+	if err != nil {
+		t.Fatalf("InspectExportBundle failed on metadata: %v", err)
+	}
+	if info.Version != FORMAT_VERSION_2 || info.RecordType != METADATA_HEADER || info.Sequence != 0 {
+		t.Errorf("Unexpected metadata bundle info: %+v", info)
+	}
+	if info.Meta[rf.UUID][DRFileNameKey] != "inspect_file.bin" {
+		t.Errorf("Metadata missing file name: %v", info.Meta)
+	}
+
+	bundleID := info.BundleID
+	var total int
+	sequence := 0
+	for {
+		dataBundle, err := exp.GetNextExportBundle()
+		if err != nil {
+			t.Fatalf("GetNextExportBundle failed: %v", err)
+		}
+		if dataBundle == nil {
+			break
+		}
+		info, err := InspectExportBundle(dataBundle)
+		if err != nil {
+			t.Fatalf("InspectExportBundle failed on data: %v", err)
+		}
+		sequence++
+		if info.RecordType != DATA_HEADER || !info.SegmentChecksums() {
+			t.Errorf("Unexpected data record type %d flags %d", info.RecordType, info.Flags)
+		}
+		if info.BundleID != bundleID || info.Sequence != sequence {
+			t.Errorf("Unexpected bundle %s sequence %d, want %s %d", info.BundleID, info.Sequence, bundleID, sequence)
+		}
+		if final := info.Flags&RECORD_FLAG_FINAL != 0; final != (sequence == 2) {
+			t.Errorf("Record %d has final flag %v", sequence, final)
+		}
+		for _, segment := range info.Segments {
+			if !segment.Valid {
+				t.Errorf("Segment failed its checksum: %+v", segment)
+			}
+			if segment.UUID != rf.UUID || segment.FileSize != 700 || segment.Start != int64(total) {
+				t.Errorf("Unexpected segment: %+v", segment)
+			}
+			total += segment.Length
+		}
+		if _, err := InspectExportBundle(dataBundle[:len(dataBundle)-1]); err == nil {
+			t.Error("Expected error for truncated data bundle")
+		}
+	}
+	if total != 700 {
+		t.Errorf("Segments cover %d bytes, want 700", total)
+	}
+
+	if _, err := InspectExportBundle([]byte{1, 2, 3, 4, 5, 6, 7, 8}); err == nil {
+		t.Error("Expected error for bad block header")
+	}
+}
@@ -3,7 +3,7 @@ package ramformats
 import (
 	"fmt"
 	"io"
-	"os"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
@@ -17,7 +17,7 @@ import (
 // 2. A data block that contains the actual data of the files in the bundle
 // Multiple data blocks may result from a single bundle. Only a single metadata map will be created for each bundle.
 
-// State will need to be saved and stored for this class for restarts
+// State can be journaled to disk for restarts, see ramexportstate.go
 
 type RamExportBundle struct {
 	fileInboundQueue []RamFile
@@ -31,47 +31,174 @@ type RamExportBundle struct {
 	maxQueueSize   int   // Maximum size of the queue
 	chunkSize      int64
 	maxBundleCount int
-	mu             sync.Mutex // Mutex to protect concurrent access
+	hashAlgorithm  string             // Whole file hash added to each file's metadata
+	formatVersion  int                // Wire format version of the records produced
+	bundleID       string             // Identifies the records of the current export in v2 headers
+	sentFiles      map[string]RamFile // Exported files kept for resends until released
+	sentBundles    map[string]string  // Bundle ID each sent file was exported in
+	readers        *filePool          // Bounded set of open files being exported
+	recordBuffer   []byte             // Reused to build data records
+	statePath      string             // Journal file, empty when state is not persisted
+	bundlesAcked   int64              // Bundles of the current export the receiver has acknowledged
+	metaAcked      bool               // Whether the current export's metadata has been acknowledged
+	fecData        int                // Data records per parity group, 0 without FEC, see ramfec.go
+	fecParity      int                // Parity records per group
+	fecRecords     [][]byte           // Data records of the current group, for its parity
+	fecGroupStart  int                // Sequence of the first record of the current group
+	parityRecords  [][]byte           // Parity records of the finished group still to send
+	mu             sync.Mutex         // Mutex to protect concurrent access
 }
 
 func NewRamExportBundle(chunkSize int64, maxBundleCount int, maxQueueSize int) *RamExportBundle {
 	return &RamExportBundle{
 		fileInboundQueue: make([]RamFile, 0),
 		exportBundle:     make([]RamFile, 0),
+		sentFiles:        make(map[string]RamFile),
+		sentBundles:      make(map[string]string),
+		readers:          newFilePool(DEFAULT_MAX_OPEN_FILES),
 		chunkSize:        chunkSize,
 		maxBundleCount:   maxBundleCount,
 		maxQueueSize:     maxQueueSize,
 		exportFinished:   true,
+		hashAlgorithm:    HashAlgSHA256,
+		formatVersion:    DEFAULT_FORMAT_VERSION,
 	}
 }
 
+// MaxRecordLen returns the longest record, header included, an exporter with
+// these settings sends, so receivers can size their buffers to accept it. With
+// fecData set the parity records, which carry a copy sized to the longest data
+// record of their group, are the longest.
+func MaxRecordLen(chunkSize int64, maxBundleCount int, fecData int) int64 {
+	recordLen := int64(V2_HEADER_LEN) + chunkSize + int64(maxBundleCount)*(SEGMENT_HEADER_LEN+CHECKSUM_LEN)
+	if fecData > 0 {
+		recordLen += V2_HEADER_LEN + 4*INT32_LEN + int64(fecData)*INT32_LEN
+	}
+	return recordLen
+}
+
+// SetHashAlgorithm selects the whole file hash sent in each file's metadata,
+// HashAlgNone disables it.
+func (rb *RamExportBundle) SetHashAlgorithm(algorithm string) error {
+	if algorithm != HashAlgNone {
+		if _, err := NewFileHasher(algorithm); err != nil {
+			return err
+		}
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.hashAlgorithm = algorithm
+	return nil
+}
+
+// SetFormatVersion selects the wire format of the records produced. Receivers
+// accept both versions so v1 can still be sent to receivers that predate v2.
+func (rb *RamExportBundle) SetFormatVersion(version int) error {
+	if version != FORMAT_VERSION_1 && version != FORMAT_VERSION_2 {
+		return fmt.Errorf("Unsupported export format version: %d", version)
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.formatVersion = version
+	return nil
+}
+
+// segmentChecksums reports whether data segments carry checksums. v1 records
+// are left as older receivers expect them, without. The caller must hold rb.mu.
+func (rb *RamExportBundle) segmentChecksums() bool {
+	return rb.formatVersion >= FORMAT_VERSION_2
+}
+
 func (rb *RamExportBundle) PushFile(rf RamFile) error {
 	rb.mu.Lock()
 	defer rb.mu.Unlock()
 
 	if len(rb.fileInboundQueue) < rb.maxQueueSize {
 		rb.fileInboundQueue = append(rb.fileInboundQueue, rf)
+		if err := rb.saveState(); err != nil {
+			// Not queued, the caller keeps the file and pushes it again
+			rb.fileInboundQueue = rb.fileInboundQueue[:len(rb.fileInboundQueue)-1]
+			return err
+		}
 		return nil
 	} else {
 		return fmt.Errorf("RamBundle queue is full, cannot add more files until some are processed")
 	}
 }
 
+// fileMeta builds the metadata sent for a file. The caller must hold rb.mu.
+func (rb *RamExportBundle) fileMeta(rf RamFile) (map[string]string, error) {
+	fileMeta := make(map[string]string)
+	fileMeta[DRFileNameKey] = rf.MetaData[DRFileNameKey]
+	fileMeta[DRFileSizeKey] = rf.MetaData[DRFileSizeKey]
+	fileMeta[DRUUIDKey] = rf.UUID
+	fileMeta[DRSendStartKey] = time.Now().Format(time.RFC3339)
+	fileMeta[DRChunkSizeKey] = strconv.FormatInt(rb.chunkSize, 10)
+	if rb.hashAlgorithm != HashAlgNone {
+		fileHash, err := HashFile(rf.LocalPath, rb.hashAlgorithm)
+		if err != nil {
+			return nil, fmt.Errorf("Error hashing file %s: %v", rf.LocalPath, err)
+		}
+		fileMeta[DRFileHashKey] = fileHash
+		fileMeta[DRHashAlgKey] = rb.hashAlgorithm
+	}
+	return fileMeta, nil
+}
+
+// GetNextExportBundle returns the next record of the export, or nil when
+// there is nothing left to send. The returned slice is owned by the caller.
 func (rb *RamExportBundle) GetNextExportBundle() ([]byte, error) {
-	// Get and return the next chunk
-	if rb.bundlesSent >= rb.totalBundles {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	record, err := rb.nextRecord()
+	if err != nil || record == nil {
+		return nil, err
+	}
+	return slices.Clone(record), nil
+}
+
+// WriteNextExportBundle writes the next record of the export to w and returns
+// the bytes written, 0 when there is nothing left to send. Data records are
+// built in a buffer reused between calls so no per record allocation is made.
+// If the write fails the export position is not advanced.
+func (rb *RamExportBundle) WriteNextExportBundle(w io.Writer) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if exporting, err := rb.startNextExport(); err != nil || !exporting {
+		return 0, err
+	}
+	sentMetaData, bundlesSent, fec := rb.sentMetaData, rb.bundlesSent, rb.saveFECState()
+	record, err := rb.nextRecord()
+	if err != nil || record == nil {
+		return 0, err
+	}
+	n, err := w.Write(record)
+	if err != nil {
+		rb.sentMetaData, rb.bundlesSent = sentMetaData, bundlesSent
+		rb.restoreFECState(fec)
+		return n, err
+	}
+	return n, nil
+}
+
+// startNextExport finishes the current export once every record has been
+// sent and starts the next from the queue. It returns false when there is
+// nothing to export. The caller must hold rb.mu.
+func (rb *RamExportBundle) startNextExport() (bool, error) {
+	if rb.bundlesSent >= rb.totalBundles && !rb.fecPending() {
 		rb.exportFinished = true // All bundles have been sent
 		// rb.exportBundleMeta = nil
 		rb.totalBundles = 0
 		rb.bundlesSent = 0
 		rb.exportMeta = nil
 		rb.exportBundle = rb.exportBundle[:0] // Clear the export bundle
+		rb.readers.closeAll()                 // None of the open files are needed any more
 	}
 
 	// Check to see if the previous bundle is complete
 	if rb.exportFinished {
-		rb.mu.Lock()
-		defer rb.mu.Unlock()
 		newBundleSize := int64(0)
 		newBundleCount := 0
 		// loop over each file in the queue
@@ -82,7 +209,7 @@ func (rb *RamExportBundle) GetNextExportBundle() ([]byte, error) {
 			}
 			sizeVal, err := GetIntFromString(rf.MetaData[DRFileSizeKey])
 			if err != nil || sizeVal <= 0 {
-				return nil, fmt.Errorf("Error parsing file %s cannot add file to queue: %v", rf.LocalPath, err)
+				return false, fmt.Errorf("Error parsing file %s cannot add file to queue: %v", rf.LocalPath, err)
 			}
 
 			newBundleSize += sizeVal
@@ -99,17 +226,21 @@ func (rb *RamExportBundle) GetNextExportBundle() ([]byte, error) {
 		if newBundleCount != 0 {
 			rb.exportFinished = false // We have a new bundle to export
 			rb.bundlesSent = 0
+			rb.bundlesAcked = 0
+			rb.metaAcked = false
+			rb.bundleID = GenerateUUID()
 
 			// Build metadata for the new bundle
 			rb.exportMeta = make(map[string]map[string]string)
 			for i := 0; i < len(rb.exportBundle); i++ {
 				rf := rb.exportBundle[i]
-				rb.exportMeta[rf.UUID] = make(map[string]string)
-				rb.exportMeta[rf.UUID][DRFileNameKey] = rf.MetaData[DRFileNameKey]
-				rb.exportMeta[rf.UUID][DRFileSizeKey] = rf.MetaData[DRFileSizeKey]
-				rb.exportMeta[rf.UUID][DRUUIDKey] = rf.UUID
-				rb.exportMeta[rf.UUID][DRSendStartKey] = time.Now().Format(time.RFC3339)
-				rb.exportMeta[rf.UUID][DRChunkSizeKey] = strconv.FormatInt(rb.chunkSize, 10)
+				fileMeta, err := rb.fileMeta(rf)
+				if err != nil {
+					return false, err
+				}
+				rb.exportMeta[rf.UUID] = fileMeta
+				rb.sentFiles[rf.UUID] = rf
+				rb.sentBundles[rf.UUID] = rb.bundleID
 			}
 			rb.sentMetaData = false
 
@@ -119,12 +250,26 @@ func (rb *RamExportBundle) GetNextExportBundle() ([]byte, error) {
 				rb.totalBundles += 1
 				newBundleSize -= rb.chunkSize
 			}
+			// Let the receiver tell which chunks of the bundle it is missing
+			for _, fileMeta := range rb.exportMeta {
+				fileMeta[DRBundleIDKey] = rb.bundleID
+				fileMeta[DRNumChunks] = strconv.FormatInt(rb.totalBundles, 10)
+			}
 
 		} else {
-			// No more files to process, return nil
-			return nil, nil
+			// No more files to process
+			return false, nil
 		}
 	}
+	return true, nil
+}
+
+// nextRecord builds the next record of the export. Data records are returned
+// in rb.recordBuffer and are only valid until the next call. The caller must hold rb.mu.
+func (rb *RamExportBundle) nextRecord() ([]byte, error) {
+	if exporting, err := rb.startNextExport(); err != nil || !exporting {
+		return nil, err
+	}
 
 	// Return bytes of the exportMeta.
 	if !rb.sentMetaData {
@@ -135,27 +280,36 @@ func (rb *RamExportBundle) GetNextExportBundle() ([]byte, error) {
 		}
 		rb.sentMetaData = true // Metadata has been sent
 
-		// Append MetaData header to the start of the bytes
-		headerBytes := IntToBytes(METADATA_HEADER)
-		headerBytes = append(DATARAM_EXPORT_BUNDLE_HEADER_1, headerBytes...)
-		bytes = append(headerBytes, bytes...)
+		return EncodeRecord(RecordHeader{
+			Version:    rb.formatVersion,
+			RecordType: METADATA_HEADER,
+			Flags:      RECORD_FLAG_BODY_CHECKSUM,
+			BundleID:   rb.bundleID,
+		}, bytes)
+	}
+
+	// Parity follows the last data record of each group
+	if rb.fecPending() {
+		return rb.nextParityRecord()
+	}
 
-		return bytes, nil
+	// Reserve the header in front of the body, it is filled in once the body is built
+	headerLen, err := recordHeaderLen(rb.formatVersion)
+	if err != nil {
+		return nil, err
 	}
+	if rb.recordBuffer == nil {
+		segmentsLen := rb.maxBundleCount * (SEGMENT_HEADER_LEN + CHECKSUM_LEN)
+		rb.recordBuffer = make([]byte, 0, V2_HEADER_LEN+int(rb.chunkSize)+segmentsLen)
+	}
+	record := rb.recordBuffer[:headerLen]
 
-	bytesBundle := make([]byte, 0)
-	headerBytes := IntToBytes(DATA_HEADER)
-	headerBytes = append(DATARAM_EXPORT_BUNDLE_HEADER_1, headerBytes...)
-	bytesBundle = append(headerBytes, bytesBundle...)
 	// Bytes we have sent on the previous bundle
 	bundleTotalPosition := int64(rb.chunkSize) * int64(rb.bundlesSent)
 	bundleRelativePosition := int64(0)
 	thisBundleBytes := int64(0)
-	// // Bytes we have sent in the current bundle
-	// currentFilePosition := int64(0)
-	// What pos in the current file do we start to read from
 
-	for i := 0; i < len(rb.exportBundle); i++ {
+	for i := 0; i < len(rb.exportBundle) && thisBundleBytes < rb.chunkSize; i++ {
 		// Iterate over the files until we reach sentBytes
 		rf := rb.exportBundle[i]
 		sizeVal, err := GetIntFromString(rf.MetaData[DRFileSizeKey])
@@ -165,7 +319,7 @@ func (rb *RamExportBundle) GetNextExportBundle() ([]byte, error) {
 
 		// If we write this file out and we still havent caught up to our relative position
 		// This file must be completed
-		if bundleRelativePosition+sizeVal < bundleTotalPosition {
+		if bundleRelativePosition+sizeVal <= bundleTotalPosition {
 			bundleRelativePosition = bundleRelativePosition + sizeVal
 			continue
 		}
@@ -178,43 +332,67 @@ func (rb *RamExportBundle) GetNextExportBundle() ([]byte, error) {
 			amountToRead = (sizeVal - currentFilePosition)
 		}
 
-		bundleChunk := make([]byte, amountToRead)
-		// open a filestream for rf
-
-		fileHandle, err := os.Open(rf.LocalPath)
+		fileHandle, err := rb.readers.get(rf.LocalPath, openForRead)
 		if err != nil {
-			return nil, fmt.Errorf("failed to open file: %w", err)
+			return nil, err
 		}
-
-		n, err := fileHandle.ReadAt(bundleChunk, currentFilePosition)
+		record, err = appendFileSegment(record, rf.UUID, sizeVal, currentFilePosition, int(amountToRead), fileHandle, rb.segmentChecksums())
 		if err != nil {
-			if err == io.EOF {
-				return nil, nil // Return number of bytes read before EOF
-			}
-			return nil, fmt.Errorf("failed to read from file: %w", err)
+			return nil, err
 		}
-
-		// append bytesBundle to bundleChunk\
-		// TODO format (UUID, start_pos, len, Datablob)
-		uuidBytes := []byte(rf.UUID)
-		if len(uuidBytes) != UUID_LEN {
-			return nil, fmt.Errorf("Invalid UUID length: %d", len(uuidBytes))
+		if currentFilePosition+amountToRead == sizeVal {
+			// Finished with this file
+			rb.readers.close(rf.LocalPath)
 		}
-		totalFileSize := Int64ToBytes(sizeVal)
-		startPos := Int64ToBytes(currentFilePosition)
-		len := IntToBytes(n)
-		bytesBundle = append(bytesBundle, uuidBytes...)
-		bytesBundle = append(bytesBundle, totalFileSize...)
-		bytesBundle = append(bytesBundle, startPos...)
-		bytesBundle = append(bytesBundle, len...)
-		bytesBundle = append(bytesBundle, bundleChunk...)
-		thisBundleBytes += int64(n)
+		thisBundleBytes += amountToRead
 
 		// Update relative position
-		bundleRelativePosition += int64(n)
-		bundleTotalPosition += int64(n)
+		bundleRelativePosition += amountToRead
+		bundleTotalPosition += amountToRead
 	}
+	// Keep any growth so the next record does not have to
+	rb.recordBuffer = record[:0]
 
 	rb.bundlesSent += 1
-	return bytesBundle, nil
+	header := RecordHeader{
+		Version:    rb.formatVersion,
+		RecordType: DATA_HEADER,
+		Flags:      RECORD_FLAG_SEGMENT_CHECKSUMS,
+		BundleID:   rb.bundleID,
+		Sequence:   int(rb.bundlesSent),
+	}
+	if rb.bundlesSent == rb.totalBundles {
+		header.Flags |= RECORD_FLAG_FINAL
+	}
+	fec := rb.fecEnabled()
+	if fec {
+		header.Flags |= RECORD_FLAG_FEC
+	}
+	if err := putRecordHeader(record[:headerLen], header, record[headerLen:]); err != nil {
+		return nil, err
+	}
+	if fec {
+		rb.addFECRecord(header.Sequence, record)
+	}
+	return record, nil
+}
+
+// SetMaxOpenFiles bounds how many files are kept open while exporting.
+func (rb *RamExportBundle) SetMaxOpenFiles(maxOpen int) error {
+	if maxOpen <= 0 {
+		return fmt.Errorf("Max open files must be positive, got %d", maxOpen)
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.readers.setMaxOpen(maxOpen)
+	return nil
+}
+
+// Close closes every file the exporter has open. Exporting can continue
+// afterwards, files are reopened as needed.
+func (rb *RamExportBundle) Close() error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.readers.closeAll()
+	return nil
 }
@@ -1,13 +1,16 @@
 package ramformats
 
 import (
+	"bytes"
 	"crypto/rand"
 	"fmt"
+	"io"
 	"os"
 	"testing"
 )
 
 func createTestFile(filename string, size int) ([]byte, error) {
+	os.MkdirAll("test_data", 0755)
 	data := make([]byte, size)
 	_, err := rand.Read(data)
 	if err != nil {
@@ -186,3 +189,116 @@ func TestRamBundle_GetNextBundleBigLite(t *testing.T) {
 		t.Error("No data bundle found")
 	}
 }
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("write failed")
+}
+
+func TestRamExportBundle_WriteNextExportBundle(t *testing.T) {
+	fileCount := 5
+	originals := make(map[string][]byte)
+	exp := NewRamExportBundle(300, 2, 10)
+	if err := exp.SetMaxOpenFiles(2); err != nil {
+		t.Fatalf("SetMaxOpenFiles failed: %v", err)
+	}
+	if err := exp.SetMaxOpenFiles(0); err == nil {
+		t.Error("Expected error for zero max open files")
+	}
+	for i := 0; i < fileCount; i++ {
+		filename := fmt.Sprintf("test_data/export_stream_file_%d.bin", i)
+		data, err := createTestFile(filename, 250+i*100)
+		if err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		defer os.Remove(filename)
+		rf := NewRamFileFromLocal(filename, filename)
+		originals[rf.UUID] = data
+		exp.PushFile(*rf)
+	}
+
+	imp := NewRamImportBundle(10, t.TempDir())
+	var record bytes.Buffer
+	for {
+		// A failed write leaves the position where it was
+		if n, err := exp.WriteNextExportBundle(failingWriter{}); err == nil {
+			if n != 0 {
+				t.Fatal("Expected write error")
+			}
+			break // Nothing left to write
+		}
+		record.Reset()
+		n, err := exp.WriteNextExportBundle(&record)
+		if err != nil {
+			t.Fatalf("WriteNextExportBundle failed: %v", err)
+		}
+		if n == 0 {
+			t.Fatal("Record lost after a failed write")
+		}
+		if n != record.Len() {
+			t.Errorf("Reported %d bytes, wrote %d", n, record.Len())
+		}
+		if exp.readers.len() > 2 {
+			t.Errorf("Exporter has %d files open, limit is 2", exp.readers.len())
+		}
+		if err := imp.ProcessNextExportBundle(record.Bytes()); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed: %v", err)
+		}
+	}
+	if exp.readers.len() != 0 {
+		t.Errorf("Files left open after the export finished: %d", exp.readers.len())
+	}
+	for i := 0; i < fileCount; i++ {
+		rf := imp.PopFile()
+		if rf == nil {
+			t.Fatalf("Expected %d files, got %d", fileCount, i)
+		}
+		got, _ := os.ReadFile(rf.LocalPath)
+		if !bytes.Equal(got, originals[rf.UUID]) {
+			t.Errorf("File %s does not match original", rf.UUID)
+		}
+	}
+}
+
+func TestRamExportBundle_FileShrinks(t *testing.T) {
+	filename := "test_data/export_shrink_file.bin"
+	if _, err := createTestFile(filename, 500); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+	exp := NewRamExportBundle(256, 10, 10)
+	exp.PushFile(*NewRamFileFromLocal(filename, filename))
+	if _, err := exp.GetNextExportBundle(); err != nil {
+		t.Fatalf("GetNextExportBundle failed: %v", err)
+	}
+	os.Truncate(filename, 100)
+	if _, err := exp.GetNextExportBundle(); err == nil {
+		t.Error("Expected error reading a file that shrank")
+	}
+}
+
+func BenchmarkRamExportBundle_WriteNextExportBundle(b *testing.B) {
+	filename := "test_data/export_bench_file.bin"
+	if _, err := createTestFile(filename, 8*1024*1024); err != nil {
+		b.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+	b.SetBytes(8 * 1024 * 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		exp := NewRamExportBundle(1024*1024, 10, 10)
+		exp.SetHashAlgorithm(HashAlgNone)
+		exp.PushFile(*NewRamFileFromLocal(filename, filename))
+		for {
+			n, err := exp.WriteNextExportBundle(io.Discard)
+			if err != nil {
+				b.Fatalf("WriteNextExportBundle failed: %v", err)
+			}
+			if n == 0 {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package ramformats
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Export state journal
+// The journal is a JSON snapshot of the export queue and the position of the
+// current export, rewritten atomically whenever files are queued or a bundle is
+// acknowledged. Positions are only advanced by AcknowledgeBundle so after a
+// crash GetNextExportBundle resumes with the first bundle the receiver did not
+// confirm. AcknowledgeBundle covers every bundle requested since the last one, so
+// callers sending several at once acknowledge only when all of them arrived.
+
+type exportState struct {
+	FileInboundQueue []RamFile                    `json:"fileInboundQueue"`
+	ExportBundle     []RamFile                    `json:"exportBundle"`
+	ExportMeta       map[string]map[string]string `json:"exportMeta"`
+	ExportFinished   bool                         `json:"exportFinished"`
+	SentMetaData     bool                         `json:"sentMetaData"`
+	BundlesSent      int64                        `json:"bundlesSent"`
+	TotalBundles     int64                        `json:"totalBundles"`
+	ChunkSize        int64                        `json:"chunkSize"`
+	BundleID         string                       `json:"bundleID"`
+}
+
+// NewRamExportBundleWithState creates an export bundle journaled to statePath,
+// restoring any state a previous run left behind.
+func NewRamExportBundleWithState(chunkSize int64, maxBundleCount int, maxQueueSize int, statePath string) (*RamExportBundle, error) {
+	rb := NewRamExportBundle(chunkSize, maxBundleCount, maxQueueSize)
+	rb.statePath = statePath
+
+	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return rb, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading export state: %v", err)
+	}
+	var state exportState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("Error parsing export state %s: %v", statePath, err)
+	}
+	exportInProgress := !state.ExportFinished && state.BundlesSent < state.TotalBundles
+	if exportInProgress && state.ChunkSize != chunkSize {
+		// Bundle positions are multiples of the chunk size so they cannot be resumed with another
+		return nil, fmt.Errorf("Export state was written with chunk size %d, not %d", state.ChunkSize, chunkSize)
+	}
+
+	rb.fileInboundQueue = state.FileInboundQueue
+	if rb.fileInboundQueue == nil {
+		rb.fileInboundQueue = make([]RamFile, 0)
+	}
+	rb.exportBundle = state.ExportBundle
+	if rb.exportBundle == nil {
+		rb.exportBundle = make([]RamFile, 0)
+	}
+	rb.exportMeta = state.ExportMeta
+	rb.exportFinished = state.ExportFinished
+	rb.sentMetaData = state.SentMetaData
+	rb.metaAcked = state.SentMetaData
+	rb.bundlesSent = state.BundlesSent
+	rb.bundlesAcked = state.BundlesSent
+	rb.totalBundles = state.TotalBundles
+	rb.bundleID = state.BundleID
+	if rb.bundleID == "" {
+		// Journals written before bundle IDs existed
+		rb.bundleID = GenerateUUID()
+	}
+	for _, rf := range rb.exportBundle {
+		rb.sentFiles[rf.UUID] = rf
+		rb.sentBundles[rf.UUID] = rb.bundleID
+	}
+	return rb, nil
+}
+
+// AcknowledgeBundle records that every bundle returned by GetNextExportBundle
+// since the last acknowledgement was delivered and journals the new position.
+func (rb *RamExportBundle) AcknowledgeBundle() error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.bundlesAcked = rb.bundlesSent
+	rb.metaAcked = rb.sentMetaData
+	return rb.saveState()
+}
+
+// PendingFiles returns every file that is queued or part of the current export.
+func (rb *RamExportBundle) PendingFiles() []RamFile {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	files := make([]RamFile, 0, len(rb.exportBundle)+len(rb.fileInboundQueue))
+	if !rb.exportFinished {
+		files = append(files, rb.exportBundle...)
+	}
+	return append(files, rb.fileInboundQueue...)
+}
+
+// saveState writes the journal. The caller must hold rb.mu.
+func (rb *RamExportBundle) saveState() error {
+	if rb.statePath == "" {
+		return nil
+	}
+	state := exportState{
+		FileInboundQueue: rb.fileInboundQueue,
+		ExportBundle:     rb.exportBundle,
+		ExportMeta:       rb.exportMeta,
+		ExportFinished:   rb.exportFinished,
+		SentMetaData:     rb.metaAcked,
+		BundlesSent:      rb.bundlesAcked,
+		TotalBundles:     rb.totalBundles,
+		ChunkSize:        rb.chunkSize,
+		BundleID:         rb.bundleID,
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Error encoding export state: %v", err)
+	}
+	if err := WriteFileAtomic(rb.statePath, data); err != nil {
+		return fmt.Errorf("Error saving export state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package ramformats
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRamExportBundle_ResumeFromState(t *testing.T) {
+	fileCount := 3
+	fileSize := 1000
+	files := make([]string, fileCount)
+	for i := 0; i < fileCount; i++ {
+		files[i] = fmt.Sprintf("test_data/export_state_file_%d.bin", i)
+		if _, err := createTestFile(files[i], fileSize); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		defer os.Remove(files[i])
+	}
+	statePath := filepath.Join(t.TempDir(), "export.json")
+
+	exp, err := NewRamExportBundleWithState(256, 10, 10, statePath)
+	if err != nil {
+		t.Fatalf("NewRamExportBundleWithState failed: %v", err)
+	}
+	for i := 0; i < fileCount; i++ {
+		if err := exp.PushFile(*NewRamFileFromLocal(files[i], files[i])); err != nil {
+			t.Fatalf("PushFile failed: %v", err)
+		}
+	}
+
+	// Send and acknowledge the metadata and two data bundles
+	delivered := make([][]byte, 0)
+	for i := 0; i < 3; i++ {
+		bundle, err := exp.GetNextExportBundle()
+		if err != nil || bundle == nil {
+			t.Fatalf("GetNextExportBundle failed: %v", err)
+		}
+		if err := exp.AcknowledgeBundle(); err != nil {
+			t.Fatalf("AcknowledgeBundle failed: %v", err)
+		}
+		delivered = append(delivered, bundle)
+	}
+	// This bundle is lost in the crash before it is acknowledged
+	lost, err := exp.GetNextExportBundle()
+	if err != nil || lost == nil {
+		t.Fatalf("GetNextExportBundle failed: %v", err)
+	}
+
+	resumed, err := NewRamExportBundleWithState(256, 10, 10, statePath)
+	if err != nil {
+		t.Fatalf("Failed to resume from state: %v", err)
+	}
+	if len(resumed.PendingFiles()) != fileCount {
+		t.Errorf("Expected %d pending files after resume, got %d", fileCount, len(resumed.PendingFiles()))
+	}
+	first, err := resumed.GetNextExportBundle()
+	if err != nil {
+		t.Fatalf("GetNextExportBundle after resume failed: %v", err)
+	}
+	if !bytes.Equal(first, lost) {
+		t.Fatalf("Resumed export did not restart at the unacknowledged bundle")
+	}
+	delivered = append(delivered, first)
+	resumed.AcknowledgeBundle()
+	for {
+		bundle, err := resumed.GetNextExportBundle()
+		if err != nil {
+			t.Fatalf("GetNextExportBundle failed: %v", err)
+		}
+		if bundle == nil {
+			break
+		}
+		resumed.AcknowledgeBundle()
+		delivered = append(delivered, bundle)
+	}
+
+	imp := NewRamImportBundle(10, "test_data/")
+	for _, bundle := range delivered {
+		if err := imp.ProcessNextExportBundle(bundle); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed: %v", err)
+		}
+	}
+	for i := 0; i < fileCount; i++ {
+		rf := imp.PopFile()
+		if rf == nil {
+			t.Fatalf("Only %d of %d files completed", i, fileCount)
+		}
+		got, _ := os.ReadFile(rf.LocalPath)
+		want, _ := os.ReadFile(rf.MetaData[DRFileNameKey])
+		if !bytes.Equal(got, want) {
+			t.Errorf("Resumed file %s does not match the original", rf.MetaData[DRFileNameKey])
+		}
+		os.Remove(rf.LocalPath)
+	}
+
+	if _, err := NewRamExportBundleWithState(512, 10, 10, statePath); err != nil {
+		t.Errorf("A finished export should resume with any chunk size: %v", err)
+	}
+}
+
+func TestRamExportBundle_CorruptState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "export.json")
+	os.WriteFile(statePath, []byte("{not json"), 0644)
+	if _, err := NewRamExportBundleWithState(256, 10, 10, statePath); err == nil {
+		t.Error("Expected error for corrupt state file")
+	}
+}
+
+func TestRamExportBundle_PushFileSaveFails(t *testing.T) {
+	stateDir := t.TempDir()
+	rb, err := NewRamExportBundleWithState(256, 10, 10, filepath.Join(stateDir, "export.json"))
+	if err != nil {
+		t.Fatalf("NewRamExportBundleWithState failed: %v", err)
+	}
+	os.RemoveAll(stateDir)
+	if err := rb.PushFile(RamFile{UUID: GenerateUUID()}); err == nil {
+		t.Fatal("Expected PushFile to fail when the journal cannot be saved")
+	}
+	if len(rb.PendingFiles()) != 0 {
+		t.Errorf("A file that was not journaled was left queued")
+	}
+}
@@ -0,0 +1,349 @@
+package ramformats
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Forward error correction
+// With SetFEC(K, M) the exporter follows every K data records of a bundle with
+// M Reed-Solomon parity records (fewer data records in the last group of a
+// bundle). The importer keeps the data records of a group until the group is
+// whole, and once any K of its K+M records have arrived it rebuilds the
+// missing data records and applies them as if they had been received, so
+// nothing has to be retransmitted. Only v2 exports are covered; FEC state is
+// kept in memory and lost on restart.
+//
+// Data records in a group have RECORD_FLAG_FEC set. Parity records have type
+// PARITY_HEADER, the sequence of the first data record of their group, and a
+// body of:
+//
+// data shards(4), parity shards(4), parity index(4), shard length(4),
+// data shards x record length(4), parity shard
+//
+// Shards are the whole data records, header included, padded with zeros to
+// the length of the longest.
+
+const (
+	MAX_FEC_SHARDS = 256 // Reed-Solomon over GF(2^8)
+	// Bundles with FEC state kept by the importer, the oldest is dropped beyond this
+	maxFECBundles = 64
+)
+
+// fecGroup is the parity the importer has received for one group.
+type fecGroup struct {
+	dataShards   int
+	parityShards int
+	shardLen     int
+	lengths      []int          // Length of each data record
+	parity       map[int][]byte // Parity shards by index
+}
+
+// fecBundle is the importer's FEC state for one bundle.
+type fecBundle struct {
+	records map[int][]byte    // Clean FEC covered data records by sequence, until their group is finished
+	groups  map[int]*fecGroup // Parity received, by the sequence of the group's first record
+	done    []ByteRange       // Sequences of finished groups
+}
+
+// ValidateFEC checks a data and parity shard count, 0 data shards disables FEC.
+func ValidateFEC(dataShards int, parityShards int) error {
+	if dataShards == 0 && parityShards == 0 {
+		return nil
+	}
+	if dataShards < 1 || parityShards < 1 || dataShards+parityShards > MAX_FEC_SHARDS {
+		return fmt.Errorf("FEC needs at least 1 data and 1 parity shard and at most %d in total, got %d+%d",
+			MAX_FEC_SHARDS, dataShards, parityShards)
+	}
+	return nil
+}
+
+// SetFEC makes the exporter follow every dataShards data records with
+// parityShards parity records. 0, 0 disables it.
+func (rb *RamExportBundle) SetFEC(dataShards int, parityShards int) error {
+	if err := ValidateFEC(dataShards, parityShards); err != nil {
+		return err
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.fecData, rb.fecParity = dataShards, parityShards
+	// A group in progress is sent without parity rather than with the wrong shape
+	rb.fecRecords, rb.parityRecords = nil, nil
+	return nil
+}
+
+// fecEnabled reports whether data records are covered by parity. The caller must hold rb.mu.
+func (rb *RamExportBundle) fecEnabled() bool {
+	return rb.fecData > 0 && rb.formatVersion >= FORMAT_VERSION_2
+}
+
+// fecPending reports whether parity records are due before the next data
+// record, or before the export can finish. The caller must hold rb.mu.
+func (rb *RamExportBundle) fecPending() bool {
+	if len(rb.parityRecords) > 0 {
+		return true
+	}
+	return len(rb.fecRecords) > 0 && (len(rb.fecRecords) >= rb.fecData || rb.bundlesSent >= rb.totalBundles)
+}
+
+// fecState is the part of the exporter's FEC state a failed write rolls back.
+type fecState struct {
+	records    [][]byte
+	groupStart int
+	parity     [][]byte
+}
+
+func (rb *RamExportBundle) saveFECState() fecState {
+	return fecState{rb.fecRecords, rb.fecGroupStart, rb.parityRecords}
+}
+
+func (rb *RamExportBundle) restoreFECState(state fecState) {
+	rb.fecRecords, rb.fecGroupStart, rb.parityRecords = state.records, state.groupStart, state.parity
+}
+
+// addFECRecord keeps a copy of a data record for the parity of its group. The caller must hold rb.mu.
+func (rb *RamExportBundle) addFECRecord(sequence int, record []byte) {
+	if len(rb.fecRecords) == 0 {
+		rb.fecGroupStart = sequence
+	}
+	rb.fecRecords = append(rb.fecRecords, slices.Clone(record))
+}
+
+// nextParityRecord returns the next parity record of the current group, computing
+// them when the group's data records are all sent. The caller must hold rb.mu.
+func (rb *RamExportBundle) nextParityRecord() ([]byte, error) {
+	if len(rb.parityRecords) == 0 {
+		parity, err := encodeParityRecords(rb.bundleID, rb.fecGroupStart, rb.fecRecords, rb.fecParity)
+		if err != nil {
+			return nil, err
+		}
+		rb.parityRecords = parity
+		rb.fecRecords = nil
+	}
+	record := rb.parityRecords[0]
+	rb.parityRecords = rb.parityRecords[1:]
+	return record, nil
+}
+
+// encodeParityRecords builds the parity records for a group of data records.
+func encodeParityRecords(bundleID string, groupStart int, records [][]byte, parityShards int) ([][]byte, error) {
+	enc, err := reedsolomon.New(len(records), parityShards)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating FEC encoder: %v", err)
+	}
+	shardLen := 0
+	for _, record := range records {
+		shardLen = max(shardLen, len(record))
+	}
+	shards := make([][]byte, len(records)+parityShards)
+	for i := range shards {
+		shards[i] = make([]byte, shardLen)
+		if i < len(records) {
+			copy(shards[i], records[i])
+		}
+	}
+	if err := enc.Encode(shards); err != nil {
+		return nil, fmt.Errorf("Error encoding FEC parity: %v", err)
+	}
+
+	parity := make([][]byte, 0, parityShards)
+	for i := 0; i < parityShards; i++ {
+		body := make([]byte, 0, 4*INT32_LEN+len(records)*INT32_LEN+shardLen)
+		body = append(body, IntToBytes(len(records))...)
+		body = append(body, IntToBytes(parityShards)...)
+		body = append(body, IntToBytes(i)...)
+		body = append(body, IntToBytes(shardLen)...)
+		for _, record := range records {
+			body = append(body, IntToBytes(len(record))...)
+		}
+		body = append(body, shards[len(records)+i]...)
+		record, err := EncodeRecord(RecordHeader{
+			Version:    FORMAT_VERSION_2,
+			RecordType: PARITY_HEADER,
+			Flags:      RECORD_FLAG_BODY_CHECKSUM,
+			BundleID:   bundleID,
+			Sequence:   groupStart,
+		}, body)
+		if err != nil {
+			return nil, err
+		}
+		parity = append(parity, record)
+	}
+	return parity, nil
+}
+
+// decodeParityBody splits a parity record body into its group and shard.
+func decodeParityBody(body []byte) (*fecGroup, int, []byte, error) {
+	if len(body) < 4*INT32_LEN {
+		return nil, 0, nil, fmt.Errorf("Parity record too short: %d bytes", len(body))
+	}
+	g := &fecGroup{
+		dataShards:   BytesToInt(body[0:4]),
+		parityShards: BytesToInt(body[4:8]),
+		shardLen:     BytesToInt(body[12:16]),
+		parity:       make(map[int][]byte),
+	}
+	index := BytesToInt(body[8:12])
+	if err := ValidateFEC(g.dataShards, g.parityShards); err != nil || index < 0 || index >= g.parityShards {
+		return nil, 0, nil, fmt.Errorf("Parity record has invalid shards %d+%d, index %d", g.dataShards, g.parityShards, index)
+	}
+	readPos := 4 * INT32_LEN
+	if len(body) != readPos+g.dataShards*INT32_LEN+g.shardLen {
+		return nil, 0, nil, fmt.Errorf("Parity record length is %d bytes, expected %d", len(body), readPos+g.dataShards*INT32_LEN+g.shardLen)
+	}
+	g.lengths = make([]int, g.dataShards)
+	for i := range g.lengths {
+		g.lengths[i] = BytesToInt(body[readPos : readPos+INT32_LEN])
+		if g.lengths[i] < 0 || g.lengths[i] > g.shardLen {
+			return nil, 0, nil, fmt.Errorf("Parity record data length %d exceeds shard length %d", g.lengths[i], g.shardLen)
+		}
+		readPos += INT32_LEN
+	}
+	return g, index, body[readPos:], nil
+}
+
+// fecBundleState returns the FEC state of a bundle, creating it if needed.
+// The caller must hold rb.mu.
+func (rb *RamImportBundle) fecBundleState(bundleID string) *fecBundle {
+	fb, exists := rb.fecBundles[bundleID]
+	if !exists {
+		if len(rb.fecOrder) >= maxFECBundles {
+			delete(rb.fecBundles, rb.fecOrder[0])
+			rb.fecOrder = rb.fecOrder[1:]
+		}
+		fb = &fecBundle{records: make(map[int][]byte), groups: make(map[int]*fecGroup)}
+		rb.fecBundles[bundleID] = fb
+		rb.fecOrder = append(rb.fecOrder, bundleID)
+	}
+	return fb
+}
+
+// dropFECBundle forgets the FEC state of a bundle. The caller must hold rb.mu.
+func (rb *RamImportBundle) dropFECBundle(bundleID string) {
+	if _, exists := rb.fecBundles[bundleID]; !exists {
+		return
+	}
+	delete(rb.fecBundles, bundleID)
+	rb.fecOrder = slices.DeleteFunc(rb.fecOrder, func(id string) bool { return id == bundleID })
+}
+
+// addFECRecord keeps a clean data record covered by parity until its group is
+// finished, and rebuilds its group if that is now possible. The caller must hold rb.mu.
+func (rb *RamImportBundle) addFECRecord(header RecordHeader, record []byte, touched map[string]bool) error {
+	fb := rb.fecBundleState(header.BundleID)
+	seq := ByteRange{Start: int64(header.Sequence), End: int64(header.Sequence) + 1}
+	if rangesContain(fb.done, seq) {
+		return nil
+	}
+	if _, exists := fb.records[header.Sequence]; !exists {
+		fb.records[header.Sequence] = slices.Clone(record)
+	}
+	for start, g := range fb.groups {
+		if header.Sequence >= start && header.Sequence < start+g.dataShards {
+			return rb.rebuildFECGroup(header.BundleID, fb, start, touched)
+		}
+	}
+	return nil
+}
+
+// processParityRecord stores a parity shard and rebuilds its group if that is
+// now possible. The caller must hold rb.mu.
+func (rb *RamImportBundle) processParityRecord(header RecordHeader, body []byte, touched map[string]bool) error {
+	g, index, shard, err := decodeParityBody(body)
+	if err != nil {
+		return fmt.Errorf("Error parsing data. %v", err)
+	}
+	start := header.Sequence
+	group := ByteRange{Start: int64(start), End: int64(start + g.dataShards)}
+	chunks, tracked := rb.bundleChunks[header.BundleID]
+	fb, kept := rb.fecBundles[header.BundleID]
+	if !tracked && !kept {
+		return nil // Parity of a finished bundle
+	}
+	if tracked && rangesContain(chunks.Received, group) {
+		// The group arrived whole, its kept records are no longer needed
+		if kept {
+			rb.finishFECGroup(fb, start, g.dataShards)
+		}
+		return nil
+	}
+	fb = rb.fecBundleState(header.BundleID)
+	if rangesContain(fb.done, ByteRange{Start: int64(start), End: int64(start) + 1}) {
+		return nil // Group already whole
+	}
+	known, exists := fb.groups[start]
+	if !exists {
+		fb.groups[start] = g
+		known = g
+	} else if known.dataShards != g.dataShards || known.parityShards != g.parityShards || known.shardLen != g.shardLen {
+		return fmt.Errorf("Parity record for bundle %s sequence %d does not match its group", header.BundleID, start)
+	}
+	if _, exists := known.parity[index]; !exists {
+		known.parity[index] = slices.Clone(shard)
+	}
+	return rb.rebuildFECGroup(header.BundleID, fb, start, touched)
+}
+
+// rebuildFECGroup finishes a group once all its data records are here, or
+// rebuilds the missing ones from parity once enough shards are. Rebuilt
+// records are applied like received ones. The caller must hold rb.mu.
+func (rb *RamImportBundle) rebuildFECGroup(bundleID string, fb *fecBundle, start int, touched map[string]bool) error {
+	g := fb.groups[start]
+	present := 0
+	for i := 0; i < g.dataShards; i++ {
+		if _, ok := fb.records[start+i]; ok {
+			present++
+		}
+	}
+	if present < g.dataShards && present+len(g.parity) < g.dataShards {
+		return nil // Not enough shards yet
+	}
+
+	var rebuilt [][]byte
+	if present < g.dataShards {
+		shards := make([][]byte, g.dataShards+g.parityShards)
+		for i := 0; i < g.dataShards; i++ {
+			if record, ok := fb.records[start+i]; ok {
+				shards[i] = make([]byte, g.shardLen)
+				copy(shards[i], record)
+			}
+		}
+		for index, shard := range g.parity {
+			shards[g.dataShards+index] = shard
+		}
+		enc, err := reedsolomon.New(g.dataShards, g.parityShards)
+		if err != nil {
+			return fmt.Errorf("Error creating FEC decoder: %v", err)
+		}
+		if err := enc.ReconstructData(shards); err != nil {
+			return fmt.Errorf("Error rebuilding bundle %s sequence %d from parity: %v", bundleID, start, err)
+		}
+		for i := 0; i < g.dataShards; i++ {
+			if _, ok := fb.records[start+i]; !ok {
+				rebuilt = append(rebuilt, shards[i][:g.lengths[i]])
+			}
+		}
+	}
+
+	// Finished before the rebuilt records are applied so they are not kept again
+	rb.finishFECGroup(fb, start, g.dataShards)
+
+	for _, record := range rebuilt {
+		rb.rebuiltRecords++
+		if err := rb.processRecord(record, touched); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishFECGroup forgets the records and parity of a group. The caller must hold rb.mu.
+func (rb *RamImportBundle) finishFECGroup(fb *fecBundle, start int, dataShards int) {
+	fb.done = addRange(fb.done, ByteRange{Start: int64(start), End: int64(start + dataShards)})
+	for i := 0; i < dataShards; i++ {
+		delete(fb.records, start+i)
+	}
+	delete(fb.groups, start)
+}
@@ -0,0 +1,172 @@
+package ramformats
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// exportFEC exports a file with FEC and returns every record produced.
+func exportFEC(t *testing.T, filename string, chunkSize int64, dataShards int, parityShards int) [][]byte {
+	t.Helper()
+	exp := NewRamExportBundle(chunkSize, 10, 10)
+	if err := exp.SetFEC(dataShards, parityShards); err != nil {
+		t.Fatalf("SetFEC failed: %v", err)
+	}
+	rf := NewRamFileFromLocal(filename, filename)
+	if err := exp.PushFile(*rf); err != nil {
+		t.Fatalf("PushFile failed: %v", err)
+	}
+	records := make([][]byte, 0)
+	for {
+		record, err := exp.GetNextExportBundle()
+		if err != nil {
+			t.Fatalf("GetNextExportBundle failed: %v", err)
+		}
+		if record == nil {
+			return records
+		}
+		records = append(records, record)
+	}
+}
+
+func recordTypes(t *testing.T, records [][]byte) []int {
+	t.Helper()
+	types := make([]int, len(records))
+	for i, record := range records {
+		header, _, err := DecodeRecord(record)
+		if err != nil {
+			t.Fatalf("DecodeRecord failed: %v", err)
+		}
+		types[i] = header.RecordType
+	}
+	return types
+}
+
+func TestFEC_ParityLayout(t *testing.T) {
+	filename := "test_data/fec_layout_file.bin"
+	if _, err := createTestFile(filename, 1000); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+
+	// 4 data records in groups of 3, the last group holds just the 4th
+	records := exportFEC(t, filename, 256, 3, 2)
+	want := []int{METADATA_HEADER, DATA_HEADER, DATA_HEADER, DATA_HEADER, PARITY_HEADER, PARITY_HEADER,
+		DATA_HEADER, PARITY_HEADER, PARITY_HEADER}
+	got := recordTypes(t, records)
+	if len(got) != len(want) {
+		t.Fatalf("Record types: got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Record types: got %v, want %v", got, want)
+		}
+	}
+
+	info, err := InspectExportBundle(records[5])
+	if err != nil {
+		t.Fatalf("InspectExportBundle failed on parity: %v", err)
+	}
+	if info.Sequence != 1 || info.Parity.DataShards != 3 || info.Parity.ParityShards != 2 || info.Parity.Index != 1 {
+		t.Errorf("Unexpected parity info: %+v %+v", info.RecordHeader, info.Parity)
+	}
+	maxLen := MaxRecordLen(256, 10, 3)
+	for i, record := range records[1:] {
+		if int64(len(record)) > maxLen {
+			t.Errorf("Record %d is %d bytes, longer than MaxRecordLen %d", i+1, len(record), maxLen)
+		}
+	}
+	header, _, _ := DecodeRecord(records[1])
+	if header.Flags&RECORD_FLAG_FEC == 0 {
+		t.Error("Data record is missing the FEC flag")
+	}
+
+	if err := NewRamExportBundle(256, 10, 10).SetFEC(200, 57); err == nil {
+		t.Error("Expected more than 256 shards to be rejected")
+	}
+}
+
+func TestFEC_RebuildsLostRecords(t *testing.T) {
+	filename := "test_data/fec_rebuild_file.bin"
+	data, err := createTestFile(filename, 2000)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+
+	// Metadata, then 8 data records in groups of 4 each followed by 2 parity records
+	records := exportFEC(t, filename, 256, 4, 2)
+	if len(records) != 13 {
+		t.Fatalf("Expected 13 records, got %d", len(records))
+	}
+	// Lose 2 data records of the first group and 1 data and 1 parity record of the second
+	lost := map[int]bool{2: true, 3: true, 8: true, 11: true}
+
+	imp := NewRamImportBundle(10, t.TempDir())
+	for i, record := range records {
+		if lost[i] {
+			continue
+		}
+		if err := imp.ProcessNextExportBundle(record); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed on record %d: %v", i, err)
+		}
+	}
+	imported := imp.PopFile()
+	if imported == nil {
+		t.Fatalf("File was not rebuilt, missing chunks %v", imp.MissingChunks())
+	}
+	got, err := os.ReadFile(imported.LocalPath)
+	if err != nil {
+		t.Fatalf("Failed to read imported file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Rebuilt file does not match the original")
+	}
+	if imp.RebuiltRecords() != 3 {
+		t.Errorf("Expected 3 rebuilt records, got %d", imp.RebuiltRecords())
+	}
+	if len(imp.MissingChunks()) != 0 || len(imp.fecBundles) != 0 {
+		t.Errorf("Expected no state left, missing %v, FEC bundles %d", imp.MissingChunks(), len(imp.fecBundles))
+	}
+}
+
+func TestFEC_TooManyLost(t *testing.T) {
+	filename := "test_data/fec_lost_file.bin"
+	if _, err := createTestFile(filename, 1000); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+
+	// Metadata, 4 data records, 1 parity record
+	records := exportFEC(t, filename, 256, 4, 1)
+	if len(records) != 6 {
+		t.Fatalf("Expected 6 records, got %d", len(records))
+	}
+	header, _, _ := DecodeRecord(records[0])
+
+	imp := NewRamImportBundle(10, t.TempDir())
+	for i, record := range records {
+		if i == 1 || i == 2 {
+			continue // Two lost, one parity record can only rebuild one
+		}
+		if err := imp.ProcessNextExportBundle(record); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed on record %d: %v", i, err)
+		}
+	}
+	if imp.PopFile() != nil {
+		t.Fatal("File should not be complete")
+	}
+	missing := imp.BundleMissingChunks(header.BundleID)
+	if len(missing) != 2 || missing[0] != 1 || missing[1] != 2 {
+		t.Errorf("Missing chunks: got %v, want [1 2]", missing)
+	}
+
+	// Once one arrives the other is rebuilt
+	if err := imp.ProcessNextExportBundle(records[2]); err != nil {
+		t.Fatalf("ProcessNextExportBundle failed: %v", err)
+	}
+	if imp.PopFile() == nil {
+		t.Errorf("File was not rebuilt, missing chunks %v", imp.MissingChunks())
+	}
+}
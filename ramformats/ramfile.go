@@ -16,7 +16,17 @@ const (
 	DRRecieveStartKey = "receiveStartTimestamp"
 	DRRecieveEndKey   = "receiveEndTimestamp"
 	DRChunkSizeKey    = "chunkSize"
-	DRNumChunks       = "numChunks"
+	DRNumChunks       = "numChunks"     // Number of data chunks in the bundle the file was sent in
+	DRBundleIDKey     = "bundleID"      // Bundle the file was sent in, matches the v2 record headers
+	DRFileHashKey     = "fileHash"      // Hex encoded hash of the whole file
+	DRHashAlgKey      = "hashAlgorithm" // Algorithm used for DRFileHashKey
+)
+
+// Supported whole file hash algorithms
+const (
+	HashAlgSHA256 = "sha256"
+	HashAlgSHA512 = "sha512"
+	HashAlgNone   = "none"
 )
 
 // Should we just give a stream here instead of path?
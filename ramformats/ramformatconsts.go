@@ -6,11 +6,31 @@ var (
 	DATARAM_EXPORT_BUNDLE_HEADER_2 = []byte{0xda, 0x1a, 0xbe, 0x02} // DATA Bundle Export v2 header
 )
 
+// Export bundle wire format versions
+const (
+	FORMAT_VERSION_1       = 1
+	FORMAT_VERSION_2       = 2
+	DEFAULT_FORMAT_VERSION = FORMAT_VERSION_2
+)
+
 // These are converted to ints
 const (
 	METADATA_HEADER = 10
 	DATA_HEADER     = 12
+	PARITY_HEADER   = 16 // Reed-Solomon parity over a group of data records, see ramfec.go
 	UUID_LEN        = 36
 	INT64_LEN       = 8
 	INT32_LEN       = 4
+	CHECKSUM_LEN    = 4
+	V1_HEADER_LEN   = 8  // magic, type
+	V2_HEADER_LEN   = 64 // magic, type, flags, length, bundle ID, sequence, body crc32c, header crc32c
+)
+
+// Flags carried in v2 record headers
+const (
+	RECORD_FLAG_SEGMENT_CHECKSUMS = 1 << 0 // Each data segment has a CRC32C of its header and data after its length
+	RECORD_FLAG_BODY_CHECKSUM     = 1 << 1 // The header body checksum covers the whole body
+	RECORD_FLAG_FINAL             = 1 << 2 // Last record of the bundle
+	RECORD_FLAG_RESEND            = 1 << 3 // Retransmitted ranges, not a chunk of the bundle
+	RECORD_FLAG_FEC               = 1 << 4 // Data record covered by parity records
 )
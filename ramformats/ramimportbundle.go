@@ -1,14 +1,28 @@
 package ramformats
 
 import (
-	"bytes"
+	"data_ram/ramstream"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 )
 
 // Define const header bytes // TODO test this
 
+// ErrChecksumMismatch is returned, wrapped, for each segment whose data does not match its checksum.
+// The segment is not written so its range is reported by MissingRanges until it is resent.
+var ErrChecksumMismatch = errors.New("segment checksum mismatch")
+
+// Files failing whole file hash verification are moved here, under the processing directory
+const quarantineDirName = "quarantine"
+
+// Handed off files whose UUIDs are remembered so late segments and metadata are ignored
+const maxHandedOffUUIDs = 4096
+
 // The purpose of RamBundle is to take chunks of ramexportbundles
 // and piece them back into ramfiles
 
@@ -17,37 +31,78 @@ import (
 // 2. A data block that contains the actual data of the files in the bundle
 // Multiple data blocks may result from a single bundle. Only a single metadata map will be created for each set of bundles.
 
-// State will need to be saved and stored for this class for restarts
+// State is saved per file so reassembly survives restarts, see ramimportstate.go
 
 type RamImportBundle struct {
 	processingDirectory string
 	filePartsQueue      []byte
 	processBundles      map[string]RamFile
 	CompletedFiles      []RamFile
-	bytesWritten        map[string]int64 // Track bytes written to each file
-	metadataApplied     map[string]bool  // Track bytes written to each file
-	maxQueueSize        int              // Maximum size of the queue
-	mu                  sync.Mutex       // Mutex to protect concurrent access
+	QuarantinedFiles    []RamFile                // Files that failed whole file hash verification
+	metadataApplied     map[string]bool          // Track which files have had metadata applied
+	ranges              map[string][]ByteRange   // Byte ranges written to each file
+	completedUUIDs      map[string]bool          // Files already completed, late segments and metadata for these are duplicates
+	handedOff           []string                 // Completed files handed off, oldest first, forgotten beyond maxHandedOffUUIDs
+	bundleChunks        map[string]*bundleChunks // Chunks received of each v2 bundle, see ramimportchunks.go
+	fecBundles          map[string]*fecBundle    // Data and parity records kept to rebuild lost records, see ramfec.go
+	fecOrder            []string                 // Bundles in fecBundles, oldest first
+	duplicateSegments   int64                    // Segments ignored because they were already written
+	badSegments         int64                    // Segments rejected because their checksum did not match
+	rebuiltRecords      int64                    // Data records rebuilt from parity
+	stateDirectory      string                   // Where per file state is persisted
+	dirtyFiles          map[string]bool          // Files whose state changed since the last save, see ramimportstate.go
+	dirtyBundles        map[string]bool          // Bundles whose chunks changed since the last save
+	removedBundles      map[string]bool          // Bundles whose state file is removed at the next save
+	removedFiles        map[string]bool          // Files whose state file is removed at the next save
+	unsavedRecords      int                      // Records processed since the last save
+	saveDue             bool                     // Save as soon as the current record is processed
+	saveTimer           *time.Timer              // Saves changes left waiting, nil when there are none
+	stateMu             sync.Mutex               // Serialises saves, taken before mu
+	writers             *filePool                // Output files kept open between segments
+	preallocate         bool                     // Reserve disk space for each file when it is first written
+	maxQueueSize        int                      // Maximum size of the queue
+	mu                  sync.Mutex               // Mutex to protect concurrent access
 }
 
 func NewRamImportBundle(maxQueueSize int, processingDir string) *RamImportBundle {
-	return &RamImportBundle{
+	rb := &RamImportBundle{
 		processBundles:      make(map[string]RamFile),
-		bytesWritten:        make(map[string]int64),
 		metadataApplied:     make(map[string]bool),
+		ranges:              make(map[string][]ByteRange),
+		completedUUIDs:      make(map[string]bool),
+		bundleChunks:        make(map[string]*bundleChunks),
+		dirtyFiles:          make(map[string]bool),
+		dirtyBundles:        make(map[string]bool),
+		removedBundles:      make(map[string]bool),
+		removedFiles:        make(map[string]bool),
+		fecBundles:          make(map[string]*fecBundle),
 		CompletedFiles:      make([]RamFile, 0),
+		QuarantinedFiles:    make([]RamFile, 0),
 		filePartsQueue:      make([]byte, 0),
 		maxQueueSize:        maxQueueSize,
 		processingDirectory: processingDir,
+		stateDirectory:      filepath.Join(processingDir, importStateDirName),
+		writers:             newFilePool(DEFAULT_MAX_OPEN_FILES),
 	}
+	// Pick up any transfers interrupted by a restart
+	if err := os.MkdirAll(rb.stateDirectory, 0755); err != nil {
+		ramstream.Logf("Error creating import state directory, state will not be saved: %v\n", err)
+		rb.stateDirectory = ""
+	} else {
+		rb.loadState()
+	}
+	return rb
 }
 
 func (rb *RamImportBundle) PopFile() *RamFile {
+	rb.stateMu.Lock()
+	defer rb.stateMu.Unlock()
 	rb.mu.Lock()
 	defer rb.mu.Unlock()
 
 	if len(rb.CompletedFiles) != 0 {
 		rf, _ := PopFront(&rb.CompletedFiles)
+		rb.removeState(rf.UUID)
 		return &rf
 	} else {
 		return nil
@@ -55,29 +110,56 @@ func (rb *RamImportBundle) PopFile() *RamFile {
 }
 
 func (rb *RamImportBundle) ProcessNextExportBundle(dataIn []byte) error {
-	// Verify data has a valid header
-	blockHeader := dataIn[0:4]
-	if !bytes.Equal(blockHeader, DATARAM_EXPORT_BUNDLE_HEADER_1) {
-		return fmt.Errorf("Error parsing data. Unrecognised block header: %d", blockHeader)
+	saveNow, err := rb.processAndMark(dataIn)
+	if saveNow {
+		if saveErr := rb.saveStateIfIdle(); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// processAndMark processes a record and queues the state of every file it
+// touched to be saved, even if parsing fails part way. It reports whether the
+// state should be saved now.
+func (rb *RamImportBundle) processAndMark(dataIn []byte) (bool, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	touched := make(map[string]bool)
+	err := rb.processRecord(dataIn, touched)
+	return rb.markDirty(touched), err
+}
+
+// processRecord applies one record, received or rebuilt from parity, adding the
+// files whose state changed to touched. The caller must hold rb.mu.
+func (rb *RamImportBundle) processRecord(dataIn []byte, touched map[string]bool) error {
+	header, body, err := DecodeRecord(dataIn)
+	if err != nil {
+		return fmt.Errorf("Error parsing data. %w", err)
 	}
 
-	typeHeader := BytesToInt(dataIn[4:8])
-	readPos := 8
-	if typeHeader == METADATA_HEADER {
+	if header.RecordType == METADATA_HEADER {
 		// if it's a metadata bundle
-		metadataHeader, err := BytesToExportMeta(dataIn[8:])
+		metadataHeader, err := BytesToExportMeta(body)
 		if err != nil {
 			return fmt.Errorf("Error parsing ram export meta map, %s", err)
 		}
 
+		applied := 0
 		for k, v := range metadataHeader {
-			fmt.Printf("key[%s] value[%s]\n", k, v)
+			if rb.completedUUIDs[k] {
+				// Resent or replayed metadata for a file already complete
+				continue
+			}
+			applied++
+			ramstream.Logf("key[%s] value[%s]\n", k, v)
 			_, exists := rb.processBundles[k]
 			rb.metadataApplied[k] = true
+			touched[k] = true
 			if !exists {
 				ramFile := *NewRamFileFromMeta(v)
 				// TODO this
-				ramFile.LocalPath = rb.processingDirectory + "/" + k
+				ramFile.LocalPath = filepath.Join(rb.processingDirectory, k)
 				rb.processBundles[k] = ramFile
 			} else {
 				// Already exists from a data packet first, just update metadata
@@ -85,77 +167,266 @@ func (rb *RamImportBundle) ProcessNextExportBundle(dataIn []byte) error {
 					rb.processBundles[k].MetaData[kk] = vv
 				}
 			}
-			fileSize, err := strconv.ParseInt(v[DRFileSizeKey], 10, 64)
-			if err != nil {
+			if _, err := strconv.ParseInt(v[DRFileSizeKey], 10, 64); err != nil {
 				return fmt.Errorf("Error parsing file size for %s: %v", k, err)
 			}
-			if rb.bytesWritten[k] >= fileSize && rb.metadataApplied[k] {
-				// File is complete, add to completed files
-				rb.CompletedFiles = append(rb.CompletedFiles, rb.processBundles[k])
-				delete(rb.processBundles, k) // Remove from process bundles
-			}
-
+			rb.checkComplete(k)
 		}
 		// create RamFiles and add into process bundles
 		// Check to see if they exist first with uuid checks, if they exist just update metadata
+		if applied == 0 && len(metadataHeader) > 0 {
+			// Every file is already complete, the bundle needs nothing more
+			return nil
+		}
+		rb.trackRecord(header, metadataHeader)
 		return nil
 
-	} else if typeHeader == DATA_HEADER {
+	} else if header.RecordType == DATA_HEADER {
 
-		// Need to track number of bytes written to each file
-		// When bytes written to a file is equal to the file size, then the file is complete
-		for {
-			if readPos+UUID_LEN > len(dataIn) {
-				return fmt.Errorf("Error parsing data. Not enough data for UUID")
+		// Track the byte ranges written to each file
+		// When the ranges cover the whole file, then the file is complete
+		segments, err := decodeSegments(body, header.SegmentChecksums())
+		if err != nil {
+			return fmt.Errorf("Error parsing data. %v", err)
+		}
+		// A record only for files already complete, a late retransmission, is not tracked
+		late := true
+		for _, segment := range segments {
+			late = late && rb.completedUUIDs[segment.UUID]
+		}
+		// Segments failing their checksum are skipped so they stay missing, the rest are still written
+		var badSegments []error
+		for _, segment := range segments {
+			if !segment.Valid {
+				rb.badSegments++
+				badSegments = append(badSegments, fmt.Errorf("%w: %s bytes %d-%d", ErrChecksumMismatch,
+					segment.UUID, segment.Start, segment.Start+int64(segment.Length)))
+			} else if err := rb.writeSegment(segment.UUID, segment.FileSize, segment.Start, segment.Data, touched); err != nil {
+				return err
 			}
-			uuid := string(dataIn[readPos : readPos+UUID_LEN])
-			readPos += UUID_LEN
-			ramFile, exists := rb.processBundles[uuid]
-			if !exists {
-				ramFile = *NewRamFileFromUUID(uuid)
-				ramFile.LocalPath = "/tmp/" + uuid
-				rb.processBundles[uuid] = ramFile
+		}
+		if len(badSegments) != 0 {
+			// Leave the chunk missing so it is asked for again
+			return errors.Join(badSegments...)
+		}
+		if late {
+			return nil
+		}
+		if header.Version >= FORMAT_VERSION_2 && header.Flags&RECORD_FLAG_FEC != 0 && header.Flags&RECORD_FLAG_RESEND == 0 {
+			if err := rb.addFECRecord(header, dataIn, touched); err != nil {
+				return err
 			}
+		}
+		rb.trackRecord(header, nil)
+		return nil
+	} else if header.RecordType == PARITY_HEADER {
+		return rb.processParityRecord(header, body, touched)
+	} else {
+		return fmt.Errorf("Error parsing data. Unrecognised type header: %d", header.RecordType)
+	}
+}
 
-			fileSize := BytesToInt64(dataIn[readPos : readPos+INT64_LEN])
-			readPos += INT64_LEN
+// writeSegment writes one file segment to its file in the processing directory.
+// Segments whose bytes have all been written already are counted as duplicates and skipped.
+// The caller must hold rb.mu.
+func (rb *RamImportBundle) writeSegment(uuid string, fileSize int64, start int64, data []byte, touched map[string]bool) error {
+	segment := ByteRange{Start: start, End: start + int64(len(data))}
+	if start < 0 || fileSize <= 0 || segment.End > fileSize {
+		return fmt.Errorf("Error parsing data. Segment %d-%d is outside file %s of size %d", segment.Start, segment.End, uuid, fileSize)
+	}
+	if rb.completedUUIDs[uuid] || rangesContain(rb.ranges[uuid], segment) {
+		rb.duplicateSegments++
+		return nil
+	}
 
-			tmpFile, prepErr := PrepareFile(ramFile.LocalPath, fileSize)
-			if prepErr != nil {
-				return prepErr
-			}
-			defer tmpFile.Close()
+	touched[uuid] = true
+	ramFile, exists := rb.processBundles[uuid]
+	if !exists {
+		ramFile = *NewRamFileFromUUID(uuid)
+		ramFile.LocalPath = filepath.Join(rb.processingDirectory, uuid)
+		// Remember the size until the metadata arrives
+		ramFile.MetaData[DRFileSizeKey] = strconv.FormatInt(fileSize, 10)
+		rb.processBundles[uuid] = ramFile
+	}
 
-			fileWriteStart := BytesToInt64(dataIn[readPos : readPos+INT64_LEN])
-			readPos += INT64_LEN
+	outFile, err := rb.writers.get(ramFile.LocalPath, func(path string) (*os.File, error) {
+		return prepareFile(path, fileSize, rb.preallocate)
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := outFile.WriteAt(data, start); err != nil {
+		return err
+	}
+	rb.ranges[uuid] = addRange(rb.ranges[uuid], segment)
+	rb.checkComplete(uuid)
+	return nil
+}
 
-			bytesLen := BytesToInt(dataIn[readPos : readPos+INT32_LEN])
-			readPos += INT32_LEN
+// checkComplete moves a file to CompletedFiles once its metadata has arrived and
+// every byte of it has been written. The caller must hold rb.mu.
+func (rb *RamImportBundle) checkComplete(uuid string) {
+	ramFile, exists := rb.processBundles[uuid]
+	if !exists || !rb.metadataApplied[uuid] {
+		return
+	}
+	fileSize, err := strconv.ParseInt(ramFile.MetaData[DRFileSizeKey], 10, 64)
+	if err != nil {
+		return
+	}
+	if rangesCovered(rb.ranges[uuid]) < fileSize {
+		return
+	}
+	rb.completedUUIDs[uuid] = true
+	delete(rb.processBundles, uuid) // Remove from process bundles
+	if err := rb.syncFile(ramFile.LocalPath); err != nil {
+		ramstream.Logf("Error syncing completed file %s: %v\n", uuid, err)
+	}
+	if err := verifyFileHash(ramFile); err != nil {
+		rb.quarantineFile(ramFile, err)
+		return
+	}
+	// File is complete, add to completed files
+	rb.CompletedFiles = append(rb.CompletedFiles, ramFile)
+}
 
-			_, seekErr := tmpFile.Seek(fileWriteStart, 0)
-			if seekErr != nil {
-				return seekErr
-			}
-			_, writeErr := tmpFile.Write(dataIn[readPos : readPos+bytesLen])
-			if writeErr != nil {
-				return writeErr
-			}
-			rb.bytesWritten[uuid] += int64(bytesLen)
+// forgetCompleted records that a completed file has been handed off. Its UUID
+// is still remembered so late segments and metadata are ignored, but only for
+// the last maxHandedOffUUIDs files so a long running receiver does not grow
+// without bound. The caller must hold rb.mu.
+func (rb *RamImportBundle) forgetCompleted(uuid string) {
+	if !rb.completedUUIDs[uuid] {
+		return
+	}
+	rb.handedOff = append(rb.handedOff, uuid)
+	if len(rb.handedOff) > maxHandedOffUUIDs {
+		delete(rb.completedUUIDs, rb.handedOff[0])
+		rb.handedOff = rb.handedOff[1:]
+	}
+}
 
-			if rb.bytesWritten[uuid] >= fileSize && rb.metadataApplied[uuid] {
-				// File is complete, add to completed files
-				rb.CompletedFiles = append(rb.CompletedFiles, ramFile)
-				delete(rb.processBundles, uuid) // Remove from process bundles
-			}
+// syncFile flushes a completed file to disk and closes it. The caller must hold rb.mu.
+func (rb *RamImportBundle) syncFile(path string) error {
+	file, err := rb.writers.get(path, func(path string) (*os.File, error) {
+		return os.OpenFile(path, os.O_RDWR, 0)
+	})
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	rb.writers.close(path)
+	return err
+}
 
-			readPos += bytesLen
-			if readPos >= len(dataIn) {
-				return nil
-			}
+// SetPreallocate selects whether disk space for each file is reserved when it
+// is first written, see fallocate_linux.go.
+func (rb *RamImportBundle) SetPreallocate(preallocate bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.preallocate = preallocate
+}
 
-		}
+// Close saves any unsaved state and closes output files still open for partially
+// received files. Importing can continue afterwards, files are reopened as needed.
+func (rb *RamImportBundle) Close() error {
+	err := rb.SaveState()
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.writers.closeAll()
+	return err
+}
+
+// verifyFileHash checks a reassembled file against the hash in its metadata, if it has one.
+func verifyFileHash(ramFile RamFile) error {
+	expected := ramFile.MetaData[DRFileHashKey]
+	if expected == "" {
+		return nil
+	}
+	actual, err := HashFile(ramFile.LocalPath, ramFile.MetaData[DRHashAlgKey])
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("%s hash mismatch: expected %s, got %s", ramFile.MetaData[DRHashAlgKey], expected, actual)
+	}
+	return nil
+}
+
+// quarantineFile moves a file that failed verification out of the processing
+// directory so it is never delivered. The caller must hold rb.mu.
+func (rb *RamImportBundle) quarantineFile(ramFile RamFile, reason error) {
+	ramstream.Logf("Quarantining file %s (%s): %v\n", ramFile.UUID, ramFile.MetaData[DRFileNameKey], reason)
+	quarantineDir := filepath.Join(rb.processingDirectory, quarantineDirName)
+	quarantinePath := filepath.Join(quarantineDir, ramFile.UUID)
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		ramstream.Logf("Error creating quarantine directory: %v\n", err)
+	} else if err := os.Rename(ramFile.LocalPath, quarantinePath); err != nil {
+		ramstream.Logf("Error moving %s to quarantine: %v\n", ramFile.UUID, err)
 	} else {
-		return fmt.Errorf("Error parsing data. Unrecognised type header: %d", typeHeader)
+		ramFile.LocalPath = quarantinePath
+	}
+	rb.QuarantinedFiles = append(rb.QuarantinedFiles, ramFile)
+	rb.queueRemoveState(ramFile.UUID)
+}
+
+// DuplicateSegments returns how many received segments were ignored because
+// their bytes had already been written.
+func (rb *RamImportBundle) DuplicateSegments() int64 {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.duplicateSegments
+}
+
+// BadSegments returns how many received segments were rejected because their
+// checksum did not match their data.
+func (rb *RamImportBundle) BadSegments() int64 {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.badSegments
+}
+
+// RebuiltRecords returns how many lost data records were rebuilt from parity.
+func (rb *RamImportBundle) RebuiltRecords() int64 {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.rebuiltRecords
+}
+
+// MissingRange is a range of a file that has not been received yet.
+type MissingRange struct {
+	UUID string
+	ByteRange
+}
+
+// FileMissingRanges returns the gaps in a file that is still being reassembled.
+func (rb *RamImportBundle) FileMissingRanges(uuid string) []ByteRange {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.fileMissingRanges(uuid)
+}
+
+// MissingRanges returns the gaps in every file that is still being reassembled.
+func (rb *RamImportBundle) MissingRanges() []MissingRange {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	missing := make([]MissingRange, 0)
+	for uuid := range rb.processBundles {
+		for _, gap := range rb.fileMissingRanges(uuid) {
+			missing = append(missing, MissingRange{UUID: uuid, ByteRange: gap})
+		}
+	}
+	return missing
+}
+
+func (rb *RamImportBundle) fileMissingRanges(uuid string) []ByteRange {
+	ramFile, exists := rb.processBundles[uuid]
+	if !exists {
+		return nil
+	}
+	fileSize, err := strconv.ParseInt(ramFile.MetaData[DRFileSizeKey], 10, 64)
+	if err != nil {
+		return nil
 	}
-	// return fmt.Errorf("Unreachable code reached.")
+	return rangeGaps(rb.ranges[uuid], fileSize)
 }
@@ -1,8 +1,13 @@
 package ramformats
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -93,10 +98,332 @@ func TestRamImportBundle_RoundTrip(t *testing.T) {
 		}
 		for j := range importedData {
 			if importedData[j] != originalData[j] {
-				t.Errorf("Data mismatch in file %s at byte %d", importedFile, j)
+				t.Errorf("Data mismatch in file %s at byte %d", importedFile.LocalPath, j)
 				break
 			}
 		}
 		os.Remove(importedFile.LocalPath)
 	}
 }
+
+func TestRamImportBundle_DuplicatesAndGaps(t *testing.T) {
+	filename := "test_data/import_gap_file.bin"
+	original, err := createTestFile(filename, 1000)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+	bundles := exportAll(t, 256, filename)
+	if len(bundles) != 5 {
+		t.Fatalf("Expected 1 metadata and 4 data bundles, got %d", len(bundles))
+	}
+
+	imp := NewRamImportBundle(10, t.TempDir())
+	// Send everything except the second data bundle, with the first data bundle sent twice
+	for _, bundle := range [][]byte{bundles[0], bundles[1], bundles[1], bundles[3], bundles[4]} {
+		if err := imp.ProcessNextExportBundle(bundle); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed: %v", err)
+		}
+	}
+	if imp.PopFile() != nil {
+		t.Fatal("File must not complete while a range is missing")
+	}
+	if imp.DuplicateSegments() != 1 {
+		t.Errorf("Expected 1 duplicate segment, got %d", imp.DuplicateSegments())
+	}
+	missing := imp.MissingRanges()
+	if len(missing) != 1 || missing[0].Start != 256 || missing[0].End != 512 {
+		t.Fatalf("Unexpected missing ranges: %v", missing)
+	}
+	if gaps := imp.FileMissingRanges(missing[0].UUID); len(gaps) != 1 {
+		t.Errorf("Unexpected file missing ranges: %v", gaps)
+	}
+
+	if err := imp.ProcessNextExportBundle(bundles[2]); err != nil {
+		t.Fatalf("ProcessNextExportBundle failed: %v", err)
+	}
+	rf := imp.PopFile()
+	if rf == nil {
+		t.Fatal("File did not complete once the gap was filled")
+	}
+	got, _ := os.ReadFile(rf.LocalPath)
+	if !bytes.Equal(got, original) {
+		t.Error("Imported file does not match original")
+	}
+
+	// Late retransmissions of a completed file are ignored
+	if err := imp.ProcessNextExportBundle(bundles[2]); err != nil {
+		t.Fatalf("ProcessNextExportBundle failed: %v", err)
+	}
+	if imp.DuplicateSegments() != 2 || len(imp.MissingRanges()) != 0 {
+		t.Error("Late segment for a completed file was not treated as a duplicate")
+	}
+	// So is its metadata, which must not start the file over
+	if err := imp.ProcessNextExportBundle(bundles[0]); err != nil {
+		t.Fatalf("ProcessNextExportBundle failed: %v", err)
+	}
+	if len(imp.MissingRanges()) != 0 || len(imp.MissingChunks()) != 0 || imp.PopFile() != nil {
+		t.Errorf("Replayed metadata for a completed file was not ignored: missing ranges %v, chunks %v", imp.MissingRanges(), imp.MissingChunks())
+	}
+}
+
+func TestRamImportBundle_ForgetsOldHandedOffFiles(t *testing.T) {
+	imp := NewRamImportBundle(10, t.TempDir())
+	uuids := make([]string, maxHandedOffUUIDs+1)
+	for i := range uuids {
+		uuids[i] = GenerateUUID()
+		imp.completedUUIDs[uuids[i]] = true
+		imp.forgetCompleted(uuids[i])
+	}
+	if len(imp.completedUUIDs) != maxHandedOffUUIDs || len(imp.handedOff) != maxHandedOffUUIDs {
+		t.Errorf("Expected %d remembered files, got %d", maxHandedOffUUIDs, len(imp.completedUUIDs))
+	}
+	if imp.completedUUIDs[uuids[0]] || !imp.completedUUIDs[uuids[len(uuids)-1]] {
+		t.Error("Expected the oldest handed off file to be forgotten first")
+	}
+}
+
+func TestRamImportBundle_RejectsCorruptSegments(t *testing.T) {
+	filename := "test_data/import_crc_file.bin"
+	original, err := createTestFile(filename, 600)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+	bundles := exportAll(t, 256, filename)
+
+	imp := NewRamImportBundle(10, t.TempDir())
+	if err := imp.ProcessNextExportBundle(bundles[0]); err != nil {
+		t.Fatalf("ProcessNextExportBundle failed: %v", err)
+	}
+	// Flip a bit in the data of the first data bundle
+	corrupt := append([]byte(nil), bundles[1]...)
+	corrupt[len(corrupt)-1] ^= 0x01
+	err = imp.ProcessNextExportBundle(corrupt)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Expected checksum mismatch, got %v", err)
+	}
+	if imp.BadSegments() != 1 {
+		t.Errorf("Expected 1 bad segment, got %d", imp.BadSegments())
+	}
+	for _, bundle := range bundles[2:] {
+		if err := imp.ProcessNextExportBundle(bundle); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed: %v", err)
+		}
+	}
+	missing := imp.MissingRanges()
+	if imp.PopFile() != nil || len(missing) != 1 || missing[0].Start != 0 || missing[0].End != 256 {
+		t.Fatalf("Corrupt segment should be left missing, got %v", missing)
+	}
+
+	if err := imp.ProcessNextExportBundle(bundles[1]); err != nil {
+		t.Fatalf("Resent segment failed: %v", err)
+	}
+	rf := imp.PopFile()
+	if rf == nil {
+		t.Fatal("File did not complete after the corrupt segment was resent")
+	}
+	got, _ := os.ReadFile(rf.LocalPath)
+	if !bytes.Equal(got, original) {
+		t.Error("Imported file does not match original")
+	}
+}
+
+func TestRamImportBundle_AcceptsUnchecksummedData(t *testing.T) {
+	uuid := GenerateUUID()
+	data := []byte("legacy data record")
+	meta := map[string]map[string]string{uuid: {DRUUIDKey: uuid, DRFileNameKey: "legacy.txt", DRFileSizeKey: fmt.Sprintf("%d", len(data))}}
+	metaBytes, _ := ExportMetaToBytes(meta)
+	metaBundle := append(append(append([]byte{}, DATARAM_EXPORT_BUNDLE_HEADER_1...), IntToBytes(METADATA_HEADER)...), metaBytes...)
+
+	dataBundle := append(append([]byte{}, DATARAM_EXPORT_BUNDLE_HEADER_1...), IntToBytes(DATA_HEADER)...)
+	dataBundle = append(dataBundle, []byte(uuid)...)
+	dataBundle = append(dataBundle, Int64ToBytes(int64(len(data)))...)
+	dataBundle = append(dataBundle, Int64ToBytes(0)...)
+	dataBundle = append(dataBundle, IntToBytes(len(data))...)
+	dataBundle = append(dataBundle, data...)
+
+	imp := NewRamImportBundle(10, t.TempDir())
+	for _, bundle := range [][]byte{metaBundle, dataBundle} {
+		if err := imp.ProcessNextExportBundle(bundle); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed: %v", err)
+		}
+	}
+	rf := imp.PopFile()
+	if rf == nil {
+		t.Fatal("Legacy data record did not complete the file")
+	}
+	got, _ := os.ReadFile(rf.LocalPath)
+	if !bytes.Equal(got, data) {
+		t.Errorf("Imported data mismatch: got %q", got)
+	}
+}
+
+func TestRamImportBundle_VerifiesFileHash(t *testing.T) {
+	filename := "test_data/import_hash_file.bin"
+	if _, err := createTestFile(filename, 800); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+	bundles := exportAll(t, 256, filename)
+
+	header, body, err := DecodeRecord(bundles[0])
+	if err != nil {
+		t.Fatalf("Failed to decode metadata record: %v", err)
+	}
+	meta, err := BytesToExportMeta(body)
+	if err != nil {
+		t.Fatalf("Failed to parse metadata: %v", err)
+	}
+	for _, fileMeta := range meta {
+		if fileMeta[DRHashAlgKey] != HashAlgSHA256 || len(fileMeta[DRFileHashKey]) != 64 {
+			t.Fatalf("Metadata is missing the sha256 file hash: %v", fileMeta)
+		}
+		// Tamper with the expected hash so verification fails
+		fileMeta[DRFileHashKey] = strings.Repeat("0", 64)
+	}
+	metaBytes, _ := ExportMetaToBytes(meta)
+	if bundles[0], err = EncodeRecord(header, metaBytes); err != nil {
+		t.Fatalf("Failed to encode metadata record: %v", err)
+	}
+
+	processingDir := t.TempDir()
+	imp := NewRamImportBundle(10, processingDir)
+	for _, bundle := range bundles {
+		if err := imp.ProcessNextExportBundle(bundle); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed: %v", err)
+		}
+	}
+	if imp.PopFile() != nil {
+		t.Fatal("File with a hash mismatch must not be completed")
+	}
+	if len(imp.QuarantinedFiles) != 1 {
+		t.Fatalf("Expected 1 quarantined file, got %d", len(imp.QuarantinedFiles))
+	}
+	quarantined := imp.QuarantinedFiles[0]
+	if filepath.Dir(quarantined.LocalPath) != filepath.Join(processingDir, quarantineDirName) {
+		t.Errorf("Quarantined file was not moved to quarantine: %s", quarantined.LocalPath)
+	}
+	if _, err := os.Stat(quarantined.LocalPath); err != nil {
+		t.Errorf("Quarantined file missing: %v", err)
+	}
+}
+
+func TestRamExportBundle_SetHashAlgorithm(t *testing.T) {
+	exp := NewRamExportBundle(256, 10, 10)
+	if err := exp.SetHashAlgorithm("md5"); err == nil {
+		t.Error("Expected error for unsupported hash algorithm")
+	}
+	if err := exp.SetHashAlgorithm(HashAlgSHA512); err != nil {
+		t.Errorf("SetHashAlgorithm(sha512) failed: %v", err)
+	}
+	if err := exp.SetHashAlgorithm(HashAlgNone); err != nil {
+		t.Errorf("SetHashAlgorithm(none) failed: %v", err)
+	}
+
+	filename := "test_data/export_nohash_file.bin"
+	if _, err := createTestFile(filename, 100); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+	exp.PushFile(*NewRamFileFromLocal(filename, filename))
+	bundle, err := exp.GetNextExportBundle()
+	if err != nil {
+		t.Fatalf("GetNextExportBundle failed: %v", err)
+	}
+	_, body, _ := DecodeRecord(bundle)
+	meta, _ := BytesToExportMeta(body)
+	for _, fileMeta := range meta {
+		if _, exists := fileMeta[DRFileHashKey]; exists {
+			t.Error("File hash should not be sent when hashing is disabled")
+		}
+	}
+}
+
+func TestRamImportBundle_CachesOutputFiles(t *testing.T) {
+	fileCount := 3
+	files := make([]string, fileCount)
+	originals := make(map[string][]byte)
+	exp := NewRamExportBundle(128, 1, 10)
+	for i := range files {
+		files[i] = fmt.Sprintf("test_data/import_cache_file_%d.bin", i)
+		data, err := createTestFile(files[i], 1000)
+		if err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		defer os.Remove(files[i])
+		rf := NewRamFileFromLocal(files[i], files[i])
+		originals[rf.UUID] = data
+		exp.PushFile(*rf)
+	}
+
+	imp := NewRamImportBundle(10, t.TempDir())
+	imp.SetPreallocate(true)
+	records := 0
+	for {
+		bundle, err := exp.GetNextExportBundle()
+		if err != nil {
+			t.Fatalf("GetNextExportBundle failed: %v", err)
+		}
+		if bundle == nil {
+			break
+		}
+		if err := imp.ProcessNextExportBundle(bundle); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed: %v", err)
+		}
+		records++
+		if records == 3 && imp.writers.len() != 1 {
+			t.Errorf("Expected the partial file to stay open, %d open", imp.writers.len())
+		}
+	}
+	if imp.writers.len() != 0 {
+		t.Errorf("Completed files should be closed, %d still open", imp.writers.len())
+	}
+	for i := 0; i < fileCount; i++ {
+		rf := imp.PopFile()
+		if rf == nil {
+			t.Fatalf("Expected %d files, got %d", fileCount, i)
+		}
+		got, _ := os.ReadFile(rf.LocalPath)
+		if !bytes.Equal(got, originals[rf.UUID]) {
+			t.Errorf("File %s does not match original", rf.UUID)
+		}
+	}
+}
+
+// UUIDs from the peer name files, so paths in their place are refused
+func TestRamImportBundle_RejectsPathUUIDs(t *testing.T) {
+	parent := t.TempDir()
+	processingDir := filepath.Join(parent, "processing")
+	imp := NewRamImportBundle(10, processingDir)
+	escape := "../escaped-aaaaaaaaaaaaaaaaaaaaaaaaa" // UUID_LEN characters
+
+	body, err := appendSegment(nil, escape, 4, 0, []byte("evil"), false)
+	if err != nil {
+		t.Fatalf("appendSegment failed: %v", err)
+	}
+	record, err := EncodeRecord(RecordHeader{Version: FORMAT_VERSION_1, RecordType: DATA_HEADER}, body)
+	if err != nil {
+		t.Fatalf("EncodeRecord failed: %v", err)
+	}
+	if err := imp.ProcessNextExportBundle(record); err == nil {
+		t.Error("Expected a segment with a path for its UUID to be refused")
+	}
+
+	meta, _ := json.Marshal(map[string]map[string]string{escape: {DRFileSizeKey: "4"}})
+	record, err = EncodeRecord(RecordHeader{Version: FORMAT_VERSION_1, RecordType: METADATA_HEADER}, meta)
+	if err != nil {
+		t.Fatalf("EncodeRecord failed: %v", err)
+	}
+	if err := imp.ProcessNextExportBundle(record); err == nil {
+		t.Error("Expected metadata with a path for its UUID to be refused")
+	}
+	imp.Close()
+
+	if _, err := os.Stat(filepath.Join(parent, "escaped-aaaaaaaaaaaaaaaaaaaaaaaaa")); !os.IsNotExist(err) {
+		t.Errorf("A file was written outside the processing directory: %v", err)
+	}
+	if err := ValidateUUID(GenerateUUID()); err != nil {
+		t.Errorf("A generated UUID was refused: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package ramformats
+
+import (
+	"strconv"
+)
+
+// Chunk tracking
+// v2 records carry the ID of the bundle they belong to and their sequence
+// number within it. The metadata record is chunk 0 and data records are chunks
+// 1 to numChunks. The receiver records which chunks of each bundle it has
+// received so a chunk that never arrived can be told apart from one that is
+// still in flight: anything below the highest chunk seen, or below the chunk
+// count once the metadata or the final record has arrived, is missing.
+// v1 records have no bundle ID, gaps in those are only visible through
+// MissingRanges.
+
+type bundleChunks struct {
+	NumChunks int         `json:"numChunks"` // Number of data chunks, 0 until known
+	Received  []ByteRange `json:"received"`  // Chunk indices received
+	Files     []string    `json:"files"`     // UUIDs of the files in the bundle, from its metadata
+}
+
+// markChunk records a chunk of a bundle as received and reports whether every
+// chunk of the bundle has now arrived. The caller must hold rb.mu.
+func (rb *RamImportBundle) markChunk(bundleID string, index int, numChunks int) bool {
+	chunks, exists := rb.bundleChunks[bundleID]
+	if !exists {
+		chunks = &bundleChunks{}
+		rb.bundleChunks[bundleID] = chunks
+	}
+	if numChunks > 0 {
+		chunks.NumChunks = numChunks
+	}
+	chunks.Received = addRange(chunks.Received, ByteRange{Start: int64(index), End: int64(index) + 1})
+	return chunks.NumChunks > 0 && rangesCovered(chunks.Received) == int64(chunks.NumChunks)+1
+}
+
+// trackRecord updates chunk tracking for a v2 record that was fully applied.
+// The caller must hold rb.mu.
+func (rb *RamImportBundle) trackRecord(header RecordHeader, meta map[string]map[string]string) {
+	if header.Version < FORMAT_VERSION_2 {
+		return
+	}
+	// Metadata, even when resent, names the bundle each file was first sent in
+	for uuid, fileMeta := range meta {
+		if bundleID := fileMeta[DRBundleIDKey]; ValidateUUID(bundleID) == nil {
+			rb.addBundleFile(bundleID, uuid)
+		}
+	}
+	if header.Flags&RECORD_FLAG_RESEND != 0 {
+		// Resent ranges are not chunks, but they may have completed a bundle's files
+		rb.pruneBundles()
+		return
+	}
+	numChunks := 0
+	if header.RecordType == METADATA_HEADER {
+		for _, fileMeta := range meta {
+			if n, err := strconv.Atoi(fileMeta[DRNumChunks]); err == nil && n > 0 {
+				numChunks = n
+				break
+			}
+		}
+	} else if header.Flags&RECORD_FLAG_FINAL != 0 {
+		numChunks = header.Sequence
+	}
+	if rb.markChunk(header.BundleID, header.Sequence, numChunks) {
+		// Every chunk is here, nothing left to ask for or rebuild
+		delete(rb.bundleChunks, header.BundleID)
+		rb.dropFECBundle(header.BundleID)
+		rb.removeBundleState(header.BundleID)
+		return
+	}
+	rb.markBundleDirty(header.BundleID)
+}
+
+// addBundleFile records that a file belongs to a bundle. The caller must hold rb.mu.
+func (rb *RamImportBundle) addBundleFile(bundleID string, uuid string) {
+	chunks, exists := rb.bundleChunks[bundleID]
+	if !exists {
+		chunks = &bundleChunks{}
+		rb.bundleChunks[bundleID] = chunks
+	}
+	for _, known := range chunks.Files {
+		if known == uuid {
+			return
+		}
+	}
+	chunks.Files = append(chunks.Files, uuid)
+}
+
+// pruneBundles stops tracking bundles whose files have all completed, their
+// remaining chunks are no longer needed. The caller must hold rb.mu.
+func (rb *RamImportBundle) pruneBundles() {
+	for bundleID, chunks := range rb.bundleChunks {
+		if len(chunks.Files) == 0 {
+			continue
+		}
+		complete := true
+		for _, uuid := range chunks.Files {
+			complete = complete && rb.completedUUIDs[uuid]
+		}
+		if complete {
+			delete(rb.bundleChunks, bundleID)
+			rb.dropFECBundle(bundleID)
+			rb.removeBundleState(bundleID)
+		}
+	}
+}
+
+// MissingChunks returns, for each bundle that is still arriving, the chunk
+// indices that have not been received. Chunk 0 is the metadata record.
+func (rb *RamImportBundle) MissingChunks() map[string][]int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	missing := make(map[string][]int)
+	for bundleID := range rb.bundleChunks {
+		if gaps := rb.bundleMissingChunks(bundleID); len(gaps) > 0 {
+			missing[bundleID] = gaps
+		}
+	}
+	return missing
+}
+
+// BundleMissingChunks returns the chunk indices of one bundle that have not been received.
+func (rb *RamImportBundle) BundleMissingChunks(bundleID string) []int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.bundleMissingChunks(bundleID)
+}
+
+func (rb *RamImportBundle) bundleMissingChunks(bundleID string) []int {
+	chunks, exists := rb.bundleChunks[bundleID]
+	if !exists || len(chunks.Received) == 0 {
+		return nil
+	}
+	// Until the chunk count is known only gaps below the highest chunk seen are missing
+	limit := chunks.Received[len(chunks.Received)-1].End
+	if chunks.NumChunks > 0 {
+		limit = int64(chunks.NumChunks) + 1
+	}
+	missing := make([]int, 0)
+	for _, gap := range rangeGaps(chunks.Received, limit) {
+		for index := gap.Start; index < gap.End; index++ {
+			missing = append(missing, int(index))
+		}
+	}
+	return missing
+}
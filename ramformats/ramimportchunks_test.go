@@ -0,0 +1,94 @@
+package ramformats
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRamImportBundle_MissingChunks(t *testing.T) {
+	filename := "test_data/import_chunks_file.bin"
+	if _, err := createTestFile(filename, 1000); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+	// Metadata then 4 data chunks
+	bundles := exportAll(t, 256, filename)
+	if len(bundles) != 5 {
+		t.Fatalf("Expected 5 records, got %d", len(bundles))
+	}
+	header, _, err := DecodeRecord(bundles[0])
+	if err != nil {
+		t.Fatalf("DecodeRecord failed: %v", err)
+	}
+	bundleID := header.BundleID
+
+	processingDir := t.TempDir()
+	imp := NewRamImportBundle(10, processingDir)
+	expectMissing := func(want []int) {
+		t.Helper()
+		got := imp.MissingChunks()[bundleID]
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Missing chunks: got %v, want %v", got, want)
+		}
+	}
+	process := func(bundle []byte) {
+		t.Helper()
+		if err := imp.ProcessNextExportBundle(bundle); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed: %v", err)
+		}
+	}
+
+	// Chunk count is unknown so only gaps below chunk 3 are missing
+	process(bundles[1])
+	process(bundles[3])
+	expectMissing([]int{0, 2})
+
+	// The metadata gives the chunk count
+	process(bundles[0])
+	expectMissing([]int{2, 4})
+
+	corrupt := append([]byte(nil), bundles[4]...)
+	corrupt[len(corrupt)-1] ^= 0x01
+	if err := imp.ProcessNextExportBundle(corrupt); err == nil {
+		t.Fatal("Expected checksum mismatch")
+	}
+	expectMissing([]int{2, 4})
+	process(bundles[4])
+	expectMissing([]int{2})
+
+	// Chunk tracking survives a restart once saved
+	if err := imp.SaveState(); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	imp = NewRamImportBundle(10, processingDir)
+	if got := imp.BundleMissingChunks(bundleID); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("Missing chunks after restart: got %v, want [2]", got)
+	}
+	process(bundles[2])
+	if len(imp.MissingChunks()) != 0 {
+		t.Errorf("Expected no missing chunks, got %v", imp.MissingChunks())
+	}
+	if imp.PopFile() == nil {
+		t.Error("File did not complete")
+	}
+}
+
+func TestRamImportBundle_MissingChunksFinalFlag(t *testing.T) {
+	filename := "test_data/import_chunks_final_file.bin"
+	if _, err := createTestFile(filename, 600); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+	bundles := exportAll(t, 256, filename)
+	header, _, _ := DecodeRecord(bundles[0])
+
+	// Only the final record arrives, everything before it is missing
+	imp := NewRamImportBundle(10, t.TempDir())
+	if err := imp.ProcessNextExportBundle(bundles[3]); err != nil {
+		t.Fatalf("ProcessNextExportBundle failed: %v", err)
+	}
+	if got := imp.BundleMissingChunks(header.BundleID); !reflect.DeepEqual(got, []int{0, 1, 2}) {
+		t.Errorf("Missing chunks: got %v, want [0 1 2]", got)
+	}
+}
@@ -0,0 +1,364 @@
+package ramformats
+
+import (
+	"data_ram/ramstream"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Import state
+// Each file being reassembled has a small JSON state file in
+// <processingDirectory>/.state holding its metadata and the byte ranges written
+// so far. NewRamImportBundle reloads these so a restarted receiver can finish
+// interrupted transfers when the remaining chunks arrive. A state file is
+// removed once its completed file has been popped.
+//
+// Saving after every record would hold the receive path to the speed of the
+// disk, so changes are collected and saved in batches, see SaveState. A crash
+// loses at most the last batch, whose ranges are asked for again. Files are
+// synced before the ranges covering them are saved.
+
+const importStateDirName = ".state"
+
+// How often changed state is saved
+const (
+	STATE_SAVE_RECORDS  = 256         // Records processed between saves
+	STATE_SAVE_INTERVAL = time.Second // Longest a change waits to be saved
+)
+
+// Chunk tracking for v2 bundles is kept in a sub directory of the state directory
+const bundleStateDirName = "bundles"
+
+type importFileState struct {
+	File            RamFile     `json:"file"`
+	Ranges          []ByteRange `json:"ranges"`
+	MetadataApplied bool        `json:"metadataApplied"`
+	Completed       bool        `json:"completed"`
+}
+
+func (rb *RamImportBundle) stateFilePath(uuid string) string {
+	return filepath.Join(rb.stateDirectory, uuid+".json")
+}
+
+// loadState restores every file state found in the state directory.
+// Unreadable state files are reported and skipped.
+func (rb *RamImportBundle) loadState() {
+	entries, err := os.ReadDir(rb.stateDirectory)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ramstream.Logf("Error reading import state directory: %v\n", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(rb.stateDirectory, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			ramstream.Logf("Error reading import state %s: %v\n", path, err)
+			continue
+		}
+		var state importFileState
+		if err := json.Unmarshal(data, &state); err != nil || ValidateUUID(state.File.UUID) != nil {
+			ramstream.Logf("Skipping invalid import state %s: %v\n", path, err)
+			continue
+		}
+		uuid := state.File.UUID
+		if state.File.MetaData == nil {
+			state.File.MetaData = make(map[string]string)
+		}
+		rb.ranges[uuid] = state.Ranges
+		rb.metadataApplied[uuid] = state.MetadataApplied
+		if state.Completed {
+			rb.CompletedFiles = append(rb.CompletedFiles, state.File)
+			rb.completedUUIDs[uuid] = true
+		} else {
+			rb.processBundles[uuid] = state.File
+		}
+	}
+	rb.loadBundleState()
+}
+
+func (rb *RamImportBundle) bundleStatePath(bundleID string) string {
+	return filepath.Join(rb.stateDirectory, bundleStateDirName, bundleID+".json")
+}
+
+// loadBundleState restores the chunks received for each bundle.
+func (rb *RamImportBundle) loadBundleState() {
+	bundleDir := filepath.Join(rb.stateDirectory, bundleStateDirName)
+	entries, err := os.ReadDir(bundleDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ramstream.Logf("Error reading bundle state directory: %v\n", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		bundleID := strings.TrimSuffix(entry.Name(), ".json")
+		if ValidateUUID(bundleID) != nil || bundleID == entry.Name() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(bundleDir, entry.Name()))
+		if err != nil {
+			ramstream.Logf("Error reading bundle state %s: %v\n", bundleID, err)
+			continue
+		}
+		chunks := &bundleChunks{}
+		if err := json.Unmarshal(data, chunks); err != nil {
+			ramstream.Logf("Skipping invalid bundle state %s: %v\n", bundleID, err)
+			continue
+		}
+		rb.bundleChunks[bundleID] = chunks
+	}
+}
+
+// markBundleDirty queues a bundle's chunks to be saved. Failures to save are
+// only reported, the chunks will be asked for again after a restart. The caller must hold rb.mu.
+func (rb *RamImportBundle) markBundleDirty(bundleID string) {
+	if rb.stateDirectory == "" {
+		return
+	}
+	rb.dirtyBundles[bundleID] = true
+	delete(rb.removedBundles, bundleID)
+}
+
+// removeBundleState queues a bundle's state file for removal. The caller must hold rb.mu.
+func (rb *RamImportBundle) removeBundleState(bundleID string) {
+	if rb.stateDirectory == "" {
+		return
+	}
+	delete(rb.dirtyBundles, bundleID)
+	rb.removedBundles[bundleID] = true
+}
+
+// markDirty queues the state of each uuid in touched to be saved, and reports
+// whether enough has changed that it should be saved now rather than by the
+// timer. The caller must hold rb.mu.
+func (rb *RamImportBundle) markDirty(touched map[string]bool) bool {
+	if rb.stateDirectory == "" {
+		return false
+	}
+	for uuid := range touched {
+		rb.dirtyFiles[uuid] = true
+		if rb.completedUUIDs[uuid] {
+			// Completions are rare and worth not losing
+			rb.saveDue = true
+		}
+	}
+	rb.unsavedRecords++
+	if rb.saveTimer == nil && (len(rb.dirtyFiles) > 0 || len(rb.dirtyBundles) > 0 || len(rb.removedBundles) > 0 || len(rb.removedFiles) > 0) {
+		rb.saveTimer = time.AfterFunc(STATE_SAVE_INTERVAL, func() {
+			if err := rb.SaveState(); err != nil {
+				ramstream.Logf("Error saving import state: %v\n", err)
+			}
+		})
+	}
+	return rb.saveDue || rb.unsavedRecords >= STATE_SAVE_RECORDS
+}
+
+// importStateWrites is a snapshot of the state to save, taken under rb.mu and
+// written without it.
+type importStateWrites struct {
+	dataPaths     []string          // Files to sync before the ranges covering them are saved
+	files         map[string][]byte // Encoded file states by uuid
+	bundles       map[string][]byte // Encoded bundle chunks by bundle ID
+	removeBundles []string
+	removeFiles   []string
+}
+
+// SaveState writes every file and bundle state that changed since the last save.
+// State is otherwise saved every STATE_SAVE_RECORDS records, STATE_SAVE_INTERVAL
+// after a change, when a file completes and on Close.
+func (rb *RamImportBundle) SaveState() error {
+	rb.stateMu.Lock()
+	defer rb.stateMu.Unlock()
+	return rb.writeState()
+}
+
+// saveStateIfIdle saves unless a save is already running, which will be followed
+// by another once the timer fires.
+func (rb *RamImportBundle) saveStateIfIdle() error {
+	if !rb.stateMu.TryLock() {
+		return nil
+	}
+	defer rb.stateMu.Unlock()
+	return rb.writeState()
+}
+
+// writeState takes a snapshot of the changed state under rb.mu, then writes it
+// without holding rb.mu so records keep being processed. The caller must hold rb.stateMu.
+func (rb *RamImportBundle) writeState() error {
+	writes, err := rb.snapshotState()
+	if err != nil || writes == nil {
+		return err
+	}
+	// Data first, so the saved ranges never claim bytes that are not on disk
+	var errs []error
+	for _, path := range writes.dataPaths {
+		if err := syncPath(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("Error syncing %s: %v", path, err))
+		}
+	}
+	if len(errs) == 0 {
+		for uuid, data := range writes.files {
+			if err := WriteFileAtomic(rb.stateFilePath(uuid), data); err != nil {
+				errs = append(errs, fmt.Errorf("Error saving import state for %s: %v", uuid, err))
+				rb.remarkDirty(uuid, "")
+			}
+		}
+	} else {
+		for uuid := range writes.files {
+			rb.remarkDirty(uuid, "")
+		}
+	}
+	if len(writes.bundles) > 0 {
+		if err := os.MkdirAll(filepath.Join(rb.stateDirectory, bundleStateDirName), 0755); err != nil {
+			errs = append(errs, fmt.Errorf("Error creating bundle state directory: %v", err))
+		}
+	}
+	for bundleID, data := range writes.bundles {
+		if err := WriteFileAtomic(rb.bundleStatePath(bundleID), data); err != nil {
+			errs = append(errs, fmt.Errorf("Error saving bundle state for %s: %v", bundleID, err))
+			rb.remarkDirty("", bundleID)
+		}
+	}
+	for _, uuid := range writes.removeFiles {
+		if err := os.Remove(rb.stateFilePath(uuid)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("Error removing import state for %s: %v", uuid, err))
+		}
+	}
+	for _, bundleID := range writes.removeBundles {
+		if err := os.Remove(rb.bundleStatePath(bundleID)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("Error removing bundle state for %s: %v", bundleID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// snapshotState encodes the changed state and clears it, nil when nothing changed.
+func (rb *RamImportBundle) snapshotState() (*importStateWrites, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.saveTimer != nil {
+		rb.saveTimer.Stop()
+		rb.saveTimer = nil
+	}
+	rb.unsavedRecords = 0
+	rb.saveDue = false
+	if len(rb.dirtyFiles) == 0 && len(rb.dirtyBundles) == 0 && len(rb.removedBundles) == 0 && len(rb.removedFiles) == 0 {
+		return nil, nil
+	}
+
+	writes := &importStateWrites{files: make(map[string][]byte), bundles: make(map[string][]byte)}
+	for uuid := range rb.dirtyFiles {
+		state := importFileState{
+			Ranges:          rb.ranges[uuid],
+			MetadataApplied: rb.metadataApplied[uuid],
+		}
+		if rf, exists := rb.processBundles[uuid]; exists {
+			state.File = rf
+			writes.dataPaths = append(writes.dataPaths, rf.LocalPath)
+		} else if rf, found := rb.findCompleted(uuid); found {
+			// Synced when it completed
+			state.File = rf
+			state.Completed = true
+		} else {
+			continue
+		}
+		data, err := json.Marshal(state)
+		if err != nil {
+			return nil, fmt.Errorf("Error encoding import state for %s: %v", uuid, err)
+		}
+		writes.files[uuid] = data
+	}
+	for bundleID := range rb.dirtyBundles {
+		chunks, exists := rb.bundleChunks[bundleID]
+		if !exists {
+			continue
+		}
+		data, err := json.Marshal(chunks)
+		if err != nil {
+			return nil, fmt.Errorf("Error encoding bundle state for %s: %v", bundleID, err)
+		}
+		writes.bundles[bundleID] = data
+	}
+	for bundleID := range rb.removedBundles {
+		writes.removeBundles = append(writes.removeBundles, bundleID)
+	}
+	for uuid := range rb.removedFiles {
+		writes.removeFiles = append(writes.removeFiles, uuid)
+	}
+	clear(rb.dirtyFiles)
+	clear(rb.dirtyBundles)
+	clear(rb.removedBundles)
+	clear(rb.removedFiles)
+	return writes, nil
+}
+
+// remarkDirty queues state that failed to save for the next save.
+func (rb *RamImportBundle) remarkDirty(uuid string, bundleID string) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if uuid != "" {
+		rb.dirtyFiles[uuid] = true
+	}
+	if bundleID != "" {
+		rb.dirtyBundles[bundleID] = true
+	}
+}
+
+// syncPath flushes a file's data to disk.
+func syncPath(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func (rb *RamImportBundle) findCompleted(uuid string) (RamFile, bool) {
+	for _, rf := range rb.CompletedFiles {
+		if rf.UUID == uuid {
+			return rf, true
+		}
+	}
+	return RamFile{}, false
+}
+
+// removeState forgets a file once it has been handed off. The caller must hold
+// rb.stateMu, so a save in progress cannot write the state back, and rb.mu.
+func (rb *RamImportBundle) removeState(uuid string) {
+	rb.forgetCompleted(uuid)
+	delete(rb.ranges, uuid)
+	delete(rb.metadataApplied, uuid)
+	delete(rb.dirtyFiles, uuid)
+	delete(rb.removedFiles, uuid)
+	if rb.stateDirectory == "" {
+		return
+	}
+	if err := os.Remove(rb.stateFilePath(uuid)); err != nil && !os.IsNotExist(err) {
+		ramstream.Logf("Error removing import state for %s: %v\n", uuid, err)
+	}
+}
+
+// queueRemoveState forgets a file, removing its state file at the next save.
+// The caller must hold rb.mu.
+func (rb *RamImportBundle) queueRemoveState(uuid string) {
+	rb.forgetCompleted(uuid)
+	delete(rb.ranges, uuid)
+	delete(rb.metadataApplied, uuid)
+	delete(rb.dirtyFiles, uuid)
+	if rb.stateDirectory == "" {
+		return
+	}
+	rb.removedFiles[uuid] = true
+	rb.saveDue = true
+}
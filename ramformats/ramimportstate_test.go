@@ -0,0 +1,151 @@
+package ramformats
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// exportAll pushes the files through a new export bundle and returns every bundle produced.
+func exportAll(t *testing.T, chunkSize int64, files ...string) [][]byte {
+	exp := NewRamExportBundle(chunkSize, 10, 10)
+	for _, file := range files {
+		rf := NewRamFileFromLocal(file, file)
+		if rf == nil {
+			t.Fatalf("Failed to create RamFile for %s", file)
+		}
+		if err := exp.PushFile(*rf); err != nil {
+			t.Fatalf("PushFile failed: %v", err)
+		}
+	}
+	bundles := make([][]byte, 0)
+	for {
+		bundle, err := exp.GetNextExportBundle()
+		if err != nil {
+			t.Fatalf("GetNextExportBundle failed: %v", err)
+		}
+		if bundle == nil {
+			return bundles
+		}
+		bundles = append(bundles, bundle)
+	}
+}
+
+func TestRamImportBundle_ResumeAfterRestart(t *testing.T) {
+	filename := "test_data/import_state_file.bin"
+	original, err := createTestFile(filename, 2000)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+	bundles := exportAll(t, 256, filename)
+	processingDir := t.TempDir()
+
+	// Receive the metadata and half the data, then "crash"
+	half := len(bundles) / 2
+	first := NewRamImportBundle(10, processingDir)
+	for _, bundle := range bundles[:half] {
+		if err := first.ProcessNextExportBundle(bundle); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed: %v", err)
+		}
+	}
+	if first.PopFile() != nil {
+		t.Fatal("File should not be complete yet")
+	}
+	// State is saved in batches, crash after one has been written
+	if err := first.SaveState(); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	restarted := NewRamImportBundle(10, processingDir)
+	for _, bundle := range bundles[half:] {
+		if err := restarted.ProcessNextExportBundle(bundle); err != nil {
+			t.Fatalf("ProcessNextExportBundle after restart failed: %v", err)
+		}
+	}
+	rf := restarted.PopFile()
+	if rf == nil {
+		t.Fatal("File did not complete after restart")
+	}
+	got, err := os.ReadFile(rf.LocalPath)
+	if err != nil {
+		t.Fatalf("Failed to read imported file: %v", err)
+	}
+	if !bytes.Equal(got, original) {
+		t.Error("Imported file does not match original")
+	}
+	if rf.MetaData[DRFileNameKey] != filename {
+		t.Errorf("Metadata was not restored, got filename %q", rf.MetaData[DRFileNameKey])
+	}
+
+	// Popped files are forgotten
+	if NewRamImportBundle(10, processingDir).PopFile() != nil {
+		t.Error("Popped file should not be restored again")
+	}
+}
+
+func TestRamImportBundle_CompletedSurvivesRestart(t *testing.T) {
+	filename := "test_data/import_state_done.bin"
+	if _, err := createTestFile(filename, 300); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+	processingDir := t.TempDir()
+
+	imp := NewRamImportBundle(10, processingDir)
+	for _, bundle := range exportAll(t, 256, filename) {
+		if err := imp.ProcessNextExportBundle(bundle); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed: %v", err)
+		}
+	}
+	// Write a corrupt state file alongside, it must be skipped
+	os.WriteFile(processingDir+"/.state/garbage.json", []byte("{"), 0644)
+
+	restarted := NewRamImportBundle(10, processingDir)
+	rf := restarted.PopFile()
+	if rf == nil {
+		t.Fatal("Completed file was not restored")
+	}
+	if rf.MetaData[DRFileSizeKey] != "300" {
+		t.Errorf("Unexpected metadata for restored file: %v", rf.MetaData)
+	}
+}
+
+func TestRamImportBundle_StateSavedInBatches(t *testing.T) {
+	filename := "test_data/import_state_batch.bin"
+	if _, err := createTestFile(filename, 2000); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+	bundles := exportAll(t, 256, filename)
+	processingDir := t.TempDir()
+
+	imp := NewRamImportBundle(10, processingDir)
+	for _, bundle := range bundles[:3] {
+		if err := imp.ProcessNextExportBundle(bundle); err != nil {
+			t.Fatalf("ProcessNextExportBundle failed: %v", err)
+		}
+	}
+	stateFiles := func() int {
+		matches, _ := filepath.Glob(filepath.Join(processingDir, importStateDirName, "*.json"))
+		return len(matches)
+	}
+	if n := stateFiles(); n != 0 {
+		t.Errorf("Expected nothing saved straight away, found %d state files", n)
+	}
+
+	// The timer saves changes left waiting
+	deadline := time.Now().Add(STATE_SAVE_INTERVAL + 2*time.Second)
+	for stateFiles() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("State was not saved by the timer")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	restarted := NewRamImportBundle(10, processingDir)
+	if missing := restarted.MissingRanges(); len(missing) != 1 || missing[0].Start != 512 {
+		t.Errorf("Unexpected missing ranges after restart: %v", missing)
+	}
+}
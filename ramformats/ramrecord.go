@@ -0,0 +1,270 @@
+package ramformats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Export bundle records
+// Every record returned by GetNextExportBundle starts with a 4 byte magic
+// giving the wire format version, then a 4 byte record type.
+//
+// v1: magic, type, body
+//
+// v2: magic, type, flags(4), body length(4), bundle ID(36), sequence(4),
+// body crc32c(4), header crc32c(4), body
+//
+// The v2 bundle ID is shared by the metadata record and every data record of
+// one bundle. The metadata record has sequence 0 and data records count up
+// from 1. The header checksum covers the 60 header bytes before it, the body
+// checksum is only set with RECORD_FLAG_BODY_CHECKSUM. Data records rely on
+// per segment checksums instead so good segments can still be written when
+// another segment in the same record is corrupt.
+
+// RecordHeader is the decoded header of an export bundle record.
+type RecordHeader struct {
+	Version    int
+	RecordType int
+	Flags      int    // v2 only
+	BundleID   string // v2 only
+	Sequence   int    // v2 only
+}
+
+// SegmentChecksums reports whether the data segments of the record carry checksums.
+func (h RecordHeader) SegmentChecksums() bool {
+	return h.Version == FORMAT_VERSION_2 && h.Flags&RECORD_FLAG_SEGMENT_CHECKSUMS != 0
+}
+
+// EncodeRecord prepends the header for the given version to a record body.
+func EncodeRecord(header RecordHeader, body []byte) ([]byte, error) {
+	headerLen, err := recordHeaderLen(header.Version)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, headerLen, headerLen+len(body))
+	if err := putRecordHeader(record, header, body); err != nil {
+		return nil, err
+	}
+	return append(record, body...), nil
+}
+
+// recordHeaderLen returns the length of the record header of a format version.
+func recordHeaderLen(version int) (int, error) {
+	switch version {
+	case FORMAT_VERSION_1:
+		return V1_HEADER_LEN, nil
+	case FORMAT_VERSION_2:
+		return V2_HEADER_LEN, nil
+	default:
+		return 0, fmt.Errorf("Unsupported export format version: %d", version)
+	}
+}
+
+// putRecordHeader writes the header for body into dst, which must be
+// recordHeaderLen bytes long. This lets a record be built in place with its
+// header space reserved in front of the body.
+func putRecordHeader(dst []byte, header RecordHeader, body []byte) error {
+	headerLen, err := recordHeaderLen(header.Version)
+	if err != nil {
+		return err
+	}
+	if len(dst) != headerLen {
+		return fmt.Errorf("Record header buffer is %d bytes, not %d", len(dst), headerLen)
+	}
+	if header.Version == FORMAT_VERSION_1 {
+		copy(dst[0:4], DATARAM_EXPORT_BUNDLE_HEADER_1)
+		binary.BigEndian.PutUint32(dst[4:8], uint32(header.RecordType))
+		return nil
+	}
+
+	if len(header.BundleID) != UUID_LEN {
+		return fmt.Errorf("Invalid bundle ID length: %d", len(header.BundleID))
+	}
+	bodyChecksum := uint32(0)
+	if header.Flags&RECORD_FLAG_BODY_CHECKSUM != 0 {
+		bodyChecksum = SegmentChecksum(body)
+	}
+	copy(dst[0:4], DATARAM_EXPORT_BUNDLE_HEADER_2)
+	binary.BigEndian.PutUint32(dst[4:8], uint32(header.RecordType))
+	binary.BigEndian.PutUint32(dst[8:12], uint32(header.Flags))
+	binary.BigEndian.PutUint32(dst[12:16], uint32(len(body)))
+	writePos := 16
+	copy(dst[writePos:writePos+UUID_LEN], header.BundleID)
+	writePos += UUID_LEN
+	binary.BigEndian.PutUint32(dst[writePos:writePos+INT32_LEN], uint32(header.Sequence))
+	writePos += INT32_LEN
+	binary.BigEndian.PutUint32(dst[writePos:writePos+CHECKSUM_LEN], bodyChecksum)
+	writePos += CHECKSUM_LEN
+	binary.BigEndian.PutUint32(dst[writePos:writePos+CHECKSUM_LEN], SegmentChecksum(dst[:writePos]))
+	return nil
+}
+
+// DecodeRecord detects the version of a record, checks its header and returns
+// the header and body.
+func DecodeRecord(data []byte) (RecordHeader, []byte, error) {
+	header := RecordHeader{}
+	if len(data) < V1_HEADER_LEN {
+		return header, nil, fmt.Errorf("Bundle too short: %d bytes", len(data))
+	}
+	header.RecordType = BytesToInt(data[4:8])
+	switch {
+	case bytes.Equal(data[0:4], DATARAM_EXPORT_BUNDLE_HEADER_1):
+		header.Version = FORMAT_VERSION_1
+		return header, data[V1_HEADER_LEN:], nil
+	case bytes.Equal(data[0:4], DATARAM_EXPORT_BUNDLE_HEADER_2):
+		header.Version = FORMAT_VERSION_2
+	default:
+		return header, nil, fmt.Errorf("Unrecognised block header: %x", data[0:4])
+	}
+
+	if len(data) < V2_HEADER_LEN {
+		return header, nil, fmt.Errorf("Bundle too short for a v2 header: %d bytes", len(data))
+	}
+	checksumPos := V2_HEADER_LEN - CHECKSUM_LEN
+	if uint32(BytesToInt(data[checksumPos:V2_HEADER_LEN])) != SegmentChecksum(data[:checksumPos]) {
+		return header, nil, fmt.Errorf("%w: v2 record header", ErrChecksumMismatch)
+	}
+	header.Flags = BytesToInt(data[8:12])
+	bodyLen := BytesToInt(data[12:16])
+	readPos := 16
+	header.BundleID = string(data[readPos : readPos+UUID_LEN])
+	if err := ValidateUUID(header.BundleID); err != nil {
+		return header, nil, fmt.Errorf("Bundle ID of v2 record: %v", err)
+	}
+	readPos += UUID_LEN
+	header.Sequence = BytesToInt(data[readPos : readPos+INT32_LEN])
+	readPos += INT32_LEN
+	bodyChecksum := uint32(BytesToInt(data[readPos : readPos+CHECKSUM_LEN]))
+
+	body := data[V2_HEADER_LEN:]
+	if len(body) != bodyLen {
+		return header, nil, fmt.Errorf("Record length is %d bytes, header says %d", len(body), bodyLen)
+	}
+	if header.Flags&RECORD_FLAG_BODY_CHECKSUM != 0 && SegmentChecksum(body) != bodyChecksum {
+		return header, nil, fmt.Errorf("%w: v2 record body of bundle %s sequence %d", ErrChecksumMismatch, header.BundleID, header.Sequence)
+	}
+	return header, body, nil
+}
+
+// PeekRecordType returns the type of a record from its magic and type fields,
+// without checking the rest of it. Transports use it to route records.
+func PeekRecordType(data []byte) (int, error) {
+	if len(data) < V1_HEADER_LEN {
+		return 0, fmt.Errorf("Bundle too short: %d bytes", len(data))
+	}
+	if !bytes.Equal(data[0:4], DATARAM_EXPORT_BUNDLE_HEADER_1) && !bytes.Equal(data[0:4], DATARAM_EXPORT_BUNDLE_HEADER_2) {
+		return 0, fmt.Errorf("Unrecognised block header: %x", data[0:4])
+	}
+	return BytesToInt(data[4:8]), nil
+}
+
+// dataSegment is a decoded data segment and the bytes it carries.
+type dataSegment struct {
+	SegmentInfo
+	Data []byte
+}
+
+// SEGMENT_HEADER_LEN is the length of a data segment header without its checksum
+const SEGMENT_HEADER_LEN = UUID_LEN + INT64_LEN + INT64_LEN + INT32_LEN
+
+// appendSegmentHeader encodes a segment header onto a data record body. The
+// checksum, if there is one, is left zero for the caller to fill in at the
+// returned position.
+// format (UUID, file_size, start_pos, len, [crc32c], Datablob)
+func appendSegmentHeader(body []byte, uuid string, fileSize int64, start int64, length int, withChecksum bool) ([]byte, int, error) {
+	if len(uuid) != UUID_LEN {
+		return nil, 0, fmt.Errorf("Invalid UUID length: %d", len(uuid))
+	}
+	body = append(body, uuid...)
+	body = binary.BigEndian.AppendUint64(body, uint64(fileSize))
+	body = binary.BigEndian.AppendUint64(body, uint64(start))
+	body = binary.BigEndian.AppendUint32(body, uint32(length))
+	checksumPos := len(body)
+	if withChecksum {
+		body = binary.BigEndian.AppendUint32(body, 0)
+	}
+	return body, checksumPos, nil
+}
+
+// appendSegment encodes one file segment onto a data record body.
+func appendSegment(body []byte, uuid string, fileSize int64, start int64, data []byte, withChecksum bool) ([]byte, error) {
+	body, checksumPos, err := appendSegmentHeader(body, uuid, fileSize, start, len(data), withChecksum)
+	if err != nil {
+		return nil, err
+	}
+	if withChecksum {
+		segmentStart := checksumPos - SEGMENT_HEADER_LEN
+		binary.BigEndian.PutUint32(body[checksumPos:], segmentChecksum(body[segmentStart:checksumPos], data))
+	}
+	return append(body, data...), nil
+}
+
+// appendFileSegment encodes a segment of a file onto a data record body,
+// reading the data straight into the body rather than through a separate buffer.
+func appendFileSegment(body []byte, uuid string, fileSize int64, start int64, length int, file io.ReaderAt, withChecksum bool) ([]byte, error) {
+	body, checksumPos, err := appendSegmentHeader(body, uuid, fileSize, start, length, withChecksum)
+	if err != nil {
+		return nil, err
+	}
+	dataStart := len(body)
+	body = slices.Grow(body, length)[:dataStart+length]
+	n, err := file.ReadAt(body[dataStart:], start)
+	if n < length {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("file is shorter than its size of %d", fileSize)
+		}
+		return nil, fmt.Errorf("failed to read from file: %w", err)
+	}
+	if withChecksum {
+		segmentStart := checksumPos - SEGMENT_HEADER_LEN
+		binary.BigEndian.PutUint32(body[checksumPos:], segmentChecksum(body[segmentStart:checksumPos], body[dataStart:]))
+	}
+	return body, nil
+}
+
+// decodeSegments splits a data record body into its segments. Checksums are
+// checked and reported through Valid, the segments are returned either way.
+func decodeSegments(body []byte, hasChecksum bool) ([]dataSegment, error) {
+	segmentHeaderLen := SEGMENT_HEADER_LEN
+	if hasChecksum {
+		segmentHeaderLen += CHECKSUM_LEN
+	}
+	if len(body) == 0 {
+		return nil, fmt.Errorf("Data record has no segments")
+	}
+	segments := make([]dataSegment, 0)
+	readPos := 0
+	for readPos < len(body) {
+		if readPos+segmentHeaderLen > len(body) {
+			return nil, fmt.Errorf("Truncated segment header at byte %d", readPos)
+		}
+		segment := dataSegment{}
+		segmentHeader := body[readPos : readPos+SEGMENT_HEADER_LEN]
+		segment.UUID = string(body[readPos : readPos+UUID_LEN])
+		if err := ValidateUUID(segment.UUID); err != nil {
+			return nil, fmt.Errorf("Segment at byte %d: %v", readPos, err)
+		}
+		readPos += UUID_LEN
+		segment.FileSize = BytesToInt64(body[readPos : readPos+INT64_LEN])
+		readPos += INT64_LEN
+		segment.Start = BytesToInt64(body[readPos : readPos+INT64_LEN])
+		readPos += INT64_LEN
+		segment.Length = BytesToInt(body[readPos : readPos+INT32_LEN])
+		readPos += INT32_LEN
+		if hasChecksum {
+			segment.Checksum = uint32(BytesToInt(body[readPos : readPos+CHECKSUM_LEN]))
+			readPos += CHECKSUM_LEN
+		}
+		if segment.Length < 0 || readPos+segment.Length > len(body) {
+			return nil, fmt.Errorf("Truncated segment data for %s", segment.UUID)
+		}
+		segment.Data = body[readPos : readPos+segment.Length]
+		segment.Valid = !hasChecksum || segmentChecksum(segmentHeader, segment.Data) == segment.Checksum
+		readPos += segment.Length
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
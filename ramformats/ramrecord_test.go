@@ -0,0 +1,150 @@
+package ramformats
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRecord_RoundTrip(t *testing.T) {
+	body := []byte(`{"some":"metadata"}`)
+	for _, version := range []int{FORMAT_VERSION_1, FORMAT_VERSION_2} {
+		header := RecordHeader{Version: version, RecordType: METADATA_HEADER, Flags: RECORD_FLAG_BODY_CHECKSUM, BundleID: GenerateUUID(), Sequence: 3}
+		record, err := EncodeRecord(header, body)
+		if err != nil {
+			t.Fatalf("EncodeRecord(v%d) failed: %v", version, err)
+		}
+		decoded, decodedBody, err := DecodeRecord(record)
+		if err != nil {
+			t.Fatalf("DecodeRecord(v%d) failed: %v", version, err)
+		}
+		if !bytes.Equal(decodedBody, body) {
+			t.Errorf("v%d body mismatch: %q", version, decodedBody)
+		}
+		if version == FORMAT_VERSION_1 {
+			// v1 carries only the version and type
+			header = RecordHeader{Version: version, RecordType: METADATA_HEADER}
+		}
+		if decoded != header {
+			t.Errorf("v%d header mismatch: got %+v, want %+v", version, decoded, header)
+		}
+	}
+}
+
+func TestRecord_V2Corruption(t *testing.T) {
+	header := RecordHeader{Version: FORMAT_VERSION_2, RecordType: METADATA_HEADER, Flags: RECORD_FLAG_BODY_CHECKSUM, BundleID: GenerateUUID()}
+	record, err := EncodeRecord(header, []byte("body"))
+	if err != nil {
+		t.Fatalf("EncodeRecord failed: %v", err)
+	}
+
+	badHeader := append([]byte(nil), record...)
+	badHeader[20] ^= 0x01
+	if _, _, err := DecodeRecord(badHeader); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected header checksum mismatch, got %v", err)
+	}
+	badBody := append([]byte(nil), record...)
+	badBody[len(badBody)-1] ^= 0x01
+	if _, _, err := DecodeRecord(badBody); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected body checksum mismatch, got %v", err)
+	}
+	if _, _, err := DecodeRecord(record[:len(record)-1]); err == nil {
+		t.Error("Expected error for a short record")
+	}
+	if _, _, err := DecodeRecord(append(record, 0)); err == nil {
+		t.Error("Expected error for trailing bytes")
+	}
+	if _, _, err := DecodeRecord(record[:V2_HEADER_LEN-1]); err == nil {
+		t.Error("Expected error for a truncated header")
+	}
+	if _, err := EncodeRecord(RecordHeader{Version: FORMAT_VERSION_2, BundleID: "short"}, nil); err == nil {
+		t.Error("Expected error for a bad bundle ID")
+	}
+	if _, err := EncodeRecord(RecordHeader{Version: 3}, nil); err == nil {
+		t.Error("Expected error for an unknown version")
+	}
+}
+
+func TestRecord_MixedVersionsImport(t *testing.T) {
+	filename := "test_data/record_mixed_file.bin"
+	original, err := createTestFile(filename, 900)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(filename)
+
+	exporters := map[int]*RamExportBundle{}
+	for _, version := range []int{FORMAT_VERSION_1, FORMAT_VERSION_2} {
+		exp := NewRamExportBundle(256, 10, 10)
+		if err := exp.SetFormatVersion(version); err != nil {
+			t.Fatalf("SetFormatVersion(%d) failed: %v", version, err)
+		}
+		exporters[version] = exp
+	}
+	if err := exporters[FORMAT_VERSION_1].SetFormatVersion(4); err == nil {
+		t.Error("Expected error for unsupported format version")
+	}
+
+	// One receiver takes a v1 and a v2 sender during a rollout
+	imp := NewRamImportBundle(10, t.TempDir())
+	for version, exp := range exporters {
+		exp.PushFile(*NewRamFileFromLocal(filename, filename))
+		for {
+			bundle, err := exp.GetNextExportBundle()
+			if err != nil {
+				t.Fatalf("GetNextExportBundle failed: %v", err)
+			}
+			if bundle == nil {
+				break
+			}
+			if !bytes.HasPrefix(bundle, map[int][]byte{1: DATARAM_EXPORT_BUNDLE_HEADER_1, 2: DATARAM_EXPORT_BUNDLE_HEADER_2}[version]) {
+				t.Fatalf("v%d exporter produced header %x", version, bundle[0:4])
+			}
+			if header, _, err := DecodeRecord(bundle); err != nil {
+				t.Fatalf("DecodeRecord(v%d) failed: %v", version, err)
+			} else if version == FORMAT_VERSION_1 && header.RecordType != METADATA_HEADER && header.RecordType != DATA_HEADER {
+				// Older receivers only know these two record types
+				t.Errorf("v1 exporter produced record type %d", header.RecordType)
+			}
+			if err := imp.ProcessNextExportBundle(bundle); err != nil {
+				t.Fatalf("ProcessNextExportBundle(v%d) failed: %v", version, err)
+			}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		rf := imp.PopFile()
+		if rf == nil {
+			t.Fatalf("Expected 2 completed files, got %d", i)
+		}
+		got, _ := os.ReadFile(rf.LocalPath)
+		if !bytes.Equal(got, original) {
+			t.Errorf("Imported file %s does not match original", rf.UUID)
+		}
+	}
+}
+
+func TestRecord_SegmentChecksumCoversHeader(t *testing.T) {
+	uuid := GenerateUUID()
+	body, err := appendSegment(nil, uuid, 100, 20, []byte("segment data"), true)
+	if err != nil {
+		t.Fatalf("appendSegment failed: %v", err)
+	}
+	segments, err := decodeSegments(body, true)
+	if err != nil || len(segments) != 1 || !segments[0].Valid {
+		t.Fatalf("Expected one valid segment, got %+v, %v", segments, err)
+	}
+
+	// Corrupting the file size, the start or the data must all fail the checksum
+	for _, pos := range []int{UUID_LEN, UUID_LEN + INT64_LEN + INT64_LEN - 1, len(body) - 1} {
+		corrupt := append([]byte(nil), body...)
+		corrupt[pos] ^= 0x01
+		segments, err := decodeSegments(corrupt, true)
+		if err != nil {
+			t.Fatalf("decodeSegments failed: %v", err)
+		}
+		if segments[0].Valid {
+			t.Errorf("Corrupting byte %d was not caught: %+v", pos, segments[0])
+		}
+	}
+}
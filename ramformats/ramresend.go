@@ -0,0 +1,257 @@
+package ramformats
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Selective retransmission
+// Once a sender has sent every record of a bundle it asks the receiver, over
+// the transport's control channel, what is still missing from the files it
+// sent. The request is a list of file UUIDs and the reply a list of
+// (UUID, offset, length) ranges. The sender regenerates just those segments
+// with ResendRecords.
+//
+// request: count(4), then count UUIDs(36)
+// reply:   count(4), then count entries of UUID(36), offset(8), length(8), flags(4)
+//
+// Files the receiver has never heard of are not reported, every record is
+// acknowledged after it has been applied so they can only have been delivered
+// and forgotten already.
+
+// ResendRequest is a range of a file the receiver still needs.
+type ResendRequest struct {
+	MissingRange
+	Metadata bool // The receiver has no metadata for the file, the range is empty
+}
+
+const (
+	resendEntryLen      = UUID_LEN + INT64_LEN + INT64_LEN + INT32_LEN
+	resendFlagMetadata  = 1 << 0
+	maxResendListLength = 1 << 20
+)
+
+// EncodeUUIDList encodes the file UUIDs a sender asks about.
+func EncodeUUIDList(uuids []string) ([]byte, error) {
+	data := make([]byte, 0, INT32_LEN+len(uuids)*UUID_LEN)
+	data = append(data, IntToBytes(len(uuids))...)
+	for _, uuid := range uuids {
+		if len(uuid) != UUID_LEN {
+			return nil, fmt.Errorf("Invalid UUID length: %d", len(uuid))
+		}
+		data = append(data, []byte(uuid)...)
+	}
+	return data, nil
+}
+
+// DecodeUUIDList decodes a list written by EncodeUUIDList.
+func DecodeUUIDList(data []byte) ([]string, error) {
+	count, err := decodeListCount(data, UUID_LEN)
+	if err != nil {
+		return nil, err
+	}
+	uuids := make([]string, count)
+	for i := range uuids {
+		readPos := INT32_LEN + i*UUID_LEN
+		uuids[i] = string(data[readPos : readPos+UUID_LEN])
+	}
+	return uuids, nil
+}
+
+// EncodeResendRequests encodes a receiver's reply to a resend request.
+func EncodeResendRequests(requests []ResendRequest) ([]byte, error) {
+	data := make([]byte, 0, INT32_LEN+len(requests)*resendEntryLen)
+	data = append(data, IntToBytes(len(requests))...)
+	for _, request := range requests {
+		if len(request.UUID) != UUID_LEN {
+			return nil, fmt.Errorf("Invalid UUID length: %d", len(request.UUID))
+		}
+		flags := 0
+		if request.Metadata {
+			flags |= resendFlagMetadata
+		}
+		data = append(data, []byte(request.UUID)...)
+		data = append(data, Int64ToBytes(request.Start)...)
+		data = append(data, Int64ToBytes(request.Len())...)
+		data = append(data, IntToBytes(flags)...)
+	}
+	return data, nil
+}
+
+// DecodeResendRequests decodes a reply written by EncodeResendRequests.
+func DecodeResendRequests(data []byte) ([]ResendRequest, error) {
+	count, err := decodeListCount(data, resendEntryLen)
+	if err != nil {
+		return nil, err
+	}
+	requests := make([]ResendRequest, count)
+	for i := range requests {
+		readPos := INT32_LEN + i*resendEntryLen
+		request := &requests[i]
+		request.UUID = string(data[readPos : readPos+UUID_LEN])
+		readPos += UUID_LEN
+		request.Start = BytesToInt64(data[readPos : readPos+INT64_LEN])
+		readPos += INT64_LEN
+		length := BytesToInt64(data[readPos : readPos+INT64_LEN])
+		readPos += INT64_LEN
+		if request.Start < 0 || length < 0 {
+			return nil, fmt.Errorf("Invalid resend range %d+%d for %s", request.Start, length, request.UUID)
+		}
+		request.End = request.Start + length
+		request.Metadata = BytesToInt(data[readPos:readPos+INT32_LEN])&resendFlagMetadata != 0
+	}
+	return requests, nil
+}
+
+func decodeListCount(data []byte, entryLen int) (int, error) {
+	if len(data) < INT32_LEN {
+		return 0, fmt.Errorf("List too short: %d bytes", len(data))
+	}
+	count := BytesToInt(data[0:INT32_LEN])
+	if count > maxResendListLength || len(data) != INT32_LEN+count*entryLen {
+		return 0, fmt.Errorf("List of %d entries does not match its length of %d bytes", count, len(data))
+	}
+	return count, nil
+}
+
+// ResendRequests returns what is still missing from the given files. Files
+// that are complete or unknown are not reported.
+func (rb *RamImportBundle) ResendRequests(uuids []string) []ResendRequest {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	requests := make([]ResendRequest, 0)
+	for _, uuid := range uuids {
+		if _, exists := rb.processBundles[uuid]; !exists {
+			continue
+		}
+		if !rb.metadataApplied[uuid] {
+			requests = append(requests, ResendRequest{MissingRange: MissingRange{UUID: uuid}, Metadata: true})
+		}
+		for _, gap := range rb.fileMissingRanges(uuid) {
+			requests = append(requests, ResendRequest{MissingRange: MissingRange{UUID: uuid, ByteRange: gap}})
+		}
+	}
+	return requests
+}
+
+// ResendRecords regenerates the records needed to fill the ranges a receiver
+// asked for: a metadata record for files it has no metadata for, then data
+// records of at most the chunk size. Files must have been exported and not yet
+// released with ReleaseFile.
+func (rb *RamExportBundle) ResendRecords(requests []ResendRequest) ([][]byte, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	records := make([][]byte, 0)
+	resendMeta := make(map[string]map[string]string)
+	for _, request := range requests {
+		if !request.Metadata {
+			continue
+		}
+		rf, exists := rb.sentFiles[request.UUID]
+		if !exists {
+			return nil, fmt.Errorf("Cannot resend metadata for unknown file %s", request.UUID)
+		}
+		fileMeta, err := rb.fileMeta(rf)
+		if err != nil {
+			return nil, err
+		}
+		fileMeta[DRBundleIDKey] = rb.sentBundles[rf.UUID]
+		resendMeta[rf.UUID] = fileMeta
+	}
+	if len(resendMeta) != 0 {
+		metaBytes, err := ExportMetaToBytes(resendMeta)
+		if err != nil {
+			return nil, fmt.Errorf("Error converting metadata to bytes: %v", err)
+		}
+		record, err := rb.encodeResendRecord(METADATA_HEADER, RECORD_FLAG_BODY_CHECKSUM, metaBytes)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	// Resend in file and offset order so segments pack into as few records as possible
+	ranges := make([]ResendRequest, 0, len(requests))
+	for _, request := range requests {
+		if request.Len() > 0 {
+			ranges = append(ranges, request)
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		if ranges[i].UUID != ranges[j].UUID {
+			return ranges[i].UUID < ranges[j].UUID
+		}
+		return ranges[i].Start < ranges[j].Start
+	})
+
+	body := make([]byte, 0)
+	bodyBytes := int64(0)
+	for _, request := range ranges {
+		rf, exists := rb.sentFiles[request.UUID]
+		if !exists {
+			return nil, fmt.Errorf("Cannot resend data for unknown file %s", request.UUID)
+		}
+		fileSize, err := GetIntFromString(rf.MetaData[DRFileSizeKey])
+		if err != nil {
+			return nil, err
+		}
+		if request.End > fileSize {
+			return nil, fmt.Errorf("Resend range %d-%d is outside file %s of size %d", request.Start, request.End, rf.UUID, fileSize)
+		}
+		for pos := request.Start; pos < request.End; {
+			if bodyBytes == rb.chunkSize {
+				record, err := rb.encodeResendRecord(DATA_HEADER, RECORD_FLAG_SEGMENT_CHECKSUMS, body)
+				if err != nil {
+					return nil, err
+				}
+				records = append(records, record)
+				body = make([]byte, 0)
+				bodyBytes = 0
+			}
+			amountToRead := min(request.End-pos, rb.chunkSize-bodyBytes)
+			fileHandle, err := rb.readers.get(rf.LocalPath, openForRead)
+			if err != nil {
+				return nil, err
+			}
+			if body, err = appendFileSegment(body, rf.UUID, fileSize, pos, int(amountToRead), fileHandle, rb.segmentChecksums()); err != nil {
+				return nil, err
+			}
+			pos += amountToRead
+			bodyBytes += amountToRead
+		}
+	}
+	if bodyBytes > 0 {
+		record, err := rb.encodeResendRecord(DATA_HEADER, RECORD_FLAG_SEGMENT_CHECKSUMS, body)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// encodeResendRecord wraps a resent body. Resent records are flagged so the
+// receiver does not count them as chunks of a bundle. The caller must hold rb.mu.
+func (rb *RamExportBundle) encodeResendRecord(recordType int, flags int, body []byte) ([]byte, error) {
+	header := RecordHeader{
+		Version:    rb.formatVersion,
+		RecordType: recordType,
+		Flags:      flags | RECORD_FLAG_RESEND,
+		BundleID:   GenerateUUID(),
+	}
+	return EncodeRecord(header, body)
+}
+
+// ReleaseFile forgets a file once the receiver has all of it, after which its
+// ranges can no longer be resent.
+func (rb *RamExportBundle) ReleaseFile(uuid string) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rf, exists := rb.sentFiles[uuid]; exists {
+		rb.readers.close(rf.LocalPath)
+	}
+	delete(rb.sentFiles, uuid)
+	delete(rb.sentBundles, uuid)
+}
@@ -0,0 +1,129 @@
+package ramformats
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestResendEncoding(t *testing.T) {
+	uuids := []string{GenerateUUID(), GenerateUUID()}
+	data, err := EncodeUUIDList(uuids)
+	if err != nil {
+		t.Fatalf("EncodeUUIDList failed: %v", err)
+	}
+	decoded, err := DecodeUUIDList(data)
+	if err != nil || !reflect.DeepEqual(decoded, uuids) {
+		t.Errorf("UUID list round trip: got %v, %v", decoded, err)
+	}
+	if _, err := DecodeUUIDList(data[:len(data)-1]); err == nil {
+		t.Error("Expected error for truncated UUID list")
+	}
+	if _, err := EncodeUUIDList([]string{"short"}); err == nil {
+		t.Error("Expected error for bad UUID")
+	}
+
+	requests := []ResendRequest{
+		{MissingRange: MissingRange{UUID: uuids[0], ByteRange: ByteRange{Start: 10, End: 300}}},
+		{MissingRange: MissingRange{UUID: uuids[1]}, Metadata: true},
+	}
+	data, err = EncodeResendRequests(requests)
+	if err != nil {
+		t.Fatalf("EncodeResendRequests failed: %v", err)
+	}
+	decodedRequests, err := DecodeResendRequests(data)
+	if err != nil || !reflect.DeepEqual(decodedRequests, requests) {
+		t.Errorf("Resend request round trip: got %+v, %v", decodedRequests, err)
+	}
+	if _, err := DecodeResendRequests(append(data, 0)); err == nil {
+		t.Error("Expected error for trailing bytes")
+	}
+}
+
+func TestResend_FillsGaps(t *testing.T) {
+	for _, version := range []int{FORMAT_VERSION_1, FORMAT_VERSION_2} {
+		files := []string{"test_data/resend_file_0.bin", "test_data/resend_file_1.bin"}
+		originals := make(map[string][]byte)
+		exp := NewRamExportBundle(256, 10, 10)
+		exp.SetFormatVersion(version)
+		uuids := make([]string, 0)
+		for _, filename := range files {
+			original, err := createTestFile(filename, 700)
+			if err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+			defer os.Remove(filename)
+			rf := NewRamFileFromLocal(filename, filename)
+			originals[rf.UUID] = original
+			uuids = append(uuids, rf.UUID)
+			exp.PushFile(*rf)
+		}
+
+		// Each file is its own bundle of metadata and 3 data records. Lose the
+		// first file's metadata and the middle data record of the second file
+		imp := NewRamImportBundle(10, t.TempDir())
+		for i := 0; ; i++ {
+			bundle, err := exp.GetNextExportBundle()
+			if err != nil {
+				t.Fatalf("GetNextExportBundle failed: %v", err)
+			}
+			if bundle == nil {
+				break
+			}
+			if i == 0 || i == 6 {
+				continue
+			}
+			if err := imp.ProcessNextExportBundle(bundle); err != nil {
+				t.Fatalf("ProcessNextExportBundle failed: %v", err)
+			}
+		}
+
+		requests := imp.ResendRequests(append(uuids, GenerateUUID()))
+		metadataRequests := 0
+		missingBytes := int64(0)
+		for _, request := range requests {
+			if request.Metadata {
+				metadataRequests++
+			}
+			missingBytes += request.Len()
+		}
+		if metadataRequests != 1 || missingBytes != 256 {
+			t.Fatalf("v%d: expected 1 metadata request and 256 missing bytes, got %+v", version, requests)
+		}
+
+		records, err := exp.ResendRecords(requests)
+		if err != nil {
+			t.Fatalf("ResendRecords failed: %v", err)
+		}
+		if len(records) != 2 {
+			t.Errorf("v%d: expected a metadata and a data record, got %d records", version, len(records))
+		}
+		for _, record := range records {
+			if err := imp.ProcessNextExportBundle(record); err != nil {
+				t.Fatalf("Resent record failed: %v", err)
+			}
+		}
+		if len(imp.ResendRequests(uuids)) != 0 {
+			t.Errorf("v%d: still missing after resend: %+v", version, imp.ResendRequests(uuids))
+		}
+		if len(imp.MissingChunks()) != 0 {
+			t.Errorf("v%d: bundle still tracked after its files completed: %v", version, imp.MissingChunks())
+		}
+		for i := 0; i < len(files); i++ {
+			rf := imp.PopFile()
+			if rf == nil {
+				t.Fatalf("v%d: expected %d completed files, got %d", version, len(files), i)
+			}
+			got, _ := os.ReadFile(rf.LocalPath)
+			if !bytes.Equal(got, originals[rf.UUID]) {
+				t.Errorf("v%d: file %s does not match original", version, rf.UUID)
+			}
+		}
+
+		exp.ReleaseFile(uuids[0])
+		if _, err := exp.ResendRecords(requests); err == nil {
+			t.Errorf("v%d: expected error resending a released file", version)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package ramformats
+
+import "sort"
+
+// ByteRange is a half open range [Start, End) of bytes within a file.
+type ByteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Len returns the number of bytes in the range.
+func (r ByteRange) Len() int64 {
+	return r.End - r.Start
+}
+
+// addRange adds r to a sorted list of non-overlapping ranges, merging any
+// ranges it overlaps or touches, and returns the new list.
+func addRange(ranges []ByteRange, r ByteRange) []ByteRange {
+	if r.Len() <= 0 {
+		return ranges
+	}
+	// First range that ends at or after the new start could merge with it
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].End >= r.Start })
+	j := i
+	for j < len(ranges) && ranges[j].Start <= r.End {
+		if ranges[j].Start < r.Start {
+			r.Start = ranges[j].Start
+		}
+		if ranges[j].End > r.End {
+			r.End = ranges[j].End
+		}
+		j++
+	}
+	merged := make([]ByteRange, 0, len(ranges)-(j-i)+1)
+	merged = append(merged, ranges[:i]...)
+	merged = append(merged, r)
+	return append(merged, ranges[j:]...)
+}
+
+// rangesCovered returns the total number of bytes covered by a list of ranges.
+func rangesCovered(ranges []ByteRange) int64 {
+	covered := int64(0)
+	for _, r := range ranges {
+		covered += r.Len()
+	}
+	return covered
+}
+
+// rangesContain reports whether every byte of r is already covered.
+func rangesContain(ranges []ByteRange, r ByteRange) bool {
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].End >= r.End })
+	return i < len(ranges) && ranges[i].Start <= r.Start
+}
+
+// rangeGaps returns the parts of [0, size) not covered by the ranges.
+func rangeGaps(ranges []ByteRange, size int64) []ByteRange {
+	gaps := make([]ByteRange, 0)
+	pos := int64(0)
+	for _, r := range ranges {
+		if r.Start > pos {
+			gaps = append(gaps, ByteRange{Start: pos, End: r.Start})
+		}
+		if r.End > pos {
+			pos = r.End
+		}
+	}
+	if pos < size {
+		gaps = append(gaps, ByteRange{Start: pos, End: size})
+	}
+	return gaps
+}
@@ -0,0 +1,51 @@
+package ramformats
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddRange(t *testing.T) {
+	var ranges []ByteRange
+	ranges = addRange(ranges, ByteRange{10, 20})
+	ranges = addRange(ranges, ByteRange{30, 40})
+	ranges = addRange(ranges, ByteRange{0, 5})
+	want := []ByteRange{{0, 5}, {10, 20}, {30, 40}}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("got %v, want %v", ranges, want)
+	}
+
+	// Touching and overlapping ranges merge
+	ranges = addRange(ranges, ByteRange{5, 10})
+	ranges = addRange(ranges, ByteRange{15, 35})
+	want = []ByteRange{{0, 40}}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("got %v, want %v", ranges, want)
+	}
+
+	// Empty ranges are ignored
+	ranges = addRange(ranges, ByteRange{50, 50})
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("got %v, want %v", ranges, want)
+	}
+}
+
+func TestRangeCoverageAndGaps(t *testing.T) {
+	ranges := []ByteRange{{10, 20}, {30, 40}}
+	if rangesCovered(ranges) != 20 {
+		t.Errorf("rangesCovered = %d, want 20", rangesCovered(ranges))
+	}
+	if !rangesContain(ranges, ByteRange{12, 20}) || !rangesContain(ranges, ByteRange{30, 40}) {
+		t.Error("rangesContain missed a covered range")
+	}
+	if rangesContain(ranges, ByteRange{15, 35}) || rangesContain(ranges, ByteRange{0, 5}) || rangesContain(ranges, ByteRange{38, 45}) {
+		t.Error("rangesContain matched an uncovered range")
+	}
+	want := []ByteRange{{0, 10}, {20, 30}, {40, 50}}
+	if gaps := rangeGaps(ranges, 50); !reflect.DeepEqual(gaps, want) {
+		t.Errorf("rangeGaps = %v, want %v", gaps, want)
+	}
+	if gaps := rangeGaps([]ByteRange{{0, 50}}, 50); len(gaps) != 0 {
+		t.Errorf("Expected no gaps, got %v", gaps)
+	}
+}
@@ -4,8 +4,11 @@ package raminputs
 import (
 	"data_ram/ramformats"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 )
 
 type LocalPickup struct {
@@ -14,6 +17,11 @@ type LocalPickup struct {
 	IgnoreDotFiles  bool
 	FilesInProgress map[string]ramformats.RamFile
 	FilesInQueue    map[string]ramformats.RamFile
+	pickupRegex     *regexp.Regexp
+	pickedUp        map[string]string   // Local paths already picked up, mapped to their UUID
+	sent            map[string]sentFile // Local paths sent, journaled to statePath
+	settling        map[string]sentFile // Size and modification time of files not yet picked up, as of the last pulse
+	statePath       string              // Sent file journal, empty when not persisted
 }
 
 func NewLocalPickup(pickupPath, pickupRegex string, ignoreDotFiles bool) *LocalPickup {
@@ -23,6 +31,9 @@ func NewLocalPickup(pickupPath, pickupRegex string, ignoreDotFiles bool) *LocalP
 		IgnoreDotFiles:  ignoreDotFiles,
 		FilesInProgress: make(map[string]ramformats.RamFile),
 		FilesInQueue:    make(map[string]ramformats.RamFile),
+		pickedUp:        make(map[string]string),
+		sent:            make(map[string]sentFile),
+		settling:        make(map[string]sentFile),
 	}
 }
 
@@ -40,28 +51,81 @@ func (lp *LocalPickup) Init() error {
 		return fmt.Errorf("Pickup path is not a directory")
 	}
 	// Check if the directory is writeable using a random uuid filename
-	testFileName := lp.PickupPath + "/rampickuptest_" + ramformats.GenerateUUID()
-	if err := os.WriteFile(lp.PickupPath+"/"+testFileName, []byte("test"), 0644); err != nil {
+	testFilePath := filepath.Join(lp.PickupPath, ".rampickuptest_"+ramformats.GenerateUUID())
+	if err := os.WriteFile(testFilePath, []byte("test"), 0644); err != nil {
 		return fmt.Errorf("Pickup path is not writeable check file failed: %v", err)
 	}
 	// Remove the test file
-	if err := os.Remove(lp.PickupPath + lp.PickupPath + "/" + testFileName); err != nil {
+	if err := os.Remove(testFilePath); err != nil {
 		return fmt.Errorf("Error removing check file from pickup path: %v", err)
 	}
 	// Check regex is valid or empty
 	if lp.PickupRegex != "" {
-		if _, err := regexp.Compile(lp.PickupRegex); err != nil {
+		re, err := regexp.Compile(lp.PickupRegex)
+		if err != nil {
 			return fmt.Errorf("Pickup regex is not valid: %v", err)
 		}
+		lp.pickupRegex = re
 	}
-	return nil
+	return lp.loadState()
 }
 
+// Pulse scans the pickup directory and queues any new regular files that match
+// the pickup regex. Files that have already been picked up are skipped. A file is
+// only queued once its size and modification time are unchanged since the last
+// pulse, so one still being written is not picked up part way through.
 func (lp *LocalPickup) Pulse() error {
-
+	entries, err := os.ReadDir(lp.PickupPath)
+	if err != nil {
+		return fmt.Errorf("Error reading pickup path: %v", err)
+	}
+	seen := make(map[string]sentFile)
+	defer func() { lp.settling = seen }() // Files that have gone are forgotten
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if lp.IgnoreDotFiles && strings.HasPrefix(name, ".") {
+			continue
+		}
+		if lp.pickupRegex != nil && !lp.pickupRegex.MatchString(name) {
+			continue
+		}
+		localPath := filepath.Join(lp.PickupPath, name)
+		if _, exists := lp.pickedUp[localPath]; exists {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// File disappeared between listing and stat, try again next pulse
+			continue
+		}
+		// Empty files cannot be bundled
+		if info.Size() == 0 {
+			continue
+		}
+		stamp := sentFile{Size: info.Size(), ModTime: info.ModTime()}
+		if last, exists := lp.settling[localPath]; !exists || last.Size != stamp.Size || !last.ModTime.Equal(stamp.ModTime) {
+			seen[localPath] = stamp
+			continue
+		}
+		rf := ramformats.NewRamFileFromLocal(localPath, name)
+		if rf == nil {
+			continue
+		}
+		lp.FilesInQueue[rf.UUID] = *rf
+		lp.pickedUp[localPath] = rf.UUID
+	}
 	return nil
 }
 
+// Settling returns how many files were seen on the last pulse but not yet picked
+// up, because they had changed since the pulse before.
+func (lp *LocalPickup) Settling() int {
+	return len(lp.settling)
+}
+
 func (lp *LocalPickup) GetFile() (*ramformats.RamFile, error) {
 	if len(lp.FilesInQueue) > 0 {
 		// Pop the first file from the queue
@@ -75,13 +139,52 @@ func (lp *LocalPickup) GetFile() (*ramformats.RamFile, error) {
 	return nil, fmt.Errorf("No files available in queue")
 }
 
+// ReturnFile puts an in-progress file back on the queue, e.g. when the
+// consumer could not accept it yet.
+func (lp *LocalPickup) ReturnFile(rf *ramformats.RamFile) error {
+	if _, exists := lp.FilesInProgress[rf.UUID]; !exists {
+		return fmt.Errorf("RamFile %s is not in progress", rf.UUID)
+	}
+	delete(lp.FilesInProgress, rf.UUID)
+	lp.FilesInQueue[rf.UUID] = *rf
+	return nil
+}
+
+// MarkInProgress records a file restored from elsewhere, e.g. an export journal,
+// as in progress so Pulse does not pick its local path up a second time.
+func (lp *LocalPickup) MarkInProgress(rf ramformats.RamFile) {
+	lp.FilesInProgress[rf.UUID] = rf
+	lp.pickedUp[rf.LocalPath] = rf.UUID
+}
+
+// CompleteFile removes a file from the in-progress map once it has been sent.
+// The local path stays marked as picked up so it is not sent again, and is
+// journaled so it is not sent again after a restart either.
+func (lp *LocalPickup) CompleteFile(rf *ramformats.RamFile) error {
+	if _, exists := lp.FilesInProgress[rf.UUID]; !exists {
+		return fmt.Errorf("RamFile %s is not in progress", rf.UUID)
+	}
+	delete(lp.FilesInProgress, rf.UUID)
+	return lp.recordSent(rf.LocalPath)
+}
+
 func (lp *LocalPickup) ReadData(rf *ramformats.RamFile, len int) ([]byte, error) {
 	// Check the ramfile is in the in-progress map
 	if _, exists := lp.FilesInProgress[rf.UUID]; !exists {
 		return nil, fmt.Errorf("RamFile %s is not in progress", rf.UUID)
 	}
-	// Read the data from the local file to the len
-	data, err := os.ReadFile(rf.LocalPath)
+	fileHandle, err := os.Open(rf.LocalPath)
 	if err != nil {
-	return nil, nil
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer fileHandle.Close()
+
+	// Read up to len bytes from the current position of the ramfile
+	data := make([]byte, len)
+	n, err := fileHandle.ReadAt(data, rf.Position)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read from file: %w", err)
+	}
+	rf.Position += int64(n)
+	return data[:n], nil
 }
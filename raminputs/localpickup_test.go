@@ -0,0 +1,183 @@
+package raminputs
+
+import (
+	"data_ram/ramformats"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestLocalPickup_PulseAndGetFile(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"a.bin", "b.bin", "c.txt", ".hidden.bin", "empty.bin"}
+	for _, name := range names {
+		content := []byte("pickup data")
+		if name == "empty.bin" {
+			content = nil
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+	os.Mkdir(filepath.Join(dir, "subdir.bin"), 0755)
+
+	lp := NewLocalPickup(dir, `\.bin$`, true)
+	if err := lp.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	// Files are only picked up once they are unchanged across two pulses
+	if err := lp.Pulse(); err != nil {
+		t.Fatalf("Pulse failed: %v", err)
+	}
+	if len(lp.FilesInQueue) != 0 || lp.Settling() != 2 {
+		t.Fatalf("Expected 2 settling files on the first pulse, got %d queued, %d settling", len(lp.FilesInQueue), lp.Settling())
+	}
+	if err := lp.Pulse(); err != nil {
+		t.Fatalf("Pulse failed: %v", err)
+	}
+	if len(lp.FilesInQueue) != 2 || lp.Settling() != 0 {
+		t.Fatalf("Expected 2 queued files, got %d queued, %d settling", len(lp.FilesInQueue), lp.Settling())
+	}
+
+	// Another pulse must not pick the same files up again
+	if err := lp.Pulse(); err != nil {
+		t.Fatalf("Pulse failed: %v", err)
+	}
+	if len(lp.FilesInQueue) != 2 {
+		t.Fatalf("Expected 2 queued files after second pulse, got %d", len(lp.FilesInQueue))
+	}
+
+	rf, err := lp.GetFile()
+	if err != nil {
+		t.Fatalf("GetFile failed: %v", err)
+	}
+	data, err := lp.ReadData(rf, 6)
+	if err != nil {
+		t.Fatalf("ReadData failed: %v", err)
+	}
+	if string(data) != "pickup" {
+		t.Errorf("ReadData mismatch: got %s", data)
+	}
+	data, err = lp.ReadData(rf, 100)
+	if err != nil {
+		t.Fatalf("ReadData failed: %v", err)
+	}
+	if string(data) != " data" {
+		t.Errorf("ReadData mismatch: got %s", data)
+	}
+
+	if err := lp.ReturnFile(rf); err != nil {
+		t.Fatalf("ReturnFile failed: %v", err)
+	}
+	if len(lp.FilesInQueue) != 2 || len(lp.FilesInProgress) != 0 {
+		t.Fatalf("ReturnFile did not requeue the file")
+	}
+
+	rf, _ = lp.GetFile()
+	if err := lp.CompleteFile(rf); err != nil {
+		t.Fatalf("CompleteFile failed: %v", err)
+	}
+	if err := lp.CompleteFile(rf); err == nil {
+		t.Error("Expected error completing a file twice")
+	}
+}
+
+func TestLocalPickup_GrowingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "growing.bin")
+	if err := os.WriteFile(path, []byte("first part"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	lp := NewLocalPickup(dir, "", false)
+	if err := lp.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	lp.Pulse()
+
+	// Still being written between pulses, so not picked up yet
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open test file: %v", err)
+	}
+	if _, err := f.WriteString(", second part"); err != nil {
+		t.Fatalf("Failed to append to test file: %v", err)
+	}
+	f.Close()
+	lp.Pulse()
+	if len(lp.FilesInQueue) != 0 {
+		t.Fatalf("Growing file was picked up part way through")
+	}
+
+	lp.Pulse()
+	rf, err := lp.GetFile()
+	if err != nil {
+		t.Fatalf("File was not picked up once it stopped changing: %v", err)
+	}
+	if size := rf.MetaData[ramformats.DRFileSizeKey]; size != strconv.Itoa(len("first part, second part")) {
+		t.Errorf("Picked up %s bytes, want the whole file", size)
+	}
+}
+
+func TestLocalPickup_InitErrors(t *testing.T) {
+	if err := NewLocalPickup("", "", false).Init(); err == nil {
+		t.Error("Expected error for empty pickup path")
+	}
+	if err := NewLocalPickup(filepath.Join(t.TempDir(), "missing"), "", false).Init(); err == nil {
+		t.Error("Expected error for missing pickup path")
+	}
+	if err := NewLocalPickup(t.TempDir(), "([", false).Init(); err == nil {
+		t.Error("Expected error for invalid regex")
+	}
+}
+
+func TestLocalPickup_SentJournal(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(t.TempDir(), "sent.json")
+	for _, name := range []string{"a.bin", "b.bin"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("pickup data"), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	lp := NewLocalPickupWithState(dir, "", false, statePath)
+	if err := lp.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	lp.Pulse()
+	lp.Pulse()
+	rf, _ := lp.GetFile()
+	if err := lp.CompleteFile(rf); err != nil {
+		t.Fatalf("CompleteFile failed: %v", err)
+	}
+
+	// After a restart only the file that was not sent is picked up
+	restarted := NewLocalPickupWithState(dir, "", false, statePath)
+	if err := restarted.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	restarted.Pulse()
+	restarted.Pulse()
+	if len(restarted.FilesInQueue) != 1 {
+		t.Fatalf("Expected 1 queued file after restart, got %d", len(restarted.FilesInQueue))
+	}
+	for _, queued := range restarted.FilesInQueue {
+		if queued.LocalPath == rf.LocalPath {
+			t.Errorf("Sent file %s was picked up again", rf.LocalPath)
+		}
+	}
+
+	// A sent file that has since changed is sent again
+	if err := os.WriteFile(rf.LocalPath, []byte("new pickup data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed := NewLocalPickupWithState(dir, "", false, statePath)
+	if err := changed.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	changed.Pulse()
+	changed.Pulse()
+	if len(changed.FilesInQueue) != 2 {
+		t.Errorf("Expected 2 queued files after a change, got %d", len(changed.FilesInQueue))
+	}
+}
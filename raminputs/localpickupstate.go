@@ -0,0 +1,89 @@
+package raminputs
+
+import (
+	"data_ram/ramformats"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Sent file journal
+// The journal is a JSON map of the local paths that have been sent, with the size
+// and modification time they were sent at, rewritten atomically each time a file
+// completes. Pulse skips a journaled path after a restart unless the file has
+// changed since, so files left in the pickup directory are not sent again.
+
+type sentFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// NewLocalPickupWithState creates a LocalPickup that journals the files it has
+// sent to statePath. Init restores the journal a previous run left behind.
+func NewLocalPickupWithState(pickupPath, pickupRegex string, ignoreDotFiles bool, statePath string) *LocalPickup {
+	lp := NewLocalPickup(pickupPath, pickupRegex, ignoreDotFiles)
+	lp.statePath = statePath
+	return lp
+}
+
+// loadState restores the journal, dropping files that have since been removed
+// or changed.
+func (lp *LocalPickup) loadState() error {
+	if lp.statePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(lp.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading pickup state: %v", err)
+	}
+	sent := make(map[string]sentFile)
+	if err := json.Unmarshal(data, &sent); err != nil {
+		return fmt.Errorf("Error parsing pickup state %s: %v", lp.statePath, err)
+	}
+	for localPath, sf := range sent {
+		if lp.unchanged(localPath, sf) {
+			lp.sent[localPath] = sf
+			lp.pickedUp[localPath] = ""
+		}
+	}
+	if len(lp.sent) != len(sent) {
+		return lp.saveState()
+	}
+	return nil
+}
+
+// unchanged reports whether the file at localPath is still the one journaled.
+func (lp *LocalPickup) unchanged(localPath string, sf sentFile) bool {
+	info, err := os.Stat(localPath)
+	return err == nil && info.Size() == sf.Size && info.ModTime().Equal(sf.ModTime)
+}
+
+// recordSent journals a completed file.
+func (lp *LocalPickup) recordSent(localPath string) error {
+	if lp.statePath == "" {
+		return nil
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		// Removed once sent, there is nothing left to skip
+		return nil
+	}
+	lp.sent[localPath] = sentFile{Size: info.Size(), ModTime: info.ModTime()}
+	return lp.saveState()
+}
+
+// saveState writes the journal.
+func (lp *LocalPickup) saveState() error {
+	data, err := json.Marshal(lp.sent)
+	if err != nil {
+		return fmt.Errorf("Error encoding pickup state: %v", err)
+	}
+	if err := ramformats.WriteFileAtomic(lp.statePath, data); err != nil {
+		return fmt.Errorf("Error saving pickup state: %v", err)
+	}
+	return nil
+}
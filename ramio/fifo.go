@@ -0,0 +1,173 @@
+package ramio
+
+import (
+	"data_ram/ramstream"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// FIFOStream passes records through a named pipe, for hand-offs between processes
+// on one host. Records are length prefixed frames as on a TCP_DATA connection, but
+// a pipe has no return path so nothing is acknowledged and nacks are not
+// supported. Frames larger than PIPE_BUF are not written atomically, so only one
+// sender may write to a FIFO at a time.
+type FIFOStream struct {
+	Path           string
+	StreamType     string
+	InternalStream ramstream.RamStream
+	file           *os.File
+	created        bool           // The listener made the FIFO and removes it on Flush
+	stopped        bool           // Set by Flush, Listen returns rather than start
+	listenWg       sync.WaitGroup // Listen, waited for by Flush
+	mu             sync.Mutex     // Serialises writes so frames are not interleaved, and guards file, created and stopped
+}
+
+// Constructor for FIFOStream that sets the pipe path and stream type.
+func NewFIFOStream(path string, streamType string, internalStream ramstream.RamStream) *FIFOStream {
+	return &FIFOStream{
+		Path:           path,
+		StreamType:     streamType,
+		InternalStream: internalStream,
+	}
+}
+
+func (f *FIFOStream) Listen(bufferSize int) error {
+	if f.StreamType != ramstream.DROutputStream {
+		return fmt.Errorf("Cannot listen on input stream")
+	}
+	f.mu.Lock()
+	if f.stopped {
+		f.mu.Unlock()
+		return os.ErrClosed
+	}
+	f.listenWg.Add(1)
+	f.mu.Unlock()
+	defer f.listenWg.Done()
+
+	info, err := os.Stat(f.Path)
+	created := false
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := mkfifo(f.Path, 0600); err != nil {
+			return fmt.Errorf("Failed to create FIFO %s: %w", f.Path, err)
+		}
+		created = true
+	} else if err != nil {
+		return err
+	} else if info.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("%s exists and is not a FIFO", f.Path)
+	}
+	// Opened for writing as well so reads wait for the next sender rather than
+	// seeing EOF whenever no sender has the pipe open
+	file, err := os.OpenFile(f.Path, os.O_RDWR, 0)
+	if err != nil {
+		ramstream.Logln("Failed to listen on", f.Path)
+		return err
+	}
+	f.mu.Lock()
+	if f.stopped {
+		// Flush ran while the FIFO was being opened
+		f.mu.Unlock()
+		file.Close()
+		if created {
+			os.Remove(f.Path)
+		}
+		return os.ErrClosed
+	}
+	f.file, f.created = file, created
+	f.mu.Unlock()
+	ramstream.Logln("FIFO Listening on", f.Path)
+
+	for {
+		// bufferSize caps the frame so a bad length cannot exhaust memory
+		data, err := readFrame(file, bufferSize)
+		if err != nil {
+			// Also returned when Flush closes the pipe. Any other error leaves the
+			// reader part way through a frame with no way to find the next one
+			return err
+		}
+		if _, err := f.InternalStream.Write(data); err != nil {
+			ramstream.Logf("FIFO failed to write data frame: %v\n", err)
+		}
+	}
+}
+
+// connect opens the pipe for writing. The caller must hold f.mu.
+func (f *FIFOStream) connect() error {
+	if f.file != nil {
+		return nil
+	}
+	file, err := openFIFOWriter(f.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to open FIFO %s, is the listener running: %w", f.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		file.Close()
+		return fmt.Errorf("%s is not a FIFO", f.Path)
+	}
+	f.file = file
+	return nil
+}
+
+// Send writes a record as one frame. It returns once the frame is in the pipe.
+func (f *FIFOStream) Send(data []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.connect(); err != nil {
+		return 0, err
+	}
+	if err := writeFrame(f.file, data); err != nil {
+		// The listener went away, reopen on the next send
+		f.file.Close()
+		f.file = nil
+		return 0, fmt.Errorf("Failed to write to FIFO: %w", err)
+	}
+	return len(data), nil
+}
+
+func (f *FIFOStream) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("Read should not be called on FIFOStream")
+}
+
+func (f *FIFOStream) Write(p []byte) (int, error) {
+	if f.StreamType != ramstream.DROutputStream {
+		return 0, fmt.Errorf("Cannot write to input stream")
+	}
+	if f.InternalStream != nil {
+		return 0, fmt.Errorf("Internal stream should not be initialised for FIFO writing")
+	}
+	return f.Send(p)
+}
+
+func (f *FIFOStream) Reset() error {
+	f.InternalStream.Reset()
+	return nil
+}
+
+func (f *FIFOStream) Len() int {
+	return f.InternalStream.Len()
+}
+
+// Flush closes the pipe, stopping a listener and removing the FIFO if it made it,
+// and waits for Listen to return. A Listen that has not started yet returns
+// straight away.
+func (f *FIFOStream) Flush() error {
+	f.mu.Lock()
+	f.stopped = true
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	if f.created {
+		os.Remove(f.Path)
+		f.created = false
+	}
+	f.mu.Unlock()
+	f.listenWg.Wait()
+	return nil
+}
+
+var _ ramstream.RamStream = (*FIFOStream)(nil)
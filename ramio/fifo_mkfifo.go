@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package ramio
+
+import (
+	"os"
+	"syscall"
+)
+
+// mkfifo creates a named pipe at path.
+func mkfifo(path string, mode uint32) error {
+	return syscall.Mkfifo(path, mode)
+}
+
+// openFIFOWriter opens a pipe for writing. Non-blocking so a missing listener is
+// reported instead of waiting for one.
+func openFIFOWriter(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+}
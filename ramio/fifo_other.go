@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package ramio
+
+import (
+	"errors"
+	"os"
+)
+
+// mkfifo is not available on this system, FIFOStream can only use existing pipes.
+func mkfifo(path string, mode uint32) error {
+	return errors.ErrUnsupported
+}
+
+// openFIFOWriter opens a pipe for writing. There is no non-blocking open on this
+// system, so it waits for a listener.
+func openFIFOWriter(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY, 0)
+}
@@ -0,0 +1,89 @@
+package ramio
+
+import (
+	"data_ram/ramstream"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFIFOStream(t *testing.T) {
+	if err := mkfifo(filepath.Join(t.TempDir(), "probe"), 0600); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("FIFOs cannot be made on this system")
+	}
+	output := &recordingStream{}
+	path := filepath.Join(t.TempDir(), "dataram.fifo")
+
+	fifoSender := NewFIFOStream(path, ramstream.DROutputStream, nil)
+	if _, err := fifoSender.Write([]byte("early")); err == nil {
+		t.Fatal("Expected an error writing with no listener")
+	}
+
+	fifoListener := NewFIFOStream(path, ramstream.DROutputStream, output)
+	go fifoListener.Listen(1024 * 1024)
+	time.Sleep(100 * time.Millisecond)
+
+	records := [][]byte{testRecord(7, 1), testRecord(200000, 2), testRecord(3000, 3)}
+	for _, record := range records {
+		n, err := fifoSender.Write(record)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if n != len(record) {
+			t.Fatalf("Write length mismatch: got %d, want %d", n, len(record))
+		}
+	}
+	fifoSender.Flush()
+
+	// Nothing is acknowledged so wait for the records to arrive
+	deadline := time.Now().Add(2 * time.Second)
+	for len(output.Writes()) < len(records) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	writes := output.Writes()
+	if len(writes) != len(records) {
+		t.Fatalf("Expected %d records, got %d", len(records), len(writes))
+	}
+	for i, record := range records {
+		if writes[i] != string(record) {
+			t.Errorf("Record %d was not delivered intact", i)
+		}
+	}
+
+	fifoListener.Flush()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the FIFO the listener made to be removed on Flush, got %v", err)
+	}
+}
+
+// Flush stops Listen, even one that has not started yet, and waits for it
+func TestFIFOFlush(t *testing.T) {
+	if err := mkfifo(filepath.Join(t.TempDir(), "probe"), 0600); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("FIFOs cannot be made on this system")
+	}
+	path := filepath.Join(t.TempDir(), "dataram.fifo")
+	unstarted := NewFIFOStream(path, ramstream.DROutputStream, &recordingStream{})
+	unstarted.Flush()
+	if err := unstarted.Listen(1024); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected Listen after Flush to return os.ErrClosed, got %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no FIFO left behind, got %v", err)
+	}
+
+	fifoListener := NewFIFOStream(path, ramstream.DROutputStream, &recordingStream{})
+	listenDone := make(chan error, 1)
+	go func() { listenDone <- fifoListener.Listen(1024) }()
+	time.Sleep(100 * time.Millisecond)
+	fifoListener.Flush()
+	select {
+	case <-listenDone:
+	default:
+		t.Fatal("Listen was still running after Flush")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the FIFO to be removed, got %v", err)
+	}
+}
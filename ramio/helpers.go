@@ -1,15 +1,22 @@
 package ramio
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
 	"net"
+	"os"
 )
 
-// Helper to read a big-endian int64 from a connection
-func readInt64(conn net.Conn) (int64, error) {
+// Helper to read a big-endian int64 from a connection, waiting for all 8 bytes
+func readInt64(conn io.Reader) (int64, error) {
 	buf := make([]byte, 8)
-	_, err := conn.Read(buf)
-	if err != nil {
+	if _, err := io.ReadFull(conn, buf); err != nil {
 		return 0, err
 	}
 	val := int64(buf[0])<<56 | int64(buf[1])<<48 | int64(buf[2])<<40 | int64(buf[3])<<32 |
@@ -18,21 +25,160 @@ func readInt64(conn net.Conn) (int64, error) {
 }
 
 // Helper to write a big-endian int64 to a connection
-func writeInt64(conn net.Conn, val int64) error {
-	buf := []byte{
+func writeInt64(conn io.Writer, val int64) error {
+	_, err := conn.Write(int64Bytes(val))
+	return err
+}
+
+func int64Bytes(val int64) []byte {
+	return []byte{
 		byte(val >> 56), byte(val >> 48), byte(val >> 40), byte(val >> 32),
 		byte(val >> 24), byte(val >> 16), byte(val >> 8), byte(val),
 	}
-	_, err := conn.Write(buf)
+}
+
+// Helper to write an int64 length prefixed frame to a connection.
+// The length and data go out in a single write where the connection supports it.
+func writeFrame(conn io.Writer, data []byte) error {
+	buffers := net.Buffers{int64Bytes(int64(len(data))), data}
+	_, err := buffers.WriteTo(conn)
 	return err
 }
 
-// generateTLSConfig returns a self-signed TLS config for testing
-func generateTLSConfig(certIn []byte, keyIn []byte) *tls.Config {
-	// For demo purposes only: use a proper cert in production
+// Helper to read an int64 length prefixed frame of at most maxLen bytes from a connection
+func readFrame(conn io.Reader, maxLen int) ([]byte, error) {
+	frameLen, err := readInt64(conn)
+	if err != nil {
+		return nil, err
+	}
+	if frameLen < 0 || frameLen > int64(maxLen) {
+		return nil, fmt.Errorf("Frame of %d bytes exceeds limit of %d", frameLen, maxLen)
+	}
+	data := make([]byte, frameLen)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// generateTLSConfig builds a server TLS config from a PEM certificate and key held in memory
+func generateTLSConfig(certIn []byte, keyIn []byte) (*tls.Config, error) {
 	cert, err := tls.X509KeyPair(certIn, keyIn)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to load key pair: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// LoadServerTLSConfig builds a TLS config for a listener from its PEM certificate and key.
+// If clientCAFile is set, clients must present a certificate signed by one of its CAs (mTLS).
+func LoadServerTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key pair %s: %w", certFile, err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// LoadClientTLSConfig builds a TLS config for a sender that verifies the server against
+// the CAs in caFile, or the system roots if it is empty. certFile and keyFile are the
+// optional client certificate presented to listeners that require mTLS.
+func LoadClientTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client key pair %s: %w", certFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle %s: %w", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+	}
+	return pool, nil
+}
+
+// SPKIHash returns the base64 encoded SHA-256 of a certificate's SubjectPublicKeyInfo,
+// the form pins are given in.
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// SPKIHashPEM returns the SPKI hash of the first certificate in a PEM block.
+func SPKIHashPEM(certPEM []byte) (string, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("no certificate found in PEM data")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return SPKIHash(cert), nil
+}
+
+// ValidateSPKIPin checks a pin is a base64 encoded SHA-256 hash.
+func ValidateSPKIPin(pin string) error {
+	sum, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("pin %q is not a base64 encoded SHA-256 hash", pin)
+	}
+	return nil
+}
+
+// PinSPKI makes a client TLS config reject servers whose certificate key does not match
+// one of pins. If the config has no RootCAs the pin replaces chain verification, so a
+// self-signed certificate can be trusted by its key alone.
+func PinSPKI(config *tls.Config, pins []string) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	for _, pin := range pins {
+		if err := ValidateSPKIPin(pin); err != nil {
+			return err
+		}
+	}
+	if config.RootCAs == nil {
+		config.InsecureSkipVerify = true // VerifyConnection below still checks the key
+	}
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("server presented no certificate to check against pins")
+		}
+		hash := SPKIHash(state.PeerCertificates[0])
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(pin)) == 1 {
+				return nil
+			}
+		}
+		return fmt.Errorf("server certificate key %s does not match any pin", hash)
 	}
-	return &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
+	return nil
 }
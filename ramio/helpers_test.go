@@ -0,0 +1,44 @@
+package ramio
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadInt64ShortReads(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeInt64(&buf, 0x0102030405060708); err != nil {
+		t.Fatalf("writeInt64 failed: %v", err)
+	}
+	val, err := readInt64(iotest.OneByteReader(&buf))
+	if err != nil {
+		t.Fatalf("readInt64 failed: %v", err)
+	}
+	if val != 0x0102030405060708 {
+		t.Errorf("Expected %x, got %x", 0x0102030405060708, val)
+	}
+	if _, err := readInt64(bytes.NewReader([]byte{1, 2, 3})); err == nil {
+		t.Error("Expected error reading a truncated int64")
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, []byte("hello frame")); err != nil {
+		t.Fatalf("writeFrame failed: %v", err)
+	}
+	data, err := readFrame(iotest.HalfReader(&buf), 64)
+	if err != nil {
+		t.Fatalf("readFrame failed: %v", err)
+	}
+	if string(data) != "hello frame" {
+		t.Errorf("Unexpected frame %q", data)
+	}
+
+	buf.Reset()
+	writeFrame(&buf, make([]byte, 65))
+	if _, err := readFrame(&buf, 64); err == nil {
+		t.Error("Expected error for a frame over the limit")
+	}
+}
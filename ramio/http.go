@@ -0,0 +1,269 @@
+package ramio
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"data_ram/ramstream"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Paths served by NewHTTPHandler. Both take a POST with the request as the body.
+const (
+	HTTP_BUNDLE_PATH = "/dataram/bundle" // Body is one record, answered with the number of bytes written as an int64
+	HTTP_NACK_PATH   = "/dataram/nack"   // Body is a nack request, answered with the reply
+)
+
+const httpContentType = "application/octet-stream"
+
+// A request is given httpRequestTimeout, plus the time its body takes to send
+// at httpMinSendRate, before it is abandoned
+const (
+	httpRequestTimeout = 30 * time.Second
+	httpMinSendRate    = 64 * 1024 // Bytes per second
+)
+
+// HTTPStream sends records as HTTP POSTs, for networks that only let HTTP(S) out.
+// Each record is answered with the number of bytes the listener wrote, as on a TCP
+// connection. With a TLS config requests use HTTPS, and HTTP/2 when the server
+// offers it, and senders go through any proxy set in HTTPS_PROXY or HTTP_PROXY.
+// Writes may be made concurrently, requests share the client's connections.
+type HTTPStream struct {
+	Address        string // host:port
+	StreamType     string
+	InternalStream ramstream.RamStream
+	tlsConfig      *tls.Config // Requests use HTTPS when set
+	client         *http.Client
+	requestTimeout time.Duration // Allowed for each request on top of the time its body takes to send
+	server         *http.Server
+	stopped        bool           // Set by Flush, Listen returns rather than start
+	listenWg       sync.WaitGroup // Listen, waited for by Flush
+	mu             sync.Mutex     // Protects server and stopped
+}
+
+// Constructor for HTTPStream that sets the address and stream type. A nil tlsConfig
+// sends plain HTTP; listeners need one with a certificate for HTTPS, see
+// LoadServerTLSConfig, and senders one that can verify it, see LoadClientTLSConfig.
+func NewHTTPStream(address string, streamType string, internalStream ramstream.RamStream, tlsConfig *tls.Config) *HTTPStream {
+	return &HTTPStream{
+		Address:        address,
+		StreamType:     streamType,
+		InternalStream: internalStream,
+		tlsConfig:      tlsConfig,
+		requestTimeout: httpRequestTimeout,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			ForceAttemptHTTP2:   true, // Not negotiated by default with a custom TLS config
+			MaxIdleConnsPerHost: 64,
+			IdleConnTimeout:     90 * time.Second,
+		}},
+	}
+}
+
+// NewHTTPHandler serves HTTP_BUNDLE_PATH and HTTP_NACK_PATH, writing each record
+// received into internalStream. It can be mounted on an existing server with
+// mux.Handle("/dataram/", handler). maxBodyLen caps the size of a request.
+func NewHTTPHandler(internalStream ramstream.RamStream, maxBodyLen int) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+HTTP_BUNDLE_PATH, func(w http.ResponseWriter, r *http.Request) {
+		data, ok := readHTTPBody(w, r, maxBodyLen)
+		if !ok {
+			return
+		}
+		outN, err := internalStream.Write(data)
+		if err != nil {
+			ramstream.Logf("HTTP failed to write record: %v\n", err)
+		}
+		// Answered like a TCP_DATA frame, a short count tells the sender it failed
+		w.Header().Set("Content-Type", httpContentType)
+		writeInt64(w, int64(outN))
+	})
+	mux.HandleFunc("POST "+HTTP_NACK_PATH, func(w http.ResponseWriter, r *http.Request) {
+		request, ok := readHTTPBody(w, r, maxBodyLen)
+		if !ok {
+			return
+		}
+		reply := []byte{}
+		if handler, isHandler := internalStream.(ramstream.RamNackHandler); isHandler {
+			var err error
+			reply, err = handler.HandleNack(request)
+			if err != nil {
+				ramstream.Logf("HTTP failed to handle nack request: %v\n", err)
+				http.Error(w, "Failed to handle nack request", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", httpContentType)
+		w.Write(reply)
+	})
+	return mux
+}
+
+// readHTTPBody reads a request body of at most maxLen bytes, answering the request
+// with an error if it cannot.
+func readHTTPBody(w http.ResponseWriter, r *http.Request, maxLen int) ([]byte, bool) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxLen)))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Body exceeds limit of %d bytes", maxLen), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+		}
+		ramstream.Logf("HTTP failed to read request body: %v\n", err)
+		return nil, false
+	}
+	return data, true
+}
+
+func (h *HTTPStream) Listen(bufferSize int) error {
+	if h.StreamType != ramstream.DROutputStream {
+		return fmt.Errorf("Cannot listen on input stream")
+	}
+	h.mu.Lock()
+	if h.stopped {
+		h.mu.Unlock()
+		return http.ErrServerClosed
+	}
+	h.listenWg.Add(1)
+	h.mu.Unlock()
+	defer h.listenWg.Done()
+
+	ln, err := net.Listen("tcp", h.Address)
+	if err != nil {
+		ramstream.Logln("Failed to listen on", h.Address)
+		return err
+	}
+	server := &http.Server{
+		Handler:           NewHTTPHandler(h.InternalStream, bufferSize),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	h.mu.Lock()
+	if h.stopped {
+		// Flush ran while the listener was being opened
+		h.mu.Unlock()
+		ln.Close()
+		return http.ErrServerClosed
+	}
+	h.server = server
+	h.mu.Unlock()
+
+	if h.tlsConfig != nil {
+		ramstream.Logln("HTTPS Listening on", h.Address)
+		// ServeTLS offers HTTP/2 alongside HTTP/1.1
+		server.TLSConfig = h.tlsConfig.Clone()
+		return server.ServeTLS(ln, "", "")
+	}
+	ramstream.Logln("HTTP Listening on", h.Address)
+	return server.Serve(ln) // Returns http.ErrServerClosed once Flush is called
+}
+
+// url returns the URL of one of the listener's paths.
+func (h *HTTPStream) url(path string) string {
+	if h.tlsConfig != nil {
+		return "https://" + h.Address + path
+	}
+	return "http://" + h.Address + path
+}
+
+// post sends body to one of the listener's paths and returns the response body.
+// A listener that stops answering fails the request rather than holding it forever.
+func (h *HTTPStream) post(path string, body []byte, maxReplyLen int) ([]byte, error) {
+	timeout := h.requestTimeout + time.Duration(len(body)/httpMinSendRate)*time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url(path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", httpContentType)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP request to %s failed: %s", path, resp.Status)
+	}
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxReplyLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) > maxReplyLen {
+		return nil, fmt.Errorf("HTTP reply from %s exceeds limit of %d bytes", path, maxReplyLen)
+	}
+	return reply, nil
+}
+
+// Send posts a record and waits for the listener to answer with the bytes it wrote.
+func (h *HTTPStream) Send(data []byte) (int, error) {
+	reply, err := h.post(HTTP_BUNDLE_PATH, data, 8)
+	if err != nil {
+		return 0, err
+	}
+	respN, err := readInt64(bytes.NewReader(reply))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read response: %w", err)
+	}
+	if int(respN) != len(data) {
+		return 0, fmt.Errorf("Could not write over http stream: sent %d, got response %d", len(data), respN)
+	}
+	return len(data), nil
+}
+
+// Nack posts a resend request to the listener and returns its reply.
+func (h *HTTPStream) Nack(request []byte) ([]byte, error) {
+	reply, err := h.post(HTTP_NACK_PATH, request, maxNackReplyLen)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read nack reply: %w", err)
+	}
+	return reply, nil
+}
+
+func (h *HTTPStream) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("Read should not be called on HTTPStream")
+}
+
+func (h *HTTPStream) Write(p []byte) (int, error) {
+	if h.StreamType != ramstream.DROutputStream {
+		return 0, fmt.Errorf("Cannot write to input stream")
+	}
+	if h.InternalStream != nil {
+		return 0, fmt.Errorf("Internal stream should not be initialised for HTTP writing")
+	}
+	return h.Send(p)
+}
+
+func (h *HTTPStream) Reset() error {
+	h.InternalStream.Reset()
+	return nil
+}
+
+func (h *HTTPStream) Len() int {
+	return h.InternalStream.Len()
+}
+
+// Flush stops a listener, waiting for Listen to return, and closes a sender's
+// idle connections. A Listen that has not started yet returns straight away.
+func (h *HTTPStream) Flush() error {
+	h.mu.Lock()
+	h.stopped = true
+	if h.server != nil {
+		h.server.Close()
+		h.server = nil
+	}
+	h.mu.Unlock()
+	h.listenWg.Wait()
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+var _ ramstream.RamStream = (*HTTPStream)(nil)
+var _ ramstream.RamNackSender = (*HTTPStream)(nil)
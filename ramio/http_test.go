@@ -0,0 +1,189 @@
+package ramio
+
+import (
+	"data_ram/ramstream"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingStream refuses every write
+type failingStream struct {
+	recordingStream
+}
+
+func (f *failingStream) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("disk full")
+}
+
+func TestHTTPStream(t *testing.T) {
+	output := &nackRecordingStream{}
+	address := "127.0.0.1:9109"
+	httpListener := NewHTTPStream(address, ramstream.DROutputStream, output, nil)
+	go httpListener.Listen(1024 * 1024)
+	defer httpListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	httpSender := NewHTTPStream(address, ramstream.DROutputStream, nil, nil)
+	defer httpSender.Flush()
+	records := [][]byte{testRecord(7, 1), testRecord(200000, 2)}
+	for _, record := range records {
+		n, err := httpSender.Write(record)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if n != len(record) {
+			t.Fatalf("Write length mismatch: got %d, want %d", n, len(record))
+		}
+	}
+	writes := output.Writes()
+	if len(writes) != len(records) {
+		t.Fatalf("Expected %d records, got %d", len(records), len(writes))
+	}
+	for i, record := range records {
+		if writes[i] != string(record) {
+			t.Errorf("Record %d was not delivered intact", i)
+		}
+	}
+
+	reply, err := httpSender.Nack([]byte("abc"))
+	if err != nil || string(reply) != "missing:abc" {
+		t.Errorf("Unexpected nack reply %q, err %v", reply, err)
+	}
+
+	if _, err := httpSender.Write(testRecord(2*1024*1024, 3)); err == nil {
+		t.Error("Expected a record over the buffer size to be refused")
+	}
+}
+
+func TestHTTPStreamShortWrite(t *testing.T) {
+	handler := NewHTTPHandler(&failingStream{}, 1024)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	httpSender := NewHTTPStream(server.Listener.Addr().String(), ramstream.DROutputStream, nil, nil)
+	if _, err := httpSender.Write([]byte("record")); err == nil {
+		t.Error("Expected a failed write on the listener to fail the send")
+	}
+	// A sink that cannot answer nacks replies with nothing
+	reply, err := httpSender.Nack([]byte("abc"))
+	if err != nil || len(reply) != 0 {
+		t.Errorf("Expected an empty nack reply, got %q, err %v", reply, err)
+	}
+}
+
+// Flush stops Listen, even one that has not started yet, and waits for it
+func TestHTTPFlush(t *testing.T) {
+	unstarted := NewHTTPStream("127.0.0.1:9126", ramstream.DROutputStream, &recordingStream{}, nil)
+	unstarted.Flush()
+	if err := unstarted.Listen(1024); !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Expected Listen after Flush to return http.ErrServerClosed, got %v", err)
+	}
+
+	httpListener := NewHTTPStream("127.0.0.1:9126", ramstream.DROutputStream, &recordingStream{}, nil)
+	listenDone := make(chan error, 1)
+	go func() { listenDone <- httpListener.Listen(1024) }()
+	time.Sleep(100 * time.Millisecond)
+	httpListener.Flush()
+	select {
+	case <-listenDone:
+	default:
+		t.Fatal("Listen was still running after Flush")
+	}
+	// The port was released
+	ln, err := net.Listen("tcp", "127.0.0.1:9126")
+	if err != nil {
+		t.Fatalf("Port still in use after Flush: %v", err)
+	}
+	ln.Close()
+}
+
+// A listener that never answers fails the send once its timeout passes
+func TestHTTPStreamTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	httpSender := NewHTTPStream(server.Listener.Addr().String(), ramstream.DROutputStream, nil, nil)
+	httpSender.requestTimeout = 200 * time.Millisecond
+	start := time.Now()
+	if _, err := httpSender.Write([]byte("record")); err == nil {
+		t.Error("Expected a send to a listener that never answers to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send took %v to time out", elapsed)
+	}
+}
+
+func TestHTTPSStream(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, "server")
+	otherCert, _ := writeTestCert(t, "other")
+	serverConfig, err := LoadServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("LoadServerTLSConfig failed: %v", err)
+	}
+	trusted, err := LoadClientTLSConfig(certFile, "", "")
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+	untrusted, err := LoadClientTLSConfig(otherCert, "", "")
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+
+	t.Run("listener", func(t *testing.T) {
+		output := &recordingStream{}
+		address := "127.0.0.1:9120"
+		httpsListener := NewHTTPStream(address, ramstream.DROutputStream, output, serverConfig)
+		go httpsListener.Listen(1024 * 1024)
+		defer httpsListener.Flush()
+		time.Sleep(100 * time.Millisecond)
+
+		if _, err := NewHTTPStream(address, ramstream.DROutputStream, nil, trusted).Write([]byte("record")); err != nil {
+			t.Fatalf("Write over HTTPS failed: %v", err)
+		}
+		if _, err := NewHTTPStream(address, ramstream.DROutputStream, nil, untrusted).Write([]byte("x")); err == nil {
+			t.Error("Expected certificate verification to fail")
+		}
+		if writes := output.Writes(); len(writes) != 1 || writes[0] != "record" {
+			t.Errorf("Unexpected writes %q", writes)
+		}
+	})
+
+	t.Run("embedded", func(t *testing.T) {
+		// Mounted on a server of its own, which negotiates HTTP/2
+		output := &recordingStream{}
+		var proto atomic.Int32
+		mux := http.NewServeMux()
+		handler := NewHTTPHandler(output, 1024*1024)
+		mux.HandleFunc("/dataram/", func(w http.ResponseWriter, r *http.Request) {
+			proto.Store(int32(r.ProtoMajor))
+			handler.ServeHTTP(w, r)
+		})
+		server := httptest.NewUnstartedServer(mux)
+		server.EnableHTTP2 = true
+		server.TLS = serverConfig.Clone()
+		server.StartTLS()
+		defer server.Close()
+
+		httpsSender := NewHTTPStream(server.Listener.Addr().String(), ramstream.DROutputStream, nil, trusted)
+		defer httpsSender.Flush()
+		if _, err := httpsSender.Write([]byte("record")); err != nil {
+			t.Fatalf("Write over HTTPS failed: %v", err)
+		}
+		if proto.Load() != 2 {
+			t.Errorf("Expected the request over HTTP/2, got HTTP/%d", proto.Load())
+		}
+		if writes := output.Writes(); len(writes) != 1 || writes[0] != "record" {
+			t.Errorf("Unexpected writes %q", writes)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package ramio
+
+import (
+	"data_ram/ramstream"
+	"fmt"
+)
+
+// ParallelStream stripes writes across several sender streams, each with its
+// own connection. Write is safe to call from multiple goroutines: each call
+// takes an idle stream, blocks until that stream's write is acknowledged and
+// hands the stream back, so up to len(streams) writes are in flight at once.
+type ParallelStream struct {
+	StreamType string
+	streams    []ramstream.RamStream
+	idle       chan ramstream.RamStream
+}
+
+// Constructor for ParallelStream over already created sender streams.
+func NewParallelStream(streamType string, streams ...ramstream.RamStream) *ParallelStream {
+	p := &ParallelStream{
+		StreamType: streamType,
+		streams:    streams,
+		idle:       make(chan ramstream.RamStream, len(streams)),
+	}
+	for _, stream := range streams {
+		p.idle <- stream
+	}
+	return p
+}
+
+// Connections returns how many writes can be in flight at once.
+func (p *ParallelStream) Connections() int {
+	return len(p.streams)
+}
+
+func (p *ParallelStream) Write(data []byte) (int, error) {
+	if p.StreamType != ramstream.DROutputStream {
+		return 0, fmt.Errorf("Cannot write to input stream")
+	}
+	if len(p.streams) == 0 {
+		return 0, fmt.Errorf("Parallel stream has no streams to write to")
+	}
+	stream := <-p.idle
+	defer func() { p.idle <- stream }()
+	return stream.Write(data)
+}
+
+// Nack sends a resend request over one of the streams.
+func (p *ParallelStream) Nack(request []byte) ([]byte, error) {
+	if len(p.streams) == 0 {
+		return nil, fmt.Errorf("Parallel stream has no streams to write to")
+	}
+	stream := <-p.idle
+	defer func() { p.idle <- stream }()
+	nacker, ok := stream.(ramstream.RamNackSender)
+	if !ok {
+		return []byte{}, nil // Receiver cannot be asked, see RamNackSender
+	}
+	return nacker.Nack(request)
+}
+
+func (p *ParallelStream) Read(b []byte) (int, error) {
+	return 0, fmt.Errorf("Read should not be called on ParallelStream")
+}
+
+func (p *ParallelStream) Reset() error {
+	return nil
+}
+
+func (p *ParallelStream) Len() int {
+	return 0
+}
+
+func (p *ParallelStream) Flush() error {
+	var firstErr error
+	for _, stream := range p.streams {
+		if err := stream.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+var _ ramstream.RamStream = (*ParallelStream)(nil)
+var _ ramstream.RamNackSender = (*ParallelStream)(nil)
@@ -0,0 +1,91 @@
+package ramio
+
+import (
+	"data_ram/ramstream"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingStream keeps every write separately and is safe for concurrent use
+type recordingStream struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (r *recordingStream) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes = append(r.writes, string(p))
+	return len(p), nil
+}
+
+// Writes returns a copy of everything written so far
+func (r *recordingStream) Writes() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.writes...)
+}
+
+func (r *recordingStream) Read(p []byte) (int, error) { return 0, fmt.Errorf("not readable") }
+func (r *recordingStream) Reset() error               { return nil }
+func (r *recordingStream) Len() int                   { return 0 }
+func (r *recordingStream) Flush() error               { return nil }
+
+func TestParallelTCPStream(t *testing.T) {
+	output := &recordingStream{}
+	address := "127.0.0.1:9103"
+	tcpListener := NewTCPStream(address, ramstream.DROutputStream, output)
+	go tcpListener.Listen(1024)
+	defer tcpListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	senders := make([]ramstream.RamStream, 3)
+	for i := range senders {
+		senders[i] = NewTCPStream(address, ramstream.DROutputStream, nil)
+	}
+	parallel := NewParallelStream(ramstream.DROutputStream, senders...)
+	if parallel.Connections() != 3 {
+		t.Fatalf("Expected 3 connections, got %d", parallel.Connections())
+	}
+
+	want := make([]string, 30)
+	var wg sync.WaitGroup
+	for i := range want {
+		want[i] = fmt.Sprintf("record-%02d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := parallel.Write([]byte(want[i])); err != nil {
+				t.Errorf("Write failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every sender opened its own connection
+	for i, s := range senders {
+		if s.(*TCPStream).tcpCon == nil {
+			t.Errorf("Sender %d never connected", i)
+		}
+	}
+	got := output.Writes()
+	sort.Strings(got)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d records, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Record %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestParallelStreamNoStreams(t *testing.T) {
+	parallel := NewParallelStream(ramstream.DROutputStream)
+	if _, err := parallel.Write([]byte("data")); err == nil {
+		t.Error("Expected error writing without streams")
+	}
+}
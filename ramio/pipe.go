@@ -0,0 +1,116 @@
+package ramio
+
+import (
+	"data_ram/ramstream"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// PipeStream carries records over a plain byte stream, such as stdin and stdout,
+// so bundles can be piped through ssh or netcat style tools:
+//
+//	dataram send -transport stdio ... | ssh host dataram receive -listen-transport stdio ...
+//
+// Records are length prefixed frames as on a TCP_DATA connection. There is no
+// return path so nothing is acknowledged and nacks are not supported.
+type PipeStream struct {
+	StreamType     string
+	InternalStream ramstream.RamStream
+	reader         io.Reader
+	writer         io.Writer
+	mu             sync.Mutex // Serialises writes so frames are not interleaved
+}
+
+// Constructor for a PipeStream that listens on reader and sends on writer.
+func NewPipeStream(reader io.Reader, writer io.Writer, streamType string, internalStream ramstream.RamStream) *PipeStream {
+	return &PipeStream{
+		StreamType:     streamType,
+		InternalStream: internalStream,
+		reader:         reader,
+		writer:         writer,
+	}
+}
+
+// Constructor for a PipeStream that listens on stdin and sends on stdout, normally
+// os.Stdout, which a listener may leave nil. Programs sending on it should point the log elsewhere with
+// ramstream.SetLogOutput so nothing logged lands in the middle of the records.
+func NewStdioStream(stdout io.Writer, streamType string, internalStream ramstream.RamStream) *PipeStream {
+	return NewPipeStream(os.Stdin, stdout, streamType, internalStream)
+}
+
+// Listen reads records until the end of the stream, when it returns nil.
+func (p *PipeStream) Listen(bufferSize int) error {
+	if p.StreamType != ramstream.DROutputStream {
+		return fmt.Errorf("Cannot listen on input stream")
+	}
+	if p.reader == nil {
+		return fmt.Errorf("Pipe stream has nothing to read from")
+	}
+	for {
+		// bufferSize caps the frame so a bad length cannot exhaust memory
+		data, err := readFrame(p.reader, bufferSize)
+		if errors.Is(err, io.EOF) {
+			ramstream.Logln("Pipe stream ended")
+			return nil
+		}
+		if err != nil {
+			// Nothing marks where the next frame starts, so the rest of the stream is lost
+			return fmt.Errorf("Failed to read pipe frame: %w", err)
+		}
+		if _, err := p.InternalStream.Write(data); err != nil {
+			ramstream.Logf("Pipe failed to write data frame: %v\n", err)
+		}
+	}
+}
+
+// Send writes a record as one frame.
+func (p *PipeStream) Send(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.writer == nil {
+		return 0, fmt.Errorf("Pipe stream has nothing to write to")
+	}
+	if err := writeFrame(p.writer, data); err != nil {
+		return 0, fmt.Errorf("Failed to write to pipe: %w", err)
+	}
+	return len(data), nil
+}
+
+func (p *PipeStream) Read(b []byte) (int, error) {
+	return 0, fmt.Errorf("Read should not be called on PipeStream")
+}
+
+func (p *PipeStream) Write(b []byte) (int, error) {
+	if p.StreamType != ramstream.DROutputStream {
+		return 0, fmt.Errorf("Cannot write to input stream")
+	}
+	if p.InternalStream != nil {
+		return 0, fmt.Errorf("Internal stream should not be initialised for pipe writing")
+	}
+	return p.Send(b)
+}
+
+func (p *PipeStream) Reset() error {
+	p.InternalStream.Reset()
+	return nil
+}
+
+func (p *PipeStream) Len() int {
+	return p.InternalStream.Len()
+}
+
+// Flush flushes a buffered writer. The reader and writer are left open, they
+// belong to whoever made the stream.
+func (p *PipeStream) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f, ok := p.writer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+var _ ramstream.RamStream = (*PipeStream)(nil)
@@ -0,0 +1,54 @@
+package ramio
+
+import (
+	"bytes"
+	"data_ram/ramstream"
+	"testing"
+)
+
+func TestPipeStream(t *testing.T) {
+	var pipe bytes.Buffer
+	sender := NewPipeStream(nil, &pipe, ramstream.DROutputStream, nil)
+	records := [][]byte{testRecord(7, 1), testRecord(200000, 2), testRecord(3000, 3)}
+	for _, record := range records {
+		n, err := sender.Write(record)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if n != len(record) {
+			t.Fatalf("Write length mismatch: got %d, want %d", n, len(record))
+		}
+	}
+	stream := pipe.Bytes()
+
+	output := &recordingStream{}
+	listener := NewPipeStream(bytes.NewReader(stream), nil, ramstream.DROutputStream, output)
+	if err := listener.Listen(1024 * 1024); err != nil {
+		t.Fatalf("Listen should end cleanly at the end of the stream, got %v", err)
+	}
+	writes := output.Writes()
+	if len(writes) != len(records) {
+		t.Fatalf("Expected %d records, got %d", len(records), len(writes))
+	}
+	for i, record := range records {
+		if writes[i] != string(record) {
+			t.Errorf("Record %d was not delivered intact", i)
+		}
+	}
+
+	// A stream cut off part way through a frame is an error
+	output = &recordingStream{}
+	listener = NewPipeStream(bytes.NewReader(stream[:len(stream)-10]), nil, ramstream.DROutputStream, output)
+	if err := listener.Listen(1024 * 1024); err == nil {
+		t.Error("Expected an error for a truncated stream")
+	}
+	if len(output.Writes()) != len(records)-1 {
+		t.Errorf("Expected the records before the cut to be delivered, got %d", len(output.Writes()))
+	}
+
+	// Frames over the buffer size are refused
+	listener = NewPipeStream(bytes.NewReader(stream), nil, ramstream.DROutputStream, &recordingStream{})
+	if err := listener.Listen(1024); err == nil {
+		t.Error("Expected an error for a frame over the buffer size")
+	}
+}
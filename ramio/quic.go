@@ -3,18 +3,52 @@ package ramio
 import (
 	"context"
 	"crypto/tls"
+	"data_ram/ramformats"
 	"data_ram/ramstream"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
 
 	quic "github.com/quic-go/quic-go"
 )
 
+// Every QUIC stream starts with one of these, like the TCP headers
+const (
+	QUIC_DATA = 2 // Followed by a length prefixed bundle, answered with the number of bytes written, or the negated limit if the bundle is too large
+	QUIC_NACK = 4 // Length prefixed resend request, answered with a length prefixed reply
+)
+
+// Largest chunkSize whose data records fit in a QUIC datagram, which holds a bit
+// over 1 KB, alongside their record and segment headers
+const QUIC_DATAGRAM_CHUNK_SIZE = 1000
+
+// Keeps an idle sender session open between pulses
+const quicKeepAlivePeriod = 10 * time.Second
+
 // QUICStream implements a stream over QUIC with similar API to TCPStream.
+// A sender keeps one connection open and sends each bundle on its own stream, so
+// Write may be called from several goroutines to push bundles concurrently.
+//
+// In datagram mode data records are sent as unreliable QUIC datagrams instead.
+// Metadata records, and records too large for a datagram, still go on streams.
+// Lost datagrams are not retransmitted by QUIC; the sender finds them through
+// Nack, see ramstream.RamNackSender, and resends them. Listeners always accept
+// datagrams.
 type QUICStream struct {
 	Address        string
 	StreamType     string
 	InternalStream ramstream.RamStream
 	tlsConfig      *tls.Config
+	listener       *quic.Listener
+	conn           *quic.Conn
+	accepted       map[*quic.Conn]struct{} // Listener connections, closed by Flush
+	stopped        bool                    // Set by Flush, Listen returns rather than start
+	connMu         sync.Mutex              // Guards conn while it is dialled or replaced, listener, accepted and stopped
+	listenWg       sync.WaitGroup          // Listen and its connection handlers, waited for by Flush
+	datagrams      bool                    // Send data records as datagrams
 }
 
 func NewQUICStream(address string, streamType string, internalStream ramstream.RamStream,
@@ -27,60 +61,270 @@ func NewQUICStream(address string, streamType string, internalStream ramstream.R
 	}
 }
 
+// Constructor for a sending QUICStream in datagram mode.
+func NewQUICDatagramStream(address string, streamType string, internalStream ramstream.RamStream,
+	tlsConfigIn *tls.Config) *QUICStream {
+	q := NewQUICStream(address, streamType, internalStream, tlsConfigIn)
+	q.datagrams = true
+	return q
+}
+
 func (q *QUICStream) Listen(bufferSize int) error {
 	if q.StreamType != ramstream.DROutputStream {
 		return fmt.Errorf("Cannot listen on input stream")
 	}
-	listener, err := quic.ListenAddr(q.Address, q.tlsConfig, nil)
+	q.connMu.Lock()
+	if q.stopped {
+		q.connMu.Unlock()
+		return net.ErrClosed
+	}
+	q.listenWg.Add(1)
+	q.connMu.Unlock()
+	defer q.listenWg.Done()
+
+	listener, err := quic.ListenAddr(q.Address, q.tlsConfig, &quic.Config{EnableDatagrams: true})
 	if err != nil {
 		return err
 	}
+	q.connMu.Lock()
+	if q.stopped {
+		// Flush ran while the listener was being opened
+		q.connMu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	q.listener = listener
+	q.connMu.Unlock()
 
-	fmt.Println("QUIC Listening on", q.Address)
+	ramstream.Logln("QUIC Listening on", q.Address)
 	for {
-		sess, err := listener.Accept(context.Background())
+		conn, err := listener.Accept(context.Background())
 		if err != nil {
 			return err
 		}
-		go func(session *quic.Conn) {
-			stream, err := session.AcceptStream(context.Background())
-			if err != nil {
+		q.connMu.Lock()
+		if q.stopped {
+			q.connMu.Unlock()
+			conn.CloseWithError(0, "")
+			return net.ErrClosed
+		}
+		if q.accepted == nil {
+			q.accepted = make(map[*quic.Conn]struct{})
+		}
+		q.accepted[conn] = struct{}{}
+		q.listenWg.Add(1)
+		q.connMu.Unlock()
+		go q.handleConn(conn, bufferSize)
+	}
+}
+
+// handleConn accepts streams on a connection until it closes, handling each concurrently.
+// The handlers it starts are counted in listenWg so Flush waits for them too.
+func (q *QUICStream) handleConn(conn *quic.Conn, bufferSize int) {
+	defer q.listenWg.Done()
+	defer func() {
+		q.connMu.Lock()
+		delete(q.accepted, conn)
+		q.connMu.Unlock()
+	}()
+	q.listenWg.Add(1)
+	go func() {
+		defer q.listenWg.Done()
+		q.receiveDatagrams(conn)
+	}()
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return // Connection closed
+		}
+		q.listenWg.Add(1)
+		go func() {
+			defer q.listenWg.Done()
+			q.handleStream(stream, bufferSize)
+		}()
+	}
+}
+
+// receiveDatagrams writes each datagram received on a connection to the internal stream.
+// Records that fail are dropped like lost datagrams and recovered by the sender's nack.
+func (q *QUICStream) receiveDatagrams(conn *quic.Conn) {
+	for {
+		data, err := conn.ReceiveDatagram(conn.Context())
+		if err != nil {
+			return // Connection closed
+		}
+		if _, err := q.InternalStream.Write(data); err != nil {
+			ramstream.Logf("QUIC failed to write datagram: %v\n", err)
+		}
+	}
+}
+
+func (q *QUICStream) handleStream(stream *quic.Stream, bufferSize int) {
+	defer stream.Close()
+	streamType, err := readInt64(stream)
+	if err != nil {
+		ramstream.Logf("QUIC read failed: %v\n", err)
+		return
+	}
+	switch streamType {
+	case QUIC_DATA:
+		// bufferSize caps the frame so a bad length cannot exhaust memory
+		frameLen, err := readInt64(stream)
+		if err != nil || frameLen < 0 {
+			ramstream.Logf("QUIC failed to read data frame length %d: %v\n", frameLen, err)
+			stream.CancelRead(0)
+			return
+		}
+		if frameLen > int64(bufferSize) {
+			// Answered with the negated limit as on a TCP connection, the frame is
+			// read through first so the sender's write completes and it sees the reply
+			ramstream.Logf("QUIC data frame of %d bytes exceeds buffer size of %d, refusing it\n", frameLen, bufferSize)
+			if _, err := io.CopyN(io.Discard, stream, frameLen); err != nil {
+				stream.CancelRead(0)
 				return
 			}
-			buf := make([]byte, bufferSize)
-			n, err := stream.Read(buf)
-			if err == nil && n > 0 {
-				outN, _ := q.InternalStream.Write(buf[:n])
-				stream.Write([]byte(fmt.Sprintf("%d", outN)))
+			writeInt64(stream, -int64(bufferSize))
+			return
+		}
+		data := make([]byte, frameLen)
+		if _, err := io.ReadFull(stream, data); err != nil {
+			ramstream.Logf("QUIC failed to read data frame: %v\n", err)
+			stream.CancelRead(0)
+			return
+		}
+		outN, err := q.InternalStream.Write(data)
+		if err != nil {
+			ramstream.Logf("QUIC failed to write data frame: %v\n", err)
+		}
+		writeInt64(stream, int64(outN))
+	case QUIC_NACK:
+		request, err := readFrame(stream, bufferSize)
+		if err != nil {
+			ramstream.Logf("QUIC failed to read nack request: %v\n", err)
+			stream.CancelRead(0)
+			return
+		}
+		reply := []byte{}
+		if handler, ok := q.InternalStream.(ramstream.RamNackHandler); ok {
+			reply, err = handler.HandleNack(request)
+			if err != nil {
+				ramstream.Logf("QUIC failed to handle nack request: %v\n", err)
+				stream.CancelWrite(0)
+				return
 			}
-		}(sess)
+		}
+		writeFrame(stream, reply)
+	default:
+		ramstream.Logf("Unknown QUIC stream type: %d\n", streamType)
+		stream.CancelRead(0)
+	}
+}
+
+// connect returns the open connection, dialling a new one if there is none or it has closed.
+func (q *QUICStream) connect() (*quic.Conn, error) {
+	q.connMu.Lock()
+	defer q.connMu.Unlock()
+	if q.conn != nil && q.conn.Context().Err() == nil {
+		return q.conn, nil
+	}
+	quicConfig := &quic.Config{KeepAlivePeriod: quicKeepAlivePeriod, EnableDatagrams: q.datagrams}
+	conn, err := quic.DialAddr(context.Background(), q.Address, q.tlsConfig, quicConfig)
+	if err != nil {
+		ramstream.Logf("QUIC dial failed: %v\n", err)
+		return nil, err
 	}
+	q.conn = conn
+	return conn, nil
+}
+
+// openStream opens a stream for one request and writes its type header.
+func (q *QUICStream) openStream(streamType int64) (*quic.Stream, error) {
+	conn, err := q.connect()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open QUIC stream: %w", err)
+	}
+	if err := writeInt64(stream, streamType); err != nil {
+		stream.CancelWrite(0)
+		return nil, err
+	}
+	return stream, nil
 }
 
 func (q *QUICStream) Send(data []byte) (int, error) {
-	sess, err := quic.DialAddr(context.Background(), q.Address, q.tlsConfig, nil)
+	if q.datagrams {
+		if sent, err := q.sendDatagram(data); sent || err != nil {
+			return len(data), err
+		}
+	}
+	stream, err := q.openStream(QUIC_DATA)
 	if err != nil {
 		return 0, err
 	}
-	streamSend, err := sess.OpenStreamSync(context.Background())
-	n, err := streamSend.Write(data)
-	if err != nil {
-		return n, err
+	if err := writeFrame(stream, data); err != nil {
+		stream.CancelWrite(0)
+		return 0, err
 	}
-	resp := make([]byte, 16)
-	respN, err := streamSend.Read(resp)
+	stream.Close() // Nothing more to send, the response is still read
+	n := len(data)
+	outN, err := readInt64(stream)
 	if err != nil {
-		return n, fmt.Errorf("Failed to read response: %w", err)
+		return 0, fmt.Errorf("Failed to read response: %w", err)
 	}
-	// Parse response as int
-	var outN int
-	fmt.Sscanf(string(resp[:respN]), "%d", &outN)
-	if outN != n {
-		return n, fmt.Errorf("Could not write over quic stream: sent %d, got response %d", n, outN)
+	if outN < 0 {
+		return 0, fmt.Errorf("%w: sent %d bytes, listener accepts at most %d, lower chunkSize or raise the listener's bufferSize", ErrFrameTooLarge, n, -outN)
+	}
+	if int(outN) != n {
+		return 0, fmt.Errorf("Could not write over quic stream: sent %d, got response %d", n, outN)
 	}
 	return n, nil
 }
 
+// sendDatagram sends a data record as a datagram. It reports false, without an error,
+// for records that should go on a stream instead.
+func (q *QUICStream) sendDatagram(data []byte) (bool, error) {
+	recordType, err := ramformats.PeekRecordType(data)
+	if err != nil || recordType == ramformats.METADATA_HEADER {
+		return false, nil
+	}
+	conn, err := q.connect()
+	if err != nil {
+		return false, err
+	}
+	if err := conn.SendDatagram(data); err != nil {
+		// Too large for a datagram or the listener does not support them
+		var tooLarge *quic.DatagramTooLargeError
+		if errors.As(err, &tooLarge) {
+			ramstream.Logf("QUIC record of %d bytes exceeds the datagram limit of %d, sending it on a stream\n", len(data), tooLarge.MaxDatagramPayloadSize)
+		} else {
+			ramstream.Logf("QUIC datagram failed, sending the record on a stream: %v\n", err)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// Nack sends a resend request to the listener on its own stream and returns the reply.
+func (q *QUICStream) Nack(request []byte) ([]byte, error) {
+	stream, err := q.openStream(QUIC_NACK)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(stream, request); err != nil {
+		stream.CancelWrite(0)
+		return nil, err
+	}
+	stream.Close()
+	reply, err := readFrame(stream, maxNackReplyLen)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read nack reply: %w", err)
+	}
+	return reply, nil
+}
+
 func (q *QUICStream) Read(p []byte) (int, error) {
 	return 0, fmt.Errorf("Read should not be called on QUICStream")
 }
@@ -104,8 +348,26 @@ func (q *QUICStream) Len() int {
 	return q.InternalStream.Len()
 }
 
+// Flush closes the listener and the connections it accepted, or a sender's connection,
+// and waits for Listen and the connection handlers to return.
 func (q *QUICStream) Flush() error {
+	q.connMu.Lock()
+	q.stopped = true
+	if q.listener != nil {
+		q.listener.Close()
+		q.listener = nil
+	}
+	for conn := range q.accepted {
+		conn.CloseWithError(0, "")
+	}
+	if q.conn != nil {
+		q.conn.CloseWithError(0, "")
+		q.conn = nil
+	}
+	q.connMu.Unlock()
+	q.listenWg.Wait()
 	return nil
 }
 
 var _ ramstream.RamStream = (*QUICStream)(nil)
+var _ ramstream.RamNackSender = (*QUICStream)(nil)
@@ -1,8 +1,14 @@
 package ramio
 
 import (
+	"crypto/tls"
+	"data_ram/ramformats"
 	"data_ram/ramstream"
+	"errors"
+	"fmt"
 	"os"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 )
@@ -23,16 +29,27 @@ func TestQUICStreamWithDummyStreams(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to read key.pem: %v", err)
 	}
-	tlsConfig := generateTLSConfig(certPEM, keyPEM)
+	serverConfig, err := generateTLSConfig(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("generateTLSConfig failed: %v", err)
+	}
+	// The sender trusts the self-signed test cert, which is issued for localhost
+	clientConfig, err := LoadClientTLSConfig("../tools/cert.pem", "", "")
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+	clientConfig.ServerName = "localhost"
 
 	// Wrap DummyStreams with TCPStream for testing
 	address := "127.0.0.1:45454"
-	quicSender := NewQUICStream(address, ramstream.DROutputStream, nil, tlsConfig)
-	quicListener := NewQUICStream(address, ramstream.DROutputStream, output, tlsConfig)
+	quicSender := NewQUICStream(address, ramstream.DROutputStream, nil, clientConfig)
+	quicListener := NewQUICStream(address, ramstream.DROutputStream, output, serverConfig)
 
 	input.SubStream = quicSender
 
 	go quicListener.Listen(1024)
+	defer quicListener.Flush()
+	defer quicSender.Flush()
 
 	// wait for listener to start
 	time.Sleep(100 * time.Millisecond)
@@ -53,3 +70,277 @@ func TestQUICStreamWithDummyStreams(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateTLSConfigBadKeyPair(t *testing.T) {
+	if _, err := generateTLSConfig([]byte("not a cert"), []byte("not a key")); err == nil {
+		t.Error("Expected error for a bad key pair")
+	}
+}
+
+func TestQUICStreamVerification(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, "server")
+	otherCert, _ := writeTestCert(t, "other")
+	serverConfig, err := LoadServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("LoadServerTLSConfig failed: %v", err)
+	}
+	output := &recordingStream{}
+	address := "127.0.0.1:45455"
+	quicListener := NewQUICStream(address, ramstream.DROutputStream, output, serverConfig)
+	go quicListener.Listen(1024)
+	defer quicListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin, err := SPKIHashPEM(certPEM)
+	if err != nil {
+		t.Fatalf("SPKIHashPEM failed: %v", err)
+	}
+	otherPEM, err := os.ReadFile(otherCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPin, err := SPKIHashPEM(otherPEM)
+	if err != nil {
+		t.Fatalf("SPKIHashPEM failed: %v", err)
+	}
+
+	cases := map[string]struct {
+		caFile string
+		pins   []string
+		ok     bool
+	}{
+		"trusted CA":            {caFile: certFile, ok: true},
+		"untrusted CA":          {caFile: otherCert, ok: false},
+		"system roots":          {ok: false},
+		"pin alone":             {pins: []string{otherPin, pin}, ok: true},
+		"wrong pin":             {pins: []string{otherPin}, ok: false},
+		"trusted CA wrong pin":  {caFile: certFile, pins: []string{otherPin}, ok: false},
+		"trusted CA and pinned": {caFile: certFile, pins: []string{pin}, ok: true},
+	}
+	for name, tc := range cases {
+		clientConfig, err := LoadClientTLSConfig(tc.caFile, "", "")
+		if err != nil {
+			t.Fatalf("%s: LoadClientTLSConfig failed: %v", name, err)
+		}
+		if err := PinSPKI(clientConfig, tc.pins); err != nil {
+			t.Fatalf("%s: PinSPKI failed: %v", name, err)
+		}
+		_, err = NewQUICStream(address, ramstream.DROutputStream, nil, clientConfig).Write([]byte(name))
+		if tc.ok && err != nil {
+			t.Errorf("%s: expected write to succeed, got %v", name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: expected write to be refused", name)
+		}
+	}
+}
+
+func TestPinSPKIRejectsBadPins(t *testing.T) {
+	if err := PinSPKI(&tls.Config{}, []string{"not base64!"}); err == nil {
+		t.Error("Expected error for a pin that is not base64")
+	}
+	if err := PinSPKI(&tls.Config{}, []string{"c2hvcnQ="}); err == nil {
+		t.Error("Expected error for a pin that is not a SHA-256 hash")
+	}
+}
+
+// Concurrent writes share one connection, each bundle on its own stream
+func TestQUICStreamReusesConnection(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, "server")
+	serverConfig, err := LoadServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("LoadServerTLSConfig failed: %v", err)
+	}
+	clientConfig, err := LoadClientTLSConfig(certFile, "", "")
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+	output := &recordingStream{}
+	address := "127.0.0.1:45456"
+	quicListener := NewQUICStream(address, ramstream.DROutputStream, output, serverConfig)
+	go quicListener.Listen(4 * 1024 * 1024)
+	defer quicListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	quicSender := NewQUICStream(address, ramstream.DROutputStream, nil, clientConfig)
+	defer quicSender.Flush()
+	// Larger than a single read so the listener has to wait for the whole frame
+	large := make([]byte, 2*1024*1024)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	if _, err := quicSender.Write(large); err != nil {
+		t.Fatalf("Large write failed: %v", err)
+	}
+	conn := quicSender.conn
+
+	parallel := NewParallelStream(ramstream.DROutputStream, quicSender, quicSender, quicSender, quicSender)
+	want := []string{string(large)}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		record := fmt.Sprintf("record-%02d", i)
+		want = append(want, record)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := parallel.Write([]byte(record)); err != nil {
+				t.Errorf("Write failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if quicSender.conn != conn {
+		t.Error("Expected every write to reuse the first connection")
+	}
+	got := output.Writes()
+	sort.Strings(got)
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d writes, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Write %d was not delivered intact", i)
+		}
+	}
+
+	// A closed connection is replaced on the next write
+	quicSender.Flush()
+	if _, err := quicSender.Write([]byte("after flush")); err != nil {
+		t.Fatalf("Write after flush failed: %v", err)
+	}
+}
+
+// Frames above the listener's buffer size are refused with the same error as on TCP
+func TestQUICFrameTooLarge(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, "server")
+	serverConfig, err := LoadServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("LoadServerTLSConfig failed: %v", err)
+	}
+	clientConfig, err := LoadClientTLSConfig(certFile, "", "")
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+	output := &recordingStream{}
+	address := "127.0.0.1:45458"
+	quicListener := NewQUICStream(address, ramstream.DROutputStream, output, serverConfig)
+	go quicListener.Listen(16)
+	defer quicListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	quicSender := NewQUICStream(address, ramstream.DROutputStream, nil, clientConfig)
+	defer quicSender.Flush()
+	if _, err := quicSender.Write(make([]byte, 17)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected ErrFrameTooLarge sending a frame larger than the listener accepts, got %v", err)
+	}
+	if writes := output.Writes(); len(writes) != 0 {
+		t.Errorf("Expected nothing delivered, got %d writes", len(writes))
+	}
+	if _, err := quicSender.Write([]byte("small")); err != nil {
+		t.Fatalf("Write after refused frame failed: %v", err)
+	}
+	if writes := output.Writes(); len(writes) != 1 || writes[0] != "small" {
+		t.Errorf("Expected the small frame delivered, got %q", writes)
+	}
+}
+
+// nackRecordingStream records writes and answers nacks by echoing the request
+type nackRecordingStream struct {
+	recordingStream
+}
+
+func (n *nackRecordingStream) HandleNack(request []byte) ([]byte, error) {
+	return append([]byte("missing:"), request...), nil
+}
+
+func TestQUICDatagramStream(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, "server")
+	serverConfig, err := LoadServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("LoadServerTLSConfig failed: %v", err)
+	}
+	clientConfig, err := LoadClientTLSConfig(certFile, "", "")
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+	output := &nackRecordingStream{}
+	address := "127.0.0.1:45457"
+	quicListener := NewQUICStream(address, ramstream.DROutputStream, output, serverConfig)
+	go quicListener.Listen(1024 * 1024)
+	defer quicListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	record := func(recordType int, sequence int, size int) []byte {
+		header := ramformats.RecordHeader{Version: ramformats.FORMAT_VERSION_2, RecordType: recordType,
+			BundleID: ramformats.GenerateUUID(), Sequence: sequence}
+		data, err := ramformats.EncodeRecord(header, make([]byte, size))
+		if err != nil {
+			t.Fatalf("EncodeRecord failed: %v", err)
+		}
+		return data
+	}
+	meta := record(ramformats.METADATA_HEADER, 0, 100)
+	small := record(ramformats.DATA_HEADER, 1, 200)
+	large := record(ramformats.DATA_HEADER, 2, 64*1024)
+	// A full chunk of the largest size allowed with datagrams, in one segment
+	chunk := record(ramformats.DATA_HEADER, 3, QUIC_DATAGRAM_CHUNK_SIZE+ramformats.SEGMENT_HEADER_LEN+ramformats.CHECKSUM_LEN)
+
+	quicSender := NewQUICDatagramStream(address, ramstream.DROutputStream, nil, clientConfig)
+	defer quicSender.Flush()
+	for name, tc := range map[string]struct {
+		data     []byte
+		datagram bool
+	}{
+		"metadata": {meta, false},
+		"small":    {small, true},
+		"large":    {large, false},
+		"chunk":    {chunk, true},
+	} {
+		sent, err := quicSender.sendDatagram(tc.data)
+		if err != nil {
+			t.Fatalf("%s: sendDatagram failed: %v", name, err)
+		}
+		if sent != tc.datagram {
+			t.Errorf("%s: expected datagram %v, got %v", name, tc.datagram, sent)
+		}
+	}
+	// Writes route the same way, the records that were not datagrams go on streams
+	for _, data := range [][]byte{meta, large} {
+		if _, err := quicSender.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	// Datagrams are not acknowledged so wait for the small record to arrive
+	deadline := time.Now().Add(2 * time.Second)
+	for len(output.Writes()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	writes := output.Writes()
+	if len(writes) != 4 {
+		t.Fatalf("Expected 4 records delivered, got %d", len(writes))
+	}
+	got := map[string]bool{}
+	for _, w := range writes {
+		got[w] = true
+	}
+	for name, data := range map[string][]byte{"metadata": meta, "small": small, "large": large, "chunk": chunk} {
+		if !got[string(data)] {
+			t.Errorf("%s record was not delivered intact", name)
+		}
+	}
+
+	reply, err := quicSender.Nack([]byte("abc"))
+	if err != nil {
+		t.Fatalf("Nack failed: %v", err)
+	}
+	if string(reply) != "missing:abc" {
+		t.Errorf("Unexpected nack reply %q", reply)
+	}
+}
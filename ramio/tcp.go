@@ -2,18 +2,32 @@ package ramio
 
 import (
 	"context"
+	"crypto/tls"
 	"data_ram/ramstream"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"sync"
+	"time"
 )
 
 // Define const header bytes
 const (
 	TCP_KEEPALIVE = 1 // Size of the header for int64 response
-	TCP_DATA      = 2
+	TCP_DATA      = 2 // Followed by a length prefixed frame, answered with the number of bytes written, or the negated limit if the frame is too large
 	TCP_CLOSE     = 3
+	TCP_NACK      = 4 // Length prefixed request for what the receiver is missing, answered with a length prefixed reply
 )
 
+// Largest nack reply a sender will accept
+const maxNackReplyLen = 64 * 1024 * 1024
+
+// ErrFrameTooLarge is returned by Send, on TCP and QUIC streams, when the listener refused a bundle larger
+// than its buffer size. Resending it will not help.
+var ErrFrameTooLarge = errors.New("Bundle is larger than the listener accepts")
+
 // TCPListener implements Listener for TCP connections.
 type TCPStream struct {
 	Address        string
@@ -21,7 +35,14 @@ type TCPStream struct {
 	StreamType     string
 	InternalStream ramstream.RamStream
 	tcpCon         net.Conn
-	cancelListen   context.CancelFunc // Added to cancel goroutines
+	network        string                // "tcp", or "unix" with Address a socket path
+	tlsConfig      *tls.Config           // Connections are wrapped in TLS when set
+	cancelListen   context.CancelFunc    // Added to cancel goroutines
+	conns          map[net.Conn]struct{} // Accepted connections, closed by Flush
+	stopped        bool                  // Set by Flush, Listen returns rather than start
+	listenMu       sync.Mutex            // Guards listener, cancelListen, conns and stopped
+	listenWg       sync.WaitGroup        // Listen and its connection handlers, waited for by Flush
+	sendMu         sync.Mutex            // Guards tcpCon, serialising sends and nacks
 }
 
 // Constructor for TCPStream that sets the address and stream type.
@@ -33,18 +54,48 @@ func NewTCPStream(address string, streamType string, internalStream ramstream.Ra
 	}
 }
 
+// Constructor for a TCPStream whose connections use TLS. Listeners need a config with a
+// certificate, see LoadServerTLSConfig; senders one that can verify it, see LoadClientTLSConfig.
+func NewTLSStream(address string, streamType string, internalStream ramstream.RamStream, tlsConfig *tls.Config) *TCPStream {
+	t := NewTCPStream(address, streamType, internalStream)
+	t.tlsConfig = tlsConfig
+	return t
+}
+
+// Constructor for a TCPStream over a unix domain socket at path, for hand-offs between
+// processes on one host without opening a network port.
+func NewUnixStream(path string, streamType string, internalStream ramstream.RamStream) *TCPStream {
+	t := NewTCPStream(path, streamType, internalStream)
+	t.network = "unix"
+	return t
+}
+
+// networkName returns the network to listen on and dial, tcp unless set by a constructor.
+func (t *TCPStream) networkName() string {
+	if t.network == "" {
+		return "tcp"
+	}
+	return t.network
+}
+
 func (t *TCPStream) handleListen(ctx context.Context, c net.Conn, bufferSize int) {
-	defer c.Close()
+	defer t.listenWg.Done()
+	defer func() {
+		c.Close()
+		t.listenMu.Lock()
+		delete(t.conns, c)
+		t.listenMu.Unlock()
+	}()
 
 	for {
 		select {
 		case <-ctx.Done():
-			fmt.Println("TCP handler cancelled")
+			ramstream.Logln("TCP handler cancelled")
 			return
 		default:
 			respN, err := readInt64(c)
 			if err != nil {
-				fmt.Printf("TCP read failed: %v\n", err)
+				ramstream.Logf("TCP read failed: %v\n", err)
 				return
 			}
 			switch respN {
@@ -53,17 +104,52 @@ func (t *TCPStream) handleListen(ctx context.Context, c net.Conn, bufferSize int
 			case TCP_KEEPALIVE:
 				writeInt64(c, int64(TCP_KEEPALIVE))
 			case TCP_DATA:
-				buf := make([]byte, bufferSize)
-				n, err := c.Read(buf)
-				if err == nil && n > 0 {
-					outN, _ := t.InternalStream.Write(buf[:n])
-					writeInt64(c, int64(outN))
-				} else {
-					fmt.Printf("TCP failed to read from stream; closing\n")
+				// bufferSize caps the frame so a bad length cannot exhaust memory
+				frameLen, err := readInt64(c)
+				if err != nil || frameLen < 0 {
+					ramstream.Logf("TCP failed to read data frame length %d: %v; closing\n", frameLen, err)
+					return
+				}
+				if frameLen > int64(bufferSize) {
+					// Skip the frame and answer with the negated limit so the sender
+					// reports the mismatch rather than retrying on a dropped connection
+					ramstream.Logf("TCP data frame of %d bytes exceeds buffer size of %d, refusing it\n", frameLen, bufferSize)
+					if _, err := io.CopyN(io.Discard, c, frameLen); err != nil {
+						return
+					}
+					writeInt64(c, -int64(bufferSize))
+					continue
+				}
+				data := make([]byte, frameLen)
+				if _, err := io.ReadFull(c, data); err != nil {
+					ramstream.Logf("TCP failed to read data frame: %v; closing\n", err)
+					return
+				}
+				outN, err := t.InternalStream.Write(data)
+				if err != nil {
+					ramstream.Logf("TCP failed to write data frame: %v\n", err)
+				}
+				writeInt64(c, int64(outN))
+			case TCP_NACK:
+				request, err := readFrame(c, bufferSize)
+				if err != nil {
+					ramstream.Logf("TCP failed to read nack request: %v\n", err)
+					return
+				}
+				reply := []byte{}
+				if handler, ok := t.InternalStream.(ramstream.RamNackHandler); ok {
+					reply, err = handler.HandleNack(request)
+					if err != nil {
+						ramstream.Logf("TCP failed to handle nack request: %v\n", err)
+						return
+					}
+				}
+				if err := writeFrame(c, reply); err != nil {
+					ramstream.Logf("TCP failed to write nack reply: %v\n", err)
 					return
 				}
 			default:
-				fmt.Printf("Unknown TCP header type: %d\n", respN)
+				ramstream.Logf("Unknown TCP header type: %d\n", respN)
 				return
 			}
 		}
@@ -76,76 +162,164 @@ func (t *TCPStream) Listen(bufferSize int) error {
 		return fmt.Errorf("Cannot listen on input stream")
 	}
 
-	ln, err := net.Listen("tcp", t.Address)
+	t.listenMu.Lock()
+	if t.stopped {
+		t.listenMu.Unlock()
+		return net.ErrClosed
+	}
+	t.listenWg.Add(1)
+	t.listenMu.Unlock()
+	defer t.listenWg.Done()
+
+	if t.networkName() == "unix" {
+		if err := removeStaleSocket(t.Address); err != nil {
+			return err
+		}
+	}
+	var ln net.Listener
+	var err error
+	if t.tlsConfig != nil {
+		ln, err = tls.Listen(t.networkName(), t.Address, t.tlsConfig)
+	} else {
+		ln, err = net.Listen(t.networkName(), t.Address)
+	}
 	if err != nil {
-		fmt.Println("Failed to listen on", t.Address)
+		ramstream.Logln("Failed to listen on", t.Address)
 		return err
 	}
-	t.listener = ln
-	fmt.Println("Listening on", t.Address)
-
 	ctx, cancel := context.WithCancel(context.Background())
+	t.listenMu.Lock()
+	if t.stopped {
+		// Flush ran while the listener was being opened
+		t.listenMu.Unlock()
+		cancel()
+		ln.Close()
+		return net.ErrClosed
+	}
+	t.listener = ln
 	t.cancelListen = cancel // Store cancel func to use in Flush
+	t.conns = make(map[net.Conn]struct{})
+	t.listenMu.Unlock()
+	if t.tlsConfig != nil {
+		ramstream.Logln("Listening with TLS on", t.Address)
+	} else {
+		ramstream.Logln("Listening on", t.Address)
+	}
 
-	var handleListenRunning bool
-
+	// Every connection is handled concurrently so a sender can stripe bundles
+	// across several, InternalStream must be safe for concurrent writes
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			return err // this will happen when listener is closed
 		}
-		if handleListenRunning {
-			fmt.Println("Stopping new connection attempted while another is running on address", t.Address)
+		t.listenMu.Lock()
+		if t.stopped {
+			t.listenMu.Unlock()
 			conn.Close()
-			continue
+			return net.ErrClosed
 		}
-		handleListenRunning = true
-		go func() {
-			t.handleListen(ctx, conn, bufferSize)
-			handleListenRunning = false
-		}()
+		t.conns[conn] = struct{}{}
+		t.listenWg.Add(1)
+		t.listenMu.Unlock()
+		go t.handleListen(ctx, conn, bufferSize)
 	}
 }
 
-// Update Send to wait for response
-func (t *TCPStream) Send(data []byte) (int, error) {
+// connect checks the current connection with a keepalive and dials a new one if needed.
+// The caller must hold t.sendMu.
+func (t *TCPStream) connect() error {
 	if t.tcpCon != nil && t.tcpCon.RemoteAddr() != nil {
 		err := writeInt64(t.tcpCon, int64(TCP_KEEPALIVE))
 		resp, err := readInt64(t.tcpCon)
 		if err != nil || resp != int64(TCP_KEEPALIVE) {
 			t.tcpCon.Close()
 			t.tcpCon = nil
-			fmt.Printf("TCP keepalive failed: %v\n", err)
+			ramstream.Logf("TCP keepalive failed: %v\n", err)
 		}
 	}
 
 	if t.tcpCon == nil {
-		con, err := net.Dial("tcp", t.Address)
+		var con net.Conn
+		var err error
+		if t.tlsConfig != nil {
+			// Handshake now so certificate errors are reported by the send that dialled
+			con, err = tls.Dial(t.networkName(), t.Address, t.tlsConfig)
+		} else {
+			con, err = net.Dial(t.networkName(), t.Address)
+		}
 		if err != nil {
-			fmt.Printf("TCP dial failed: %v\n", err)
-			return 0, err
+			ramstream.Logf("TCP dial failed: %v\n", err)
+			return err
 		}
 		t.tcpCon = con
 	}
-	err := writeInt64(t.tcpCon, int64(TCP_DATA))
-	if err != nil {
+	return nil
+}
+
+// closeConn drops a connection left part way through a frame so the next send dials again.
+// The caller must hold t.sendMu.
+func (t *TCPStream) closeConn() {
+	if t.tcpCon != nil {
+		t.tcpCon.Close()
+		t.tcpCon = nil
+	}
+}
+
+// Update Send to wait for response
+func (t *TCPStream) Send(data []byte) (int, error) {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	if err := t.connect(); err != nil {
 		return 0, err
 	}
-	n, err := t.tcpCon.Write(data)
-	if err != nil {
-		return n, err
+	if err := writeInt64(t.tcpCon, int64(TCP_DATA)); err != nil {
+		t.closeConn()
+		return 0, err
+	}
+	if err := writeFrame(t.tcpCon, data); err != nil {
+		t.closeConn()
+		return 0, err
 	}
+	n := len(data)
 	// Wait for response
 	respN, err := readInt64(t.tcpCon)
 	if err != nil {
+		t.closeConn()
 		return 0, fmt.Errorf("Failed to read response: %w", err)
 	}
+	if respN < 0 {
+		return 0, fmt.Errorf("%w: sent %d bytes, listener accepts at most %d, lower chunkSize or raise the listener's bufferSize", ErrFrameTooLarge, n, -respN)
+	}
 	if int(respN) != n {
 		return 0, fmt.Errorf("Could not write over tcp stream: sent %d, got response %d", n, respN)
 	}
 	return n, nil
 }
 
+// Nack sends a resend request to the listener and returns its reply.
+func (t *TCPStream) Nack(request []byte) ([]byte, error) {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	if err := t.connect(); err != nil {
+		return nil, err
+	}
+	if err := writeInt64(t.tcpCon, int64(TCP_NACK)); err != nil {
+		t.closeConn()
+		return nil, err
+	}
+	if err := writeFrame(t.tcpCon, request); err != nil {
+		t.closeConn()
+		return nil, err
+	}
+	reply, err := readFrame(t.tcpCon, maxNackReplyLen)
+	if err != nil {
+		t.closeConn()
+		return nil, fmt.Errorf("Failed to read nack reply: %w", err)
+	}
+	return reply, nil
+}
+
 func (t *TCPStream) Read(p []byte) (int, error) {
 	// This should never be called - this stream is fed by the listener
 	return 0, fmt.Errorf("Read should not be called on TCPStream")
@@ -171,7 +345,20 @@ func (t *TCPStream) Len() int {
 	return t.InternalStream.Len()
 }
 
+// Flush stops a listener, closing the connections it accepted, and waits for Listen
+// and the connection handlers to return. A Listen that has not started yet returns
+// straight away. A sender tells the listener it is done and closes its connection.
 func (t *TCPStream) Flush() error {
+	t.sendMu.Lock()
+	if t.tcpCon != nil {
+		t.tcpCon.SetWriteDeadline(time.Now().Add(time.Second))
+		writeInt64(t.tcpCon, int64(TCP_CLOSE))
+		t.closeConn()
+	}
+	t.sendMu.Unlock()
+
+	t.listenMu.Lock()
+	t.stopped = true
 	if t.listener != nil {
 		t.listener.Close()
 		t.listener = nil
@@ -180,7 +367,27 @@ func (t *TCPStream) Flush() error {
 		t.cancelListen()
 		t.cancelListen = nil
 	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.listenMu.Unlock()
+	t.listenWg.Wait()
 	return nil
 }
 
+// removeStaleSocket removes a socket file left behind by a listener that did not
+// shut down cleanly. A socket something is still listening on is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil // Nothing there, or not a socket for net.Listen to complain about
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("Socket %s is already in use", path)
+	}
+	return os.Remove(path)
+}
+
 var _ ramstream.RamStream = (*TCPStream)(nil)
+var _ ramstream.RamNackSender = (*TCPStream)(nil)
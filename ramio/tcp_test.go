@@ -2,6 +2,11 @@ package ramio
 
 import (
 	"data_ram/ramstream"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -88,8 +93,7 @@ func TestTCPReuseStreamWithDummyStreams(t *testing.T) {
 	tcpListener.Flush()
 }
 
-// At the moment, a single TCPStream listener can only handle one input stream at a time.
-// For more throughput use multiple TCPStream listeners.
+// A TCPStream listener handles connections concurrently, see parallel_test.go.
 
 // func TestTCPMultiStreamWithDummyStreams(t *testing.T) {
 // 	// Create DummyStreams for input and output
@@ -134,3 +138,263 @@ func TestTCPReuseStreamWithDummyStreams(t *testing.T) {
 
 // 	tcpListener.Flush()
 // }
+
+// nackDummyStream answers nack requests by echoing them back reversed
+type nackDummyStream struct {
+	DummyStream
+}
+
+func (d *nackDummyStream) HandleNack(request []byte) ([]byte, error) {
+	reply := make([]byte, len(request))
+	for i := range request {
+		reply[len(request)-1-i] = request[i]
+	}
+	return reply, nil
+}
+
+func TestTCPNack(t *testing.T) {
+	output := &nackDummyStream{DummyStream{StreamType: ramstream.DROutputStream}}
+	address := "127.0.0.1:9102"
+	tcpSender := NewTCPStream(address, ramstream.DROutputStream, nil)
+	tcpListener := NewTCPStream(address, ramstream.DROutputStream, output)
+	go tcpListener.Listen(1024)
+	defer tcpListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := tcpSender.Write([]byte("data")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	reply, err := tcpSender.Nack([]byte("abc"))
+	if err != nil {
+		t.Fatalf("Nack failed: %v", err)
+	}
+	if string(reply) != "cba" {
+		t.Errorf("Unexpected nack reply %q", reply)
+	}
+	// Data still flows on the same connection after a nack
+	if _, err := tcpSender.Write([]byte("more")); err != nil {
+		t.Fatalf("Write after nack failed: %v", err)
+	}
+	if string(output.Data) != "datamore" {
+		t.Errorf("Unexpected data %q", output.Data)
+	}
+}
+
+// Bundles larger than a single read arrive whole
+func TestTCPLargeFrame(t *testing.T) {
+	output := &recordingStream{}
+	address := "127.0.0.1:9104"
+	tcpListener := NewTCPStream(address, ramstream.DROutputStream, output)
+	go tcpListener.Listen(4 * 1024 * 1024)
+	defer tcpListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	tcpSender := NewTCPStream(address, ramstream.DROutputStream, nil)
+	data := make([]byte, 3*1024*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	for i := 0; i < 2; i++ {
+		n, err := tcpSender.Write(data)
+		if err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+		if n != len(data) {
+			t.Fatalf("Write %d length mismatch: got %d, want %d", i, n, len(data))
+		}
+	}
+	writes := output.Writes()
+	if len(writes) != 2 {
+		t.Fatalf("Expected 2 writes, got %d", len(writes))
+	}
+	for i, w := range writes {
+		if w != string(data) {
+			t.Errorf("Write %d was not delivered intact (%d bytes)", i, len(w))
+		}
+	}
+}
+
+// Frames above the listener's buffer size are refused with an error the sender can report
+func TestTCPFrameTooLarge(t *testing.T) {
+	output := &recordingStream{}
+	address := "127.0.0.1:9105"
+	tcpListener := NewTCPStream(address, ramstream.DROutputStream, output)
+	go tcpListener.Listen(16)
+	defer tcpListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	tcpSender := NewTCPStream(address, ramstream.DROutputStream, nil)
+	if _, err := tcpSender.Write(make([]byte, 17)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected ErrFrameTooLarge sending a frame larger than the listener accepts, got %v", err)
+	}
+	if writes := output.Writes(); len(writes) != 0 {
+		t.Errorf("Expected nothing delivered, got %d writes", len(writes))
+	}
+	// The connection stays usable for the next write
+	if _, err := tcpSender.Write([]byte("small")); err != nil {
+		t.Fatalf("Write after refused frame failed: %v", err)
+	}
+}
+
+// Flush closes open connections and waits for Listen, even one that has not started yet
+func TestTCPFlush(t *testing.T) {
+	unstarted := NewTCPStream("127.0.0.1:9123", ramstream.DROutputStream, &recordingStream{})
+	unstarted.Flush()
+	if err := unstarted.Listen(1024); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected Listen after Flush to return net.ErrClosed, got %v", err)
+	}
+
+	output := &recordingStream{}
+	address := "127.0.0.1:9123"
+	tcpListener := NewTCPStream(address, ramstream.DROutputStream, output)
+	listenDone := make(chan error, 1)
+	go func() { listenDone <- tcpListener.Listen(1024) }()
+	time.Sleep(100 * time.Millisecond)
+
+	tcpSender := NewTCPStream(address, ramstream.DROutputStream, nil)
+	if _, err := tcpSender.Write([]byte("data")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	tcpListener.Flush()
+	select {
+	case <-listenDone:
+	default:
+		t.Fatal("Listen was still running after Flush")
+	}
+	// The connection the sender had open was closed by the listener
+	tcpSender.tcpCon.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := tcpSender.tcpCon.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the listener to close the connection, got %v", err)
+	}
+}
+
+// Flushing a sender closes the connection it keeps open between sends
+func TestTCPSenderFlush(t *testing.T) {
+	address := "127.0.0.1:9128"
+	tcpListener := NewTCPStream(address, ramstream.DROutputStream, &recordingStream{})
+	go tcpListener.Listen(1024)
+	defer tcpListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	tcpSender := NewTCPStream(address, ramstream.DROutputStream, nil)
+	if _, err := tcpSender.Write([]byte("data")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	conn := tcpSender.tcpCon
+	tcpSender.Flush()
+	if tcpSender.tcpCon != nil {
+		t.Error("Expected Flush to drop the sender's connection")
+	}
+	if _, err := conn.Write([]byte{0}); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected the sender's connection to be closed, got %v", err)
+	}
+}
+
+// writeTestCert writes a self-signed certificate and key for 127.0.0.1 and returns their paths
+func writeTestCert(t *testing.T, name string) (string, string) {
+	t.Helper()
+	certPEM, keyPEM, err := GenerateSelfSignedCert([]string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateSelfSignedCert failed: %v", err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, name+"-cert.pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSStream(t *testing.T) {
+	serverCert, serverKey := writeTestCert(t, "server")
+	otherCert, _ := writeTestCert(t, "other")
+	serverConfig, err := LoadServerTLSConfig(serverCert, serverKey, "")
+	if err != nil {
+		t.Fatalf("LoadServerTLSConfig failed: %v", err)
+	}
+	output := &recordingStream{}
+	address := "127.0.0.1:9106"
+	tlsListener := NewTLSStream(address, ramstream.DROutputStream, output, serverConfig)
+	go tlsListener.Listen(1024)
+	defer tlsListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	trusted, err := LoadClientTLSConfig(serverCert, "", "")
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+	tlsSender := NewTLSStream(address, ramstream.DROutputStream, nil, trusted)
+	for _, data := range []string{"first", "second"} {
+		if _, err := tlsSender.Write([]byte(data)); err != nil {
+			t.Fatalf("Write over TLS failed: %v", err)
+		}
+	}
+	if writes := output.Writes(); len(writes) != 2 || writes[0] != "first" || writes[1] != "second" {
+		t.Errorf("Unexpected writes %q", writes)
+	}
+
+	// A sender that does not trust the listener's certificate refuses to send
+	untrusted, err := LoadClientTLSConfig(otherCert, "", "")
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+	if _, err := NewTLSStream(address, ramstream.DROutputStream, nil, untrusted).Write([]byte("x")); err == nil {
+		t.Error("Expected certificate verification to fail")
+	}
+	if writes := output.Writes(); len(writes) != 2 {
+		t.Errorf("Expected untrusted write to be dropped, got %q", writes)
+	}
+}
+
+func TestMutualTLSStream(t *testing.T) {
+	serverCert, serverKey := writeTestCert(t, "server")
+	clientCert, clientKey := writeTestCert(t, "client")
+	serverConfig, err := LoadServerTLSConfig(serverCert, serverKey, clientCert)
+	if err != nil {
+		t.Fatalf("LoadServerTLSConfig failed: %v", err)
+	}
+	output := &recordingStream{}
+	address := "127.0.0.1:9107"
+	tlsListener := NewTLSStream(address, ramstream.DROutputStream, output, serverConfig)
+	go tlsListener.Listen(1024)
+	defer tlsListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	// Without a client certificate the listener drops the connection
+	noCert, err := LoadClientTLSConfig(serverCert, "", "")
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+	if _, err := NewTLSStream(address, ramstream.DROutputStream, nil, noCert).Write([]byte("anonymous")); err == nil {
+		t.Error("Expected write without a client certificate to fail")
+	}
+
+	withCert, err := LoadClientTLSConfig(serverCert, clientCert, clientKey)
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+	if _, err := NewTLSStream(address, ramstream.DROutputStream, nil, withCert).Write([]byte("mutual")); err != nil {
+		t.Fatalf("Write with client certificate failed: %v", err)
+	}
+	if writes := output.Writes(); len(writes) != 1 || writes[0] != "mutual" {
+		t.Errorf("Unexpected writes %q", writes)
+	}
+}
+
+func TestLoadTLSConfigErrors(t *testing.T) {
+	if _, err := LoadServerTLSConfig("/nonexistent.pem", "/nonexistent.pem", ""); err == nil {
+		t.Error("Expected error for missing server certificate")
+	}
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0644)
+	if _, err := LoadClientTLSConfig(notPEM, "", ""); err == nil {
+		t.Error("Expected error for a CA bundle without certificates")
+	}
+	if _, err := LoadClientTLSConfig("", "/nonexistent.pem", ""); err == nil {
+		t.Error("Expected error for a client certificate without a key")
+	}
+}
@@ -0,0 +1,407 @@
+package ramio
+
+import (
+	"crypto/rand"
+	"data_ram/ramstream"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits on what a UDP listener keeps while reassembling records
+const (
+	maxUDPPartialRecords   = 1024 // Oldest incomplete record is dropped beyond this
+	maxUDPDeliveredRecords = 4096 // Recently delivered records whose repeats are ignored
+	udpDeliverQueueLen     = 256
+	udpSocketBufferLen     = 8 * 1024 * 1024
+)
+
+// A paced sender only sleeps once it is this far ahead of its send rate, finer
+// sleeps are not honoured by the scheduler
+const udpPaceSlack = time.Millisecond
+
+// UDPStream sends records one way over UDP, for links with no return path such as
+// data diodes. Nothing is acknowledged, so Write returns once the packets are sent.
+// Loss is survived by sending every packet Redundancy times and, with FECGroupSize
+// set, a parity packet for every FECGroupSize fragments that rebuilds any one of them.
+// Records that still cannot be rebuilt are lost, the receiver's MissingChunks shows what.
+// SendRate paces the packets so a link slower than the sender's network card is not
+// overrun, which on a one way link is the only way to avoid loss from congestion.
+type UDPStream struct {
+	Address        string
+	StreamType     string
+	InternalStream ramstream.RamStream
+	PacketLen      int   // Largest datagram sent, header included
+	Redundancy     int   // Times every packet is sent
+	FECGroupSize   int   // Data fragments covered by each parity packet, 0 sends no parity
+	SendRate       int64 // Bytes per second sent, headers and repeats included, 0 sends as fast as the socket allows
+	conn           *net.UDPConn
+	session        uint32
+	sequence       uint32
+	nextSend       time.Time      // When a paced sender may send its next packet
+	stopped        bool           // Set by Flush, Listen returns rather than start
+	listenWg       sync.WaitGroup // Listen and its delivery goroutine, waited for by Flush
+	mu             sync.Mutex     // Serialises writes, which share the sequence and connection, and guards conn and stopped
+}
+
+// Constructor for UDPStream that sets the address and stream type.
+func NewUDPStream(address string, streamType string, internalStream ramstream.RamStream) *UDPStream {
+	return &UDPStream{
+		Address:        address,
+		StreamType:     streamType,
+		InternalStream: internalStream,
+		PacketLen:      DEFAULT_UDP_PACKET_LEN,
+		Redundancy:     1,
+	}
+}
+
+// udpRecord is a record being reassembled from its packets.
+type udpRecord struct {
+	recordLen    int
+	fragments    [][]byte
+	received     int
+	fecGroupSize int
+	parity       map[int][]byte
+	lastSeen     time.Time
+}
+
+type udpRecordKey struct {
+	session  uint32
+	sequence uint32
+}
+
+func (u *UDPStream) Listen(bufferSize int) error {
+	if u.StreamType != ramstream.DROutputStream {
+		return fmt.Errorf("Cannot listen on input stream")
+	}
+	u.mu.Lock()
+	if u.stopped {
+		u.mu.Unlock()
+		return net.ErrClosed
+	}
+	u.listenWg.Add(1)
+	u.mu.Unlock()
+	defer u.listenWg.Done()
+
+	addr, err := net.ResolveUDPAddr("udp", u.Address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		ramstream.Logln("Failed to listen on", u.Address)
+		return err
+	}
+	conn.SetReadBuffer(udpSocketBufferLen)
+	u.mu.Lock()
+	if u.stopped {
+		// Flush ran while the socket was being opened
+		u.mu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	}
+	u.conn = conn
+	u.listenWg.Add(1) // The delivery goroutine
+	u.mu.Unlock()
+	ramstream.Logln("UDP Listening on", u.Address)
+
+	// Records are handed to the internal stream by another goroutine so the
+	// socket keeps being drained while it writes
+	deliver := make(chan []byte, udpDeliverQueueLen)
+	defer close(deliver)
+	go func() {
+		defer u.listenWg.Done()
+		for record := range deliver {
+			if _, err := u.InternalStream.Write(record); err != nil {
+				ramstream.Logf("UDP failed to write record: %v\n", err)
+			}
+		}
+	}()
+
+	partial := make(map[udpRecordKey]*udpRecord)
+	delivered := make(map[udpRecordKey]struct{})
+	deliveredOrder := make([]udpRecordKey, 0, maxUDPDeliveredRecords)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err // this will happen when the connection is closed
+		}
+		packet, err := decodeUDPPacket(buf[:n])
+		if err != nil {
+			ramstream.Logf("UDP dropped packet: %v\n", err)
+			continue
+		}
+		if packet.RecordLen > bufferSize {
+			ramstream.Logf("UDP dropped packet of a %d byte record, over the limit of %d\n", packet.RecordLen, bufferSize)
+			continue
+		}
+		key := udpRecordKey{packet.Session, packet.Sequence}
+		if _, ok := delivered[key]; ok {
+			continue // Repeat of a record already delivered
+		}
+		rec, ok := partial[key]
+		if !ok {
+			if len(partial) >= maxUDPPartialRecords {
+				evictOldestUDPRecord(partial)
+			}
+			rec = &udpRecord{
+				recordLen:    packet.RecordLen,
+				fragments:    make([][]byte, packet.Fragments),
+				fecGroupSize: packet.FECGroupSize,
+				parity:       make(map[int][]byte),
+			}
+			partial[key] = rec
+		}
+		rec.lastSeen = time.Now()
+		if err := rec.add(packet); err != nil {
+			ramstream.Logf("UDP dropped packet: %v\n", err)
+			continue
+		}
+		if rec.received < len(rec.fragments) {
+			continue
+		}
+		deliver <- rec.assemble()
+		delete(partial, key)
+		if len(deliveredOrder) == maxUDPDeliveredRecords {
+			delete(delivered, deliveredOrder[0])
+			deliveredOrder = deliveredOrder[1:]
+		}
+		delivered[key] = struct{}{}
+		deliveredOrder = append(deliveredOrder, key)
+	}
+}
+
+// add stores a packet's payload and rebuilds what parity allows.
+func (r *udpRecord) add(p udpPacket) error {
+	if p.RecordLen != r.recordLen || p.Fragments != len(r.fragments) || p.FECGroupSize != r.fecGroupSize {
+		return fmt.Errorf("UDP packet does not match the record it belongs to")
+	}
+	fragmentSize := udpFragmentSize(r.recordLen, len(r.fragments))
+	switch p.Kind {
+	case UDP_PACKET_DATA:
+		if p.Index >= len(r.fragments) || len(p.Payload) != udpFragmentLen(r.recordLen, len(r.fragments), p.Index) {
+			return fmt.Errorf("UDP data packet %d does not fit its record", p.Index)
+		}
+		if r.fragments[p.Index] == nil {
+			r.fragments[p.Index] = append([]byte(nil), p.Payload...)
+			r.received++
+		}
+		if r.fecGroupSize > 0 {
+			r.recover(p.Index / r.fecGroupSize)
+		}
+	case UDP_PACKET_XOR_PARITY:
+		if r.fecGroupSize == 0 || p.Index*r.fecGroupSize >= len(r.fragments) || len(p.Payload) != fragmentSize {
+			return fmt.Errorf("UDP parity packet %d does not fit its record", p.Index)
+		}
+		if _, ok := r.parity[p.Index]; !ok {
+			r.parity[p.Index] = append([]byte(nil), p.Payload...)
+		}
+		r.recover(p.Index)
+	default:
+		return fmt.Errorf("Unknown UDP packet kind: %d", p.Kind)
+	}
+	return nil
+}
+
+// recover rebuilds the one missing fragment of an FEC group from its parity.
+func (r *udpRecord) recover(group int) {
+	parity, ok := r.parity[group]
+	if !ok {
+		return
+	}
+	start := group * r.fecGroupSize
+	end := min(start+r.fecGroupSize, len(r.fragments))
+	missing := -1
+	for i := start; i < end; i++ {
+		if r.fragments[i] == nil {
+			if missing >= 0 {
+				return // More than one missing, XOR can only rebuild one
+			}
+			missing = i
+		}
+	}
+	if missing < 0 {
+		return
+	}
+	rebuilt := append([]byte(nil), parity...)
+	for i := start; i < end; i++ {
+		if i != missing {
+			xorInto(rebuilt, r.fragments[i])
+		}
+	}
+	r.fragments[missing] = rebuilt[:udpFragmentLen(r.recordLen, len(r.fragments), missing)]
+	r.received++
+}
+
+func (r *udpRecord) assemble() []byte {
+	record := make([]byte, 0, r.recordLen)
+	for _, fragment := range r.fragments {
+		record = append(record, fragment...)
+	}
+	return record
+}
+
+func evictOldestUDPRecord(partial map[udpRecordKey]*udpRecord) {
+	var oldest udpRecordKey
+	var oldestSeen time.Time
+	for key, rec := range partial {
+		if oldestSeen.IsZero() || rec.lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = key, rec.lastSeen
+		}
+	}
+	ramstream.Logf("UDP dropped incomplete record %d of session %x\n", oldest.sequence, oldest.session)
+	delete(partial, oldest)
+}
+
+// connect opens the socket to send on. The caller must hold u.mu.
+func (u *UDPStream) connect() error {
+	if u.conn != nil {
+		return nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		ramstream.Logf("UDP dial failed: %v\n", err)
+		return err
+	}
+	conn.SetWriteBuffer(udpSocketBufferLen)
+	var session [4]byte
+	if _, err := rand.Read(session[:]); err != nil {
+		conn.Close()
+		return err
+	}
+	u.session = binary.BigEndian.Uint32(session[:])
+	u.conn = conn
+	return nil
+}
+
+// Send splits a record into packets and sends each of them Redundancy times.
+func (u *UDPStream) Send(data []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.connect(); err != nil {
+		return 0, err
+	}
+	packets, err := u.packets(data)
+	if err != nil {
+		return 0, err
+	}
+	// Whole rounds are repeated rather than each packet so a burst of loss
+	// does not take every copy of a packet
+	for round := 0; round < max(1, u.Redundancy); round++ {
+		for _, packet := range packets {
+			u.pace(len(packet))
+			if _, err := u.conn.Write(packet); err != nil {
+				return 0, fmt.Errorf("Failed to send UDP packet: %w", err)
+			}
+		}
+	}
+	return len(data), nil
+}
+
+// pace waits until a packet of n bytes can be sent without going over SendRate.
+// The caller must hold u.mu.
+func (u *UDPStream) pace(n int) {
+	if u.SendRate <= 0 {
+		return
+	}
+	now := time.Now()
+	if u.nextSend.Before(now) {
+		u.nextSend = now // Time spent idle is not saved up for a burst
+	} else if wait := u.nextSend.Sub(now); wait > udpPaceSlack {
+		time.Sleep(wait)
+	}
+	u.nextSend = u.nextSend.Add(time.Duration(int64(n) * int64(time.Second) / u.SendRate))
+}
+
+// packets encodes a record as its data packets followed by any parity packets.
+// The caller must hold u.mu.
+func (u *UDPStream) packets(data []byte) ([][]byte, error) {
+	maxPayload := u.PacketLen - UDP_HEADER_LEN
+	if maxPayload <= 0 {
+		return nil, fmt.Errorf("UDP packet length %d leaves no room for data", u.PacketLen)
+	}
+	if u.FECGroupSize < 0 || u.FECGroupSize > maxUDPFECGroupSize {
+		return nil, fmt.Errorf("UDP FEC group size must be between 0 and %d, got %d", maxUDPFECGroupSize, u.FECGroupSize)
+	}
+	fragments := max(1, (len(data)+maxPayload-1)/maxPayload)
+	if fragments > maxUDPFragments {
+		return nil, fmt.Errorf("Record of %d bytes needs more than %d UDP packets", len(data), maxUDPFragments)
+	}
+	fragmentSize := udpFragmentSize(len(data), fragments)
+	header := udpPacket{
+		Session:      u.session,
+		Sequence:     u.sequence,
+		RecordLen:    len(data),
+		Fragments:    fragments,
+		FECGroupSize: u.FECGroupSize,
+	}
+	u.sequence++
+
+	packets := make([][]byte, 0, fragments+fragments/max(1, u.FECGroupSize)+1)
+	var parity []byte
+	for i := 0; i < fragments; i++ {
+		payload := data[i*fragmentSize : i*fragmentSize+udpFragmentLen(len(data), fragments, i)]
+		header.Index, header.Kind, header.Payload = i, UDP_PACKET_DATA, payload
+		packets = append(packets, encodeUDPPacket(nil, header))
+		if u.FECGroupSize == 0 {
+			continue
+		}
+		if parity == nil {
+			parity = make([]byte, fragmentSize)
+		}
+		xorInto(parity, payload)
+		if (i+1)%u.FECGroupSize == 0 || i == fragments-1 {
+			header.Index, header.Kind, header.Payload = i/u.FECGroupSize, UDP_PACKET_XOR_PARITY, parity
+			packets = append(packets, encodeUDPPacket(nil, header))
+			parity = nil
+		}
+	}
+	return packets, nil
+}
+
+func (u *UDPStream) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("Read should not be called on UDPStream")
+}
+
+func (u *UDPStream) Write(p []byte) (int, error) {
+	if u.StreamType != ramstream.DROutputStream {
+		return 0, fmt.Errorf("Cannot write to input stream")
+	}
+	if u.InternalStream != nil {
+		return 0, fmt.Errorf("Internal stream should not be initialised for UDP writing")
+	}
+	return u.Send(p)
+}
+
+func (u *UDPStream) Reset() error {
+	u.InternalStream.Reset()
+	return nil
+}
+
+func (u *UDPStream) Len() int {
+	return u.InternalStream.Len()
+}
+
+// Flush closes the listening or sending socket, and waits for Listen and the
+// records it is still delivering. A Listen that has not started yet returns
+// straight away.
+func (u *UDPStream) Flush() error {
+	u.mu.Lock()
+	u.stopped = true
+	if u.conn != nil {
+		u.conn.Close()
+		u.conn = nil
+	}
+	u.mu.Unlock()
+	u.listenWg.Wait()
+	return nil
+}
+
+var _ ramstream.RamStream = (*UDPStream)(nil)
@@ -0,0 +1,192 @@
+package ramio
+
+import (
+	"bytes"
+	"data_ram/ramstream"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func testRecord(size int, seed byte) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)*7 + seed
+	}
+	return data
+}
+
+func TestUDPStream(t *testing.T) {
+	output := &recordingStream{}
+	address := "127.0.0.1:9108"
+	udpListener := NewUDPStream(address, ramstream.DROutputStream, output)
+	go udpListener.Listen(1024 * 1024)
+	defer udpListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	udpSender := NewUDPStream(address, ramstream.DROutputStream, nil)
+	udpSender.PacketLen = 526
+	udpSender.Redundancy = 2
+	udpSender.FECGroupSize = 4
+	defer udpSender.Flush()
+	records := [][]byte{testRecord(10, 1), testRecord(500, 2), testRecord(5000, 3), testRecord(100000, 4)}
+	for _, record := range records {
+		n, err := udpSender.Write(record)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if n != len(record) {
+			t.Fatalf("Write length mismatch: got %d, want %d", n, len(record))
+		}
+	}
+
+	// Nothing is acknowledged so wait for the records to arrive
+	deadline := time.Now().Add(2 * time.Second)
+	for len(output.Writes()) < len(records) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // Give repeats time to be wrongly delivered
+	writes := output.Writes()
+	if len(writes) != len(records) {
+		t.Fatalf("Expected each of %d records delivered once, got %d writes", len(records), len(writes))
+	}
+	for i, record := range records {
+		if writes[i] != string(record) {
+			t.Errorf("Record %d was not delivered intact", i)
+		}
+	}
+}
+
+func TestUDPSendRate(t *testing.T) {
+	output := &recordingStream{}
+	address := "127.0.0.1:9124"
+	udpListener := NewUDPStream(address, ramstream.DROutputStream, output)
+	go udpListener.Listen(1024 * 1024)
+	defer udpListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	udpSender := NewUDPStream(address, ramstream.DROutputStream, nil)
+	udpSender.SendRate = 1024 * 1024
+	defer udpSender.Flush()
+	record := testRecord(256*1024, 5)
+	start := time.Now()
+	if _, err := udpSender.Write(record); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// A quarter of a second's worth of data, less the first packet which goes straight away
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Sending %d bytes at %d bytes per second took only %v", len(record), udpSender.SendRate, elapsed)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(output.Writes()) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if writes := output.Writes(); len(writes) != 1 || writes[0] != string(record) {
+		t.Errorf("Paced record was not delivered intact")
+	}
+}
+
+// Flush stops Listen, even one that has not started yet, and waits for it
+func TestUDPFlush(t *testing.T) {
+	unstarted := NewUDPStream("127.0.0.1:9125", ramstream.DROutputStream, &recordingStream{})
+	unstarted.Flush()
+	if err := unstarted.Listen(1024); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected Listen after Flush to return net.ErrClosed, got %v", err)
+	}
+
+	udpListener := NewUDPStream("127.0.0.1:9125", ramstream.DROutputStream, &recordingStream{})
+	listenDone := make(chan error, 1)
+	go func() { listenDone <- udpListener.Listen(1024) }()
+	time.Sleep(100 * time.Millisecond)
+	udpListener.Flush()
+	select {
+	case <-listenDone:
+	default:
+		t.Fatal("Listen was still running after Flush")
+	}
+}
+
+// reassemble feeds packets to a record in order and returns it if it completes
+func reassemble(t *testing.T, packets [][]byte) []byte {
+	t.Helper()
+	var rec *udpRecord
+	for _, data := range packets {
+		packet, err := decodeUDPPacket(data)
+		if err != nil {
+			t.Fatalf("decodeUDPPacket failed: %v", err)
+		}
+		if rec == nil {
+			rec = &udpRecord{
+				recordLen:    packet.RecordLen,
+				fragments:    make([][]byte, packet.Fragments),
+				fecGroupSize: packet.FECGroupSize,
+				parity:       make(map[int][]byte),
+			}
+		}
+		if err := rec.add(packet); err != nil {
+			t.Fatalf("add failed: %v", err)
+		}
+	}
+	if rec == nil || rec.received < len(rec.fragments) {
+		return nil
+	}
+	return rec.assemble()
+}
+
+func TestUDPParityRebuildsLostPacket(t *testing.T) {
+	u := NewUDPStream("127.0.0.1:0", ramstream.DROutputStream, nil)
+	u.PacketLen = UDP_HEADER_LEN + 100
+	u.FECGroupSize = 3
+	record := testRecord(945, 9) // 10 fragments, the last shorter, in groups of 3, 3, 3 and 1
+	packets, err := u.packets(record)
+	if err != nil {
+		t.Fatalf("packets failed: %v", err)
+	}
+	if len(packets) != 14 {
+		t.Fatalf("Expected 10 data and 4 parity packets, got %d", len(packets))
+	}
+
+	// packets are data 0-2, parity 0, data 3-5, parity 1, data 6-8, parity 2, data 9, parity 3
+	drop := func(indices ...int) [][]byte {
+		kept := [][]byte{}
+		for i, packet := range packets {
+			dropped := false
+			for _, d := range indices {
+				dropped = dropped || d == i
+			}
+			if !dropped {
+				kept = append(kept, packet)
+			}
+		}
+		return kept
+	}
+	// One data packet lost from every group, including the short last one
+	if got := reassemble(t, drop(1, 4, 10, 12)); !bytes.Equal(got, record) {
+		t.Error("Expected every group to be rebuilt from its parity")
+	}
+	// Parity arriving before the rest of its group
+	reordered := append([][]byte{packets[3]}, drop(0, 3)...)
+	if got := reassemble(t, reordered); !bytes.Equal(got, record) {
+		t.Error("Expected the group to be rebuilt when parity arrives first")
+	}
+	// Two lost from one group cannot be rebuilt
+	if got := reassemble(t, drop(0, 1)); got != nil {
+		t.Error("Expected record with two packets lost from one group to stay incomplete")
+	}
+}
+
+func TestUDPPacketChecksum(t *testing.T) {
+	packet := encodeUDPPacket(nil, udpPacket{Session: 1, Sequence: 2, RecordLen: 5, Fragments: 1, Payload: []byte("hello")})
+	if _, err := decodeUDPPacket(packet); err != nil {
+		t.Fatalf("decodeUDPPacket failed: %v", err)
+	}
+	packet[len(packet)-1] ^= 0xff
+	if _, err := decodeUDPPacket(packet); err == nil {
+		t.Error("Expected checksum error for a corrupted packet")
+	}
+	if _, err := decodeUDPPacket(packet[:10]); err == nil {
+		t.Error("Expected error for a truncated packet")
+	}
+}
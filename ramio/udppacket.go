@@ -0,0 +1,114 @@
+package ramio
+
+import (
+	"bytes"
+	"data_ram/ramformats"
+	"encoding/binary"
+	"fmt"
+)
+
+// UDP packets
+// Each record written to a UDPStream is split into fragments that fit in one
+// datagram. Every packet carries enough to place it without any other packet:
+//
+// magic(4), session(4), sequence(4), record length(4), index(2), fragments(2),
+// kind(1), FEC group size(1), crc32c(4), payload
+//
+// The session is random per sender so a restarted sender does not collide with
+// sequence numbers the receiver has already seen. Records are split into
+// fragments of equal size, bar a shorter last one. Data packets carry the
+// fragment index. Parity packets carry the index of their FEC group, the
+// XOR of the group's data fragments padded to the fragment size, so any one lost
+// fragment of a group can be rebuilt. The checksum covers the header before it
+// and the payload.
+
+var UDP_PACKET_MAGIC = []byte{0xda, 0x1a, 0x0d, 0x01}
+
+// UDP packet kinds
+const (
+	UDP_PACKET_DATA       = 0
+	UDP_PACKET_XOR_PARITY = 1
+)
+
+const (
+	UDP_HEADER_LEN         = 26
+	udpChecksumPos         = UDP_HEADER_LEN - 4
+	maxUDPFragments        = 1<<16 - 1
+	maxUDPFECGroupSize     = 1<<8 - 1
+	DEFAULT_UDP_PACKET_LEN = 1400 // Fits a typical 1500 byte MTU with IP and UDP headers
+)
+
+// udpPacket is a decoded UDP packet.
+type udpPacket struct {
+	Session      uint32
+	Sequence     uint32
+	RecordLen    int
+	Index        int
+	Fragments    int
+	Kind         int
+	FECGroupSize int
+	Payload      []byte
+}
+
+// encodeUDPPacket appends the encoded packet to dst.
+func encodeUDPPacket(dst []byte, p udpPacket) []byte {
+	start := len(dst)
+	dst = append(dst, UDP_PACKET_MAGIC...)
+	dst = binary.BigEndian.AppendUint32(dst, p.Session)
+	dst = binary.BigEndian.AppendUint32(dst, p.Sequence)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(p.RecordLen))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(p.Index))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(p.Fragments))
+	dst = append(dst, byte(p.Kind), byte(p.FECGroupSize))
+	checksum := ramformats.SegmentChecksum(append(dst[start:], p.Payload...))
+	dst = binary.BigEndian.AppendUint32(dst, checksum)
+	return append(dst, p.Payload...)
+}
+
+// decodeUDPPacket checks and decodes a packet. The payload aliases data.
+func decodeUDPPacket(data []byte) (udpPacket, error) {
+	p := udpPacket{}
+	if len(data) < UDP_HEADER_LEN {
+		return p, fmt.Errorf("UDP packet too short: %d bytes", len(data))
+	}
+	if !bytes.Equal(data[0:4], UDP_PACKET_MAGIC) {
+		return p, fmt.Errorf("Unrecognised UDP packet header: %x", data[0:4])
+	}
+	checksum := binary.BigEndian.Uint32(data[udpChecksumPos:UDP_HEADER_LEN])
+	covered := make([]byte, 0, len(data)-4)
+	covered = append(append(covered, data[:udpChecksumPos]...), data[UDP_HEADER_LEN:]...)
+	if ramformats.SegmentChecksum(covered) != checksum {
+		return p, fmt.Errorf("%w: UDP packet", ramformats.ErrChecksumMismatch)
+	}
+	p.Session = binary.BigEndian.Uint32(data[4:8])
+	p.Sequence = binary.BigEndian.Uint32(data[8:12])
+	p.RecordLen = int(binary.BigEndian.Uint32(data[12:16]))
+	p.Index = int(binary.BigEndian.Uint16(data[16:18]))
+	p.Fragments = int(binary.BigEndian.Uint16(data[18:20]))
+	p.Kind = int(data[20])
+	p.FECGroupSize = int(data[21])
+	p.Payload = data[UDP_HEADER_LEN:]
+	if p.Fragments == 0 {
+		return p, fmt.Errorf("UDP packet for a record with no fragments")
+	}
+	return p, nil
+}
+
+// udpFragmentSize returns the size of every data fragment of a record but the last,
+// which may be shorter. Records are split evenly so the receiver can work it out.
+func udpFragmentSize(recordLen int, fragments int) int {
+	return (recordLen + fragments - 1) / fragments
+}
+
+// udpFragmentLen returns the payload length of data fragment i of a record.
+func udpFragmentLen(recordLen int, fragments int, i int) int {
+	size := udpFragmentSize(recordLen, fragments)
+	return max(0, min(size, recordLen-i*size))
+}
+
+// xorInto XORs src into dst, which must be at least as long.
+func xorInto(dst []byte, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
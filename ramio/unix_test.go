@@ -0,0 +1,58 @@
+package ramio
+
+import (
+	"data_ram/ramstream"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixStream(t *testing.T) {
+	output := &recordingStream{}
+	path := filepath.Join(t.TempDir(), "dataram.sock")
+
+	// A socket left behind by a listener that crashed is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to create stale socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	unixListener := NewUnixStream(path, ramstream.DROutputStream, output)
+	go unixListener.Listen(1024 * 1024)
+	time.Sleep(100 * time.Millisecond)
+
+	unixSender := NewUnixStream(path, ramstream.DROutputStream, nil)
+	records := [][]byte{testRecord(7, 1), testRecord(200000, 2)}
+	for _, record := range records {
+		n, err := unixSender.Write(record)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if n != len(record) {
+			t.Fatalf("Write length mismatch: got %d, want %d", n, len(record))
+		}
+	}
+	writes := output.Writes()
+	if len(writes) != len(records) {
+		t.Fatalf("Expected %d records, got %d", len(records), len(writes))
+	}
+	for i, record := range records {
+		if writes[i] != string(record) {
+			t.Errorf("Record %d was not delivered intact", i)
+		}
+	}
+
+	// A second listener must not steal a socket that is in use
+	if err := NewUnixStream(path, ramstream.DROutputStream, output).Listen(1024); err == nil {
+		t.Error("Expected an error listening on a socket in use")
+	}
+
+	unixListener.Flush()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed on Flush, got %v", err)
+	}
+}
@@ -0,0 +1,376 @@
+package ramio
+
+import (
+	"bytes"
+	"crypto/tls"
+	"data_ram/ramstream"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Path served by NewWebSocketHandler
+const WEBSOCKET_PATH = "/dataram/ws"
+
+// Timings of the ping/pong that keeps WebSocket connections alive through proxies
+const (
+	wsPingInterval = 15 * time.Second // A sender pings its open connection this often
+	wsPongWait     = 60 * time.Second // A listener drops a connection silent for this long
+	wsReplyWait    = 60 * time.Second // A sender gives up on a reply after this long
+	wsWriteWait    = 10 * time.Second
+)
+
+// WebSocketStream carries records in binary WebSocket messages, so bundles can be
+// tunnelled through HTTP proxies and load balancers that terminate TLS. Each message
+// starts with a TCP_DATA or TCP_NACK byte followed by the record or nack request,
+// and is answered as on a TCP connection: a record with the number of bytes written
+// as an int64, a nack request with the reply. Senders ping their connection while it
+// is open, in place of the TCP_KEEPALIVE handshake.
+type WebSocketStream struct {
+	Address        string // host:port
+	StreamType     string
+	InternalStream ramstream.RamStream
+	tlsConfig      *tls.Config // Connections use wss when set
+	conn           *websocket.Conn
+	stopPing       chan struct{} // Closed to stop the pings on conn
+	pingInterval   time.Duration // How often conn is pinged, wsPingInterval unless changed by a test
+	replyWait      time.Duration // How long a send waits for its reply, wsReplyWait unless changed by a test
+	server         *http.Server
+	accepted       map[*websocket.Conn]struct{} // Listener connections, closed by Flush
+	stopped        bool                         // Set by Flush, Listen returns rather than start
+	listenWg       sync.WaitGroup               // Listen and its connection handlers, waited for by Flush
+	mu             sync.Mutex                   // Protects conn, server, accepted and stopped, and serialises sends
+}
+
+// Constructor for WebSocketStream that sets the address and stream type. A nil
+// tlsConfig uses plain ws; listeners need one with a certificate for wss, see
+// LoadServerTLSConfig, and senders one that can verify it, see LoadClientTLSConfig.
+func NewWebSocketStream(address string, streamType string, internalStream ramstream.RamStream, tlsConfig *tls.Config) *WebSocketStream {
+	return &WebSocketStream{
+		Address:        address,
+		StreamType:     streamType,
+		InternalStream: internalStream,
+		tlsConfig:      tlsConfig,
+		pingInterval:   wsPingInterval,
+		replyWait:      wsReplyWait,
+	}
+}
+
+// NewWebSocketHandler serves WEBSOCKET_PATH, writing each record received into
+// internalStream. It can be mounted on an existing server with
+// mux.Handle("/dataram/", handler). maxMessageLen caps the size of a message.
+func NewWebSocketHandler(internalStream ramstream.RamStream, maxMessageLen int) http.Handler {
+	return newWebSocketHandler(internalStream, maxMessageLen, nil)
+}
+
+// newWebSocketHandler is NewWebSocketHandler with the connections it upgrades
+// tracked by ws, if set, so its Flush can close them.
+func newWebSocketHandler(internalStream ramstream.RamStream, maxMessageLen int, ws *WebSocketStream) http.Handler {
+	upgrader := websocket.Upgrader{
+		// Senders are not browsers, so there is no origin to check
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+WEBSOCKET_PATH, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			ramstream.Logf("WebSocket upgrade failed: %v\n", err)
+			return
+		}
+		if ws != nil {
+			if !ws.trackConn(conn) {
+				conn.Close()
+				return
+			}
+			defer ws.untrackConn(conn)
+		}
+		handleWebSocket(conn, internalStream, maxMessageLen)
+	})
+	return mux
+}
+
+// handleWebSocket answers the messages on one connection until it closes.
+func handleWebSocket(conn *websocket.Conn, internalStream ramstream.RamStream, maxMessageLen int) {
+	defer conn.Close()
+	conn.SetReadLimit(int64(maxMessageLen) + 1) // Room for the type byte
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPingHandler(func(appData string) error {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(wsWriteWait))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				ramstream.Logf("WebSocket read failed: %v\n", err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		if messageType != websocket.BinaryMessage || len(message) == 0 {
+			ramstream.Logln("WebSocket received a message that is not a record; closing")
+			return
+		}
+
+		var reply []byte
+		switch message[0] {
+		case TCP_DATA:
+			outN, err := internalStream.Write(message[1:])
+			if err != nil {
+				ramstream.Logf("WebSocket failed to write record: %v\n", err)
+			}
+			reply = int64Bytes(int64(outN))
+		case TCP_NACK:
+			reply = []byte{}
+			if handler, ok := internalStream.(ramstream.RamNackHandler); ok {
+				reply, err = handler.HandleNack(message[1:])
+				if err != nil {
+					ramstream.Logf("WebSocket failed to handle nack request: %v\n", err)
+					return
+				}
+			}
+		default:
+			ramstream.Logf("Unknown WebSocket message type: %d\n", message[0])
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err := conn.WriteMessage(websocket.BinaryMessage, reply); err != nil {
+			ramstream.Logf("WebSocket failed to write reply: %v\n", err)
+			return
+		}
+	}
+}
+
+func (ws *WebSocketStream) Listen(bufferSize int) error {
+	if ws.StreamType != ramstream.DROutputStream {
+		return fmt.Errorf("Cannot listen on input stream")
+	}
+	ws.mu.Lock()
+	if ws.stopped {
+		ws.mu.Unlock()
+		return http.ErrServerClosed
+	}
+	ws.listenWg.Add(1)
+	ws.mu.Unlock()
+	defer ws.listenWg.Done()
+
+	ln, err := net.Listen("tcp", ws.Address)
+	if err != nil {
+		ramstream.Logln("Failed to listen on", ws.Address)
+		return err
+	}
+	server := &http.Server{
+		Handler:           newWebSocketHandler(ws.InternalStream, bufferSize, ws),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	ws.mu.Lock()
+	if ws.stopped {
+		// Flush ran while the listener was being opened
+		ws.mu.Unlock()
+		ln.Close()
+		return http.ErrServerClosed
+	}
+	ws.server = server
+	ws.accepted = make(map[*websocket.Conn]struct{})
+	ws.mu.Unlock()
+
+	// Every connection is handled concurrently so a sender can stripe bundles
+	// across several, InternalStream must be safe for concurrent writes
+	if ws.tlsConfig != nil {
+		ramstream.Logln("WebSocket Listening with TLS on", ws.Address)
+		server.TLSConfig = ws.tlsConfig.Clone()
+		// WebSocket upgrades need HTTP/1.1
+		server.TLSConfig.NextProtos = []string{"http/1.1"}
+		return server.ServeTLS(ln, "", "")
+	}
+	ramstream.Logln("WebSocket Listening on", ws.Address)
+	return server.Serve(ln) // Returns http.ErrServerClosed once Flush is called
+}
+
+// trackConn records a connection the listener upgraded so Flush closes it. It
+// returns false once Flush has run, the connection should then be closed.
+// Upgraded connections are hijacked, so server.Close does not see them.
+func (ws *WebSocketStream) trackConn(conn *websocket.Conn) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.stopped {
+		return false
+	}
+	ws.accepted[conn] = struct{}{}
+	ws.listenWg.Add(1)
+	return true
+}
+
+// untrackConn forgets a connection once its handler has returned.
+func (ws *WebSocketStream) untrackConn(conn *websocket.Conn) {
+	ws.mu.Lock()
+	delete(ws.accepted, conn)
+	ws.mu.Unlock()
+	ws.listenWg.Done()
+}
+
+// url returns the URL of the listener's WebSocket path.
+func (ws *WebSocketStream) url() string {
+	if ws.tlsConfig != nil {
+		return "wss://" + ws.Address + WEBSOCKET_PATH
+	}
+	return "ws://" + ws.Address + WEBSOCKET_PATH
+}
+
+// connect dials a connection if there is none. The caller must hold ws.mu.
+func (ws *WebSocketStream) connect() error {
+	if ws.conn == nil {
+		dialer := websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			TLSClientConfig:  ws.tlsConfig,
+			HandshakeTimeout: 30 * time.Second,
+		}
+		conn, _, err := dialer.Dial(ws.url(), nil)
+		if err != nil {
+			ramstream.Logf("WebSocket dial failed: %v\n", err)
+			return err
+		}
+		ws.conn = conn
+		ws.stopPing = make(chan struct{})
+		go ws.ping(conn, ws.stopPing)
+	}
+	return nil
+}
+
+// ping keeps an idle connection open by pinging it until stop is closed, so
+// neither the listener nor a proxy in between drops it between sends. Pongs are
+// read, and discarded, along with the next reply. WriteControl may be called
+// alongside the writes of a send.
+func (ws *WebSocketStream) ping(conn *websocket.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(ws.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				// The next send fails on the dead connection and dials again
+				ramstream.Logf("WebSocket ping failed: %v\n", err)
+				return
+			}
+		}
+	}
+}
+
+// closeConn drops a connection so the next send dials again. The caller must hold ws.mu.
+func (ws *WebSocketStream) closeConn() {
+	if ws.conn != nil {
+		close(ws.stopPing)
+		ws.conn.Close()
+		ws.conn = nil
+	}
+}
+
+// roundTrip sends one message and returns the listener's reply.
+func (ws *WebSocketStream) roundTrip(messageType byte, body []byte, maxReplyLen int) ([]byte, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if err := ws.connect(); err != nil {
+		return nil, err
+	}
+	message := make([]byte, 1+len(body))
+	message[0] = messageType
+	copy(message[1:], body)
+	if err := ws.conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+		ws.closeConn()
+		return nil, err
+	}
+	ws.conn.SetReadLimit(int64(maxReplyLen))
+	// A listener that stops answering fails the send rather than holding ws.mu
+	ws.conn.SetReadDeadline(time.Now().Add(ws.replyWait))
+	_, reply, err := ws.conn.ReadMessage()
+	if err != nil {
+		ws.closeConn()
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Send writes a record and waits for the listener to answer with the bytes it wrote.
+func (ws *WebSocketStream) Send(data []byte) (int, error) {
+	reply, err := ws.roundTrip(TCP_DATA, data, 8)
+	if err != nil {
+		return 0, err
+	}
+	respN, err := readInt64(bytes.NewReader(reply))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read response: %w", err)
+	}
+	if int(respN) != len(data) {
+		return 0, fmt.Errorf("Could not write over websocket stream: sent %d, got response %d", len(data), respN)
+	}
+	return len(data), nil
+}
+
+// Nack sends a resend request to the listener and returns its reply.
+func (ws *WebSocketStream) Nack(request []byte) ([]byte, error) {
+	reply, err := ws.roundTrip(TCP_NACK, request, maxNackReplyLen)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read nack reply: %w", err)
+	}
+	return reply, nil
+}
+
+func (ws *WebSocketStream) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("Read should not be called on WebSocketStream")
+}
+
+func (ws *WebSocketStream) Write(p []byte) (int, error) {
+	if ws.StreamType != ramstream.DROutputStream {
+		return 0, fmt.Errorf("Cannot write to input stream")
+	}
+	if ws.InternalStream != nil {
+		return 0, fmt.Errorf("Internal stream should not be initialised for WebSocket writing")
+	}
+	return ws.Send(p)
+}
+
+func (ws *WebSocketStream) Reset() error {
+	ws.InternalStream.Reset()
+	return nil
+}
+
+func (ws *WebSocketStream) Len() int {
+	return ws.InternalStream.Len()
+}
+
+// Flush stops a listener, closing the connections it accepted and waiting for
+// Listen and their handlers to return, or closes a sender's connection with a
+// close message. A Listen that has not started yet returns straight away.
+func (ws *WebSocketStream) Flush() error {
+	ws.mu.Lock()
+	ws.stopped = true
+	if ws.server != nil {
+		ws.server.Close()
+		ws.server = nil
+	}
+	for conn := range ws.accepted {
+		conn.Close()
+	}
+	if ws.conn != nil {
+		ws.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteWait))
+		ws.closeConn()
+	}
+	ws.mu.Unlock()
+	ws.listenWg.Wait()
+	return nil
+}
+
+var _ ramstream.RamStream = (*WebSocketStream)(nil)
+var _ ramstream.RamNackSender = (*WebSocketStream)(nil)
@@ -0,0 +1,181 @@
+package ramio
+
+import (
+	"data_ram/ramstream"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketStream(t *testing.T) {
+	output := &nackRecordingStream{}
+	address := "127.0.0.1:9121"
+	wsListener := NewWebSocketStream(address, ramstream.DROutputStream, output, nil)
+	go wsListener.Listen(1024 * 1024)
+	defer wsListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	wsSender := NewWebSocketStream(address, ramstream.DROutputStream, nil, nil)
+	defer wsSender.Flush()
+	records := [][]byte{testRecord(7, 1), testRecord(200000, 2)}
+	for _, record := range records {
+		n, err := wsSender.Write(record)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if n != len(record) {
+			t.Fatalf("Write length mismatch: got %d, want %d", n, len(record))
+		}
+	}
+	writes := output.Writes()
+	if len(writes) != len(records) {
+		t.Fatalf("Expected %d records, got %d", len(records), len(writes))
+	}
+	for i, record := range records {
+		if writes[i] != string(record) {
+			t.Errorf("Record %d was not delivered intact", i)
+		}
+	}
+
+	reply, err := wsSender.Nack([]byte("abc"))
+	if err != nil || string(reply) != "missing:abc" {
+		t.Errorf("Unexpected nack reply %q, err %v", reply, err)
+	}
+
+	if _, err := wsSender.Write(testRecord(2*1024*1024, 3)); err == nil {
+		t.Error("Expected a record over the buffer size to be refused")
+	}
+	// The listener dropped the connection, the next send dials again
+	if _, err := wsSender.Write(records[0]); err != nil {
+		t.Errorf("Write after a dropped connection failed: %v", err)
+	}
+}
+
+func TestWebSocketShortWrite(t *testing.T) {
+	server := httptest.NewServer(NewWebSocketHandler(&failingStream{}, 1024))
+	defer server.Close()
+
+	wsSender := NewWebSocketStream(server.Listener.Addr().String(), ramstream.DROutputStream, nil, nil)
+	defer wsSender.Flush()
+	if _, err := wsSender.Write([]byte("record")); err == nil {
+		t.Error("Expected a failed write on the listener to fail the send")
+	}
+	reply, err := wsSender.Nack([]byte("abc"))
+	if err != nil || len(reply) != 0 {
+		t.Errorf("Expected an empty nack reply, got %q, err %v", reply, err)
+	}
+}
+
+// Flush closes open connections and waits for Listen, even one that has not started yet
+func TestWebSocketFlush(t *testing.T) {
+	unstarted := NewWebSocketStream("127.0.0.1:9127", ramstream.DROutputStream, &recordingStream{}, nil)
+	unstarted.Flush()
+	if err := unstarted.Listen(1024); !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Expected Listen after Flush to return http.ErrServerClosed, got %v", err)
+	}
+
+	address := "127.0.0.1:9127"
+	wsListener := NewWebSocketStream(address, ramstream.DROutputStream, &recordingStream{}, nil)
+	listenDone := make(chan error, 1)
+	go func() { listenDone <- wsListener.Listen(1024) }()
+	time.Sleep(100 * time.Millisecond)
+
+	wsSender := NewWebSocketStream(address, ramstream.DROutputStream, nil, nil)
+	defer wsSender.Flush()
+	if _, err := wsSender.Write([]byte("data")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	wsListener.Flush()
+	select {
+	case <-listenDone:
+	default:
+		t.Fatal("Listen was still running after Flush")
+	}
+	// The connection the sender had open was closed by the listener
+	wsSender.conn.SetReadDeadline(time.Now().Add(time.Second))
+	var netErr net.Error
+	if _, _, err := wsSender.conn.ReadMessage(); err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		t.Errorf("Expected the listener to close the connection, got %v", err)
+	}
+}
+
+// An idle sender keeps pinging, and a listener that never answers fails the send
+func TestWebSocketPingAndReplyWait(t *testing.T) {
+	var pings atomic.Int32
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetPingHandler(func(string) error {
+			pings.Add(1)
+			return nil
+		})
+		// Read, never reply
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	wsSender := NewWebSocketStream(server.Listener.Addr().String(), ramstream.DROutputStream, nil, nil)
+	wsSender.pingInterval = 20 * time.Millisecond
+	wsSender.replyWait = 300 * time.Millisecond
+	defer wsSender.Flush()
+	start := time.Now()
+	if _, err := wsSender.Write([]byte("record")); err == nil {
+		t.Error("Expected a send to a listener that never answers to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send took %v to give up on the reply", elapsed)
+	}
+	if pings.Load() < 3 {
+		t.Errorf("Expected the connection to be pinged while waiting, got %d pings", pings.Load())
+	}
+}
+
+func TestWebSocketTLSStream(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, "server")
+	otherCert, _ := writeTestCert(t, "other")
+	serverConfig, err := LoadServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("LoadServerTLSConfig failed: %v", err)
+	}
+	trusted, err := LoadClientTLSConfig(certFile, "", "")
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+	untrusted, err := LoadClientTLSConfig(otherCert, "", "")
+	if err != nil {
+		t.Fatalf("LoadClientTLSConfig failed: %v", err)
+	}
+
+	output := &recordingStream{}
+	address := "127.0.0.1:9122"
+	wssListener := NewWebSocketStream(address, ramstream.DROutputStream, output, serverConfig)
+	go wssListener.Listen(1024 * 1024)
+	defer wssListener.Flush()
+	time.Sleep(100 * time.Millisecond)
+
+	wssSender := NewWebSocketStream(address, ramstream.DROutputStream, nil, trusted)
+	defer wssSender.Flush()
+	if _, err := wssSender.Write([]byte("record")); err != nil {
+		t.Fatalf("Write over wss failed: %v", err)
+	}
+	if _, err := NewWebSocketStream(address, ramstream.DROutputStream, nil, untrusted).Write([]byte("x")); err == nil {
+		t.Error("Expected certificate verification to fail")
+	}
+	if writes := output.Writes(); len(writes) != 1 || writes[0] != "record" {
+		t.Errorf("Unexpected writes %q", writes)
+	}
+}
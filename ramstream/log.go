@@ -0,0 +1,27 @@
+package ramstream
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+// Logger takes the log lines of every package in the pipeline. It writes to
+// stdout unless SetLogOutput points it elsewhere, as a sender using stdout for
+// records must so nothing logged lands in the middle of the stream.
+var Logger = log.New(os.Stdout, "", 0)
+
+// SetLogOutput sends the log to w.
+func SetLogOutput(w io.Writer) {
+	Logger.SetOutput(w)
+}
+
+// Logf logs a line, formatted like fmt.Printf.
+func Logf(format string, args ...any) {
+	Logger.Printf(format, args...)
+}
+
+// Logln logs a line, formatted like fmt.Println.
+func Logln(args ...any) {
+	Logger.Println(args...)
+}
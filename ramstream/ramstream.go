@@ -17,3 +17,23 @@ type RamStream interface {
 	Len() int
 	Flush() error
 }
+
+// RamListener is implemented by streams that accept data from a remote sender
+// and write it into their internal stream.
+type RamListener interface {
+	Listen(bufferSize int) error
+	Flush() error
+}
+
+// RamNackSender is implemented by sender streams with a control channel back
+// to the receiver. Nack sends a request for what the receiver is still missing
+// and returns its reply, an empty reply means the receiver cannot answer.
+type RamNackSender interface {
+	Nack(request []byte) ([]byte, error)
+}
+
+// RamNackHandler is implemented by internal streams that can answer the
+// requests a RamNackSender makes.
+type RamNackHandler interface {
+	HandleNack(request []byte) ([]byte, error)
+}